@@ -0,0 +1,352 @@
+// Package config loads the server configuration. Values are layered, each
+// source overriding the previous one: built-in defaults, a JSON config file
+// (--config or CONFIG_FILE), environment variables and command-line flags.
+package config
+
+import (
+	"backend/models"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	DatabaseURL string   `json:"databaseUrl"`
+	ListenAddr  string   `json:"listenAddr"`
+	CORSOrigins []string `json:"corsOrigins"`
+	LogLevel    string   `json:"logLevel"`
+	SwaggerFile string   `json:"swaggerFile"`
+
+	Pagination Pagination `json:"pagination"`
+	Rules      Rules      `json:"rules"`
+	Limits     Limits     `json:"limits"`
+	Import     Import     `json:"import"`
+	Auth       Auth       `json:"auth"`
+
+	IdempotencyRetention Duration `json:"idempotencyRetention"`
+	HoldTTL              Duration `json:"holdTtl"`
+
+	// PrintConfig asks main to print the effective config and exit
+	PrintConfig bool `json:"-"`
+	// Args are the command-line arguments left after the flags
+	Args []string `json:"-"`
+}
+
+type Pagination struct {
+	DefaultPageSize    int `json:"defaultPageSize"`
+	MaxPageSize        int `json:"maxPageSize"`
+	DefaultLedgerLimit int `json:"defaultLedgerLimit"`
+}
+
+// Rules toggles the business rules that are not part of the core ledger
+// invariants. NoRepeatRecipient is a shorthand for a same_recipient rule
+// without cooldown; Transfer lists further transfer rules, which can only be
+// set in the config file.
+type Rules struct {
+	NoRepeatRecipient bool                  `json:"noRepeatRecipient"`
+	MaxNameLength     int                   `json:"maxNameLength"`
+	Transfer          []models.TransferRule `json:"transfer,omitempty"`
+}
+
+// Limits caps what users may send per rolling day and month. Each user is in
+// a tier, or in DefaultTier when they have none; admins can override the
+// limits of single users. Tiers can only be set in the config file.
+type Limits struct {
+	DefaultTier string                           `json:"defaultTier"`
+	Tiers       map[string]models.TransferLimits `json:"tiers"`
+}
+
+// Import configures POST /api/admin/users/import. Commit is "all" to create
+// the users of a file in one transaction, only when every row is valid, or
+// "row" to create each valid row on its own.
+type Import struct {
+	Commit  string `json:"commit"`
+	MaxRows int    `json:"maxRows"`
+}
+
+// Auth configures access tokens. When JWTSecret is empty the server signs
+// with a random key, so tokens do not survive a restart.
+type Auth struct {
+	JWTSecret string   `json:"jwtSecret"`
+	TokenTTL  Duration `json:"tokenTtl"`
+}
+
+// Duration is a time.Duration written as a string such as "15m" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+var logLevels = map[string]bool{"debug": true, "info": true, "warn": true, "error": true}
+
+func Default() *Config {
+	return &Config{
+		DatabaseURL: "./data.db",
+		ListenAddr:  ":3000",
+		CORSOrigins: []string{"*"},
+		LogLevel:    "info",
+		SwaggerFile: "./swagger.yml",
+		Pagination: Pagination{
+			DefaultPageSize:    20,
+			MaxPageSize:        200,
+			DefaultLedgerLimit: 50,
+		},
+		Rules: Rules{
+			NoRepeatRecipient: true,
+			MaxNameLength:     3,
+		},
+		Limits: Limits{
+			DefaultTier: "standard",
+			Tiers:       map[string]models.TransferLimits{"standard": {}},
+		},
+		Import: Import{
+			Commit:  models.ImportCommitAll,
+			MaxRows: 10000,
+		},
+		Auth: Auth{
+			TokenTTL: Duration(time.Hour),
+		},
+		IdempotencyRetention: Duration(24 * time.Hour),
+		HoldTTL:              Duration(15 * time.Minute),
+	}
+}
+
+// Load builds the configuration from args (normally os.Args[1:]) and the
+// process environment, then validates it.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("backend", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path of a JSON config file")
+	fs.BoolVar(&cfg.PrintConfig, "print-config", false, "print the effective config with secrets redacted and exit")
+
+	// Flags override the file and the environment, so they are applied last
+	flags := map[string]string{}
+	for _, s := range settings {
+		s := s
+		fs.Func(s.flag, s.usage, func(v string) error {
+			flags[s.flag] = v
+			return s.set(Default(), v)
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	cfg.Args = fs.Args()
+
+	if *configFile != "" {
+		if err := cfg.readFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if v := os.Getenv(s.env); v != "" {
+			if err := s.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := flags[s.flag]; ok {
+			s.set(cfg, v)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.DatabaseURL == "" {
+		errs = append(errs, errors.New("databaseUrl is required"))
+	}
+	if c.ListenAddr == "" {
+		errs = append(errs, errors.New("listenAddr is required"))
+	}
+	if len(c.CORSOrigins) == 0 {
+		errs = append(errs, errors.New("corsOrigins must list at least one origin"))
+	}
+	if !logLevels[c.LogLevel] {
+		errs = append(errs, fmt.Errorf("logLevel must be one of debug, info, warn, error; got %q", c.LogLevel))
+	}
+	if c.Pagination.MaxPageSize < 1 {
+		errs = append(errs, errors.New("pagination.maxPageSize must be at least 1"))
+	}
+	if c.Pagination.DefaultPageSize < 1 || c.Pagination.DefaultPageSize > c.Pagination.MaxPageSize {
+		errs = append(errs, errors.New("pagination.defaultPageSize must be between 1 and maxPageSize"))
+	}
+	if c.Pagination.DefaultLedgerLimit < 1 || c.Pagination.DefaultLedgerLimit > c.Pagination.MaxPageSize {
+		errs = append(errs, errors.New("pagination.defaultLedgerLimit must be between 1 and maxPageSize"))
+	}
+	if c.Rules.MaxNameLength < 1 {
+		errs = append(errs, errors.New("rules.maxNameLength must be at least 1"))
+	}
+	if _, ok := c.Limits.Tiers[c.Limits.DefaultTier]; !ok {
+		errs = append(errs, fmt.Errorf("limits.defaultTier %q is not one of limits.tiers", c.Limits.DefaultTier))
+	}
+	for name, limits := range c.Limits.Tiers {
+		if limits.DailyAmount < 0 || limits.DailyCount < 0 || limits.MonthlyAmount < 0 || limits.MonthlyCount < 0 {
+			errs = append(errs, fmt.Errorf("limits.tiers.%s must not be negative", name))
+		}
+	}
+	if c.Import.Commit != models.ImportCommitAll && c.Import.Commit != models.ImportCommitRow {
+		errs = append(errs, fmt.Errorf("import.commit must be all or row; got %q", c.Import.Commit))
+	}
+	if c.Import.MaxRows < 1 {
+		errs = append(errs, errors.New("import.maxRows must be at least 1"))
+	}
+	if c.Auth.JWTSecret != "" && len(c.Auth.JWTSecret) < 32 {
+		errs = append(errs, errors.New("auth.jwtSecret must be at least 32 bytes"))
+	}
+	if c.Auth.TokenTTL <= 0 {
+		errs = append(errs, errors.New("auth.tokenTtl must be positive"))
+	}
+	if c.IdempotencyRetention < 0 {
+		errs = append(errs, errors.New("idempotencyRetention must not be negative"))
+	}
+	if c.HoldTTL <= 0 {
+		errs = append(errs, errors.New("holdTtl must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// LogEnabled reports whether messages at level should be logged.
+func (c *Config) LogEnabled(level string) bool {
+	order := map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+	return order[level] >= order[c.LogLevel]
+}
+
+// Redacted returns a copy of the config that is safe to print: the JWT secret
+// and passwords in the database URL are masked.
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.CORSOrigins = append([]string(nil), c.CORSOrigins...)
+	if r.Auth.JWTSecret != "" {
+		r.Auth.JWTSecret = "[redacted]"
+	}
+	if u, err := url.Parse(c.DatabaseURL); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			r.DatabaseURL = u.Redacted()
+		}
+	}
+	return &r
+}
+
+// setting binds one config value to its environment variable and flag.
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+var settings = []setting{
+	{"DATABASE_URL", "database-url", "SQLite file path or postgres:// URL", func(c *Config, v string) error {
+		c.DatabaseURL = v
+		return nil
+	}},
+	{"LISTEN_ADDR", "listen", "address the HTTP server listens on", func(c *Config, v string) error {
+		c.ListenAddr = v
+		return nil
+	}},
+	{"CORS_ORIGINS", "cors-origins", "comma-separated allowed CORS origins", func(c *Config, v string) error {
+		c.CORSOrigins = splitList(v)
+		return nil
+	}},
+	{"LOG_LEVEL", "log-level", "debug, info, warn or error", func(c *Config, v string) error {
+		c.LogLevel = strings.ToLower(v)
+		return nil
+	}},
+	{"SWAGGER_FILE", "swagger-file", "path of the OpenAPI spec served at /swagger.yml", func(c *Config, v string) error {
+		c.SwaggerFile = v
+		return nil
+	}},
+	{"DEFAULT_PAGE_SIZE", "default-page-size", "page size when none is requested", intSetter(func(c *Config) *int { return &c.Pagination.DefaultPageSize })},
+	{"MAX_PAGE_SIZE", "max-page-size", "largest page size or ledger limit a client may request", intSetter(func(c *Config) *int { return &c.Pagination.MaxPageSize })},
+	{"DEFAULT_LEDGER_LIMIT", "default-ledger-limit", "ledger entries per page when no limit is requested", intSetter(func(c *Config) *int { return &c.Pagination.DefaultLedgerLimit })},
+	{"RULE_NO_REPEAT_RECIPIENT", "no-repeat-recipient", "reject a transfer to the sender's previous recipient", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Rules.NoRepeatRecipient = b
+		return err
+	}},
+	{"RULE_MAX_NAME_LENGTH", "max-name-length", "maximum length of first and last names", intSetter(func(c *Config) *int { return &c.Rules.MaxNameLength })},
+	{"IMPORT_COMMIT", "import-commit", "all to import a file in one transaction, row to import each valid row", func(c *Config, v string) error {
+		c.Import.Commit = v
+		return nil
+	}},
+	{"IMPORT_MAX_ROWS", "import-max-rows", "most rows a user import may have", intSetter(func(c *Config) *int { return &c.Import.MaxRows })},
+	{"JWT_SECRET", "jwt-secret", "HS256 key for access tokens, at least 32 bytes", func(c *Config, v string) error {
+		c.Auth.JWTSecret = v
+		return nil
+	}},
+	{"TOKEN_TTL", "token-ttl", "lifetime of access tokens", durationSetter(func(c *Config) *Duration { return &c.Auth.TokenTTL })},
+	{"IDEMPOTENCY_RETENTION", "idempotency-retention", "how long an Idempotency-Key replays its request", durationSetter(func(c *Config) *Duration { return &c.IdempotencyRetention })},
+	{"HOLD_TTL", "hold-ttl", "how long a pending transfer keeps its hold", durationSetter(func(c *Config) *Duration { return &c.HoldTTL })},
+}
+
+func intSetter(field func(c *Config) *int) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		*field(c) = n
+		return err
+	}
+}
+
+func durationSetter(field func(c *Config) *Duration) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		*field(c) = Duration(d)
+		return err
+	}
+}
+
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -1,19 +1,25 @@
 package main
 
 import (
+	"backend/handlers"
+	"log"
+
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 )
 
+// ErrorHandler writes every error as application/problem+json carrying the
+// request ID, so a client report can be matched with the server log. Messages
+// are in the language picked by handlers.Language.
 func ErrorHandler(c *fiber.Ctx, err error) error {
-	code := fiber.StatusInternalServerError
-	message := err.Error()
+	lang := handlers.Language(c)
+	problem := handlers.NewProblem(err, lang)
+	problem.RequestID, _ = c.Locals(requestid.ConfigDefault.ContextKey).(string)
 
-	if e, ok := err.(*fiber.Error); ok {
-		code = e.Code
-		message = e.Message
+	if problem.Status == fiber.StatusInternalServerError {
+		log.Printf("request %s: %s %s: %v", problem.RequestID, c.Method(), c.Path(), err)
 	}
 
-	return c.Status(code).JSON(fiber.Map{
-		"error": message,
-	})
+	c.Set(fiber.HeaderContentLanguage, lang)
+	return c.Status(problem.Status).JSON(problem, "application/problem+json")
 }
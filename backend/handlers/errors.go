@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"backend/i18n"
+	"backend/services"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// errorStatus maps the codes of service errors to HTTP statuses. Service
+// errors with a code that is not listed are reported as 500.
+var errorStatus = map[string]int{
+	services.ErrValidation.Code:            fiber.StatusBadRequest,
+	services.ErrInvalidQuery.Code:          fiber.StatusBadRequest,
+	services.ErrInvalidIdempotencyKey.Code: fiber.StatusBadRequest,
+	services.ErrInvalidCSV.Code:            fiber.StatusBadRequest,
+	services.ErrInvalidBody.Code:           fiber.StatusBadRequest,
+
+	services.ErrUnauthenticated.Code:    fiber.StatusUnauthorized,
+	services.ErrInvalidCredentials.Code: fiber.StatusUnauthorized,
+	services.ErrInvalidToken.Code:       fiber.StatusUnauthorized,
+	services.ErrInvalidAPIKey.Code:      fiber.StatusUnauthorized,
+
+	services.ErrForbidden.Code: fiber.StatusForbidden,
+
+	services.ErrUserNotFound.Code:     fiber.StatusNotFound,
+	services.ErrTransferNotFound.Code: fiber.StatusNotFound,
+	services.ErrAPIKeyNotFound.Code:   fiber.StatusNotFound,
+
+	services.ErrIdempotencyKeyInProgress.Code:     fiber.StatusConflict,
+	services.ErrInsufficientBalance.Code:          fiber.StatusConflict,
+	services.ErrIllegalTransition.Code:            fiber.StatusConflict,
+	services.ErrTransferExpired.Code:              fiber.StatusConflict,
+	services.ErrRecipientInsufficientBalance.Code: fiber.StatusConflict,
+	services.ErrUsernameTaken.Code:                fiber.StatusConflict,
+	services.ErrAccountClosed.Code:                fiber.StatusConflict,
+	services.ErrBalanceRemaining.Code:             fiber.StatusConflict,
+	services.ErrPendingHolds.Code:                 fiber.StatusConflict,
+
+	services.ErrPreconditionFailed.Code: fiber.StatusPreconditionFailed,
+
+	services.ErrUnsupportedMediaType.Code: fiber.StatusUnsupportedMediaType,
+
+	services.ErrSameRecipient.Code:         fiber.StatusUnprocessableEntity,
+	services.ErrAmountBelowMinimum.Code:    fiber.StatusUnprocessableEntity,
+	services.ErrAmountAboveMaximum.Code:    fiber.StatusUnprocessableEntity,
+	services.ErrDailyLimitExceeded.Code:    fiber.StatusUnprocessableEntity,
+	services.ErrWeeklyLimitExceeded.Code:   fiber.StatusUnprocessableEntity,
+	services.ErrTransferBlocked.Code:       fiber.StatusUnprocessableEntity,
+	services.ErrOutsideTransferWindow.Code: fiber.StatusUnprocessableEntity,
+	services.ErrTransferLimitExceeded.Code: fiber.StatusUnprocessableEntity,
+	services.ErrIdempotencyKeyReused.Code:  fiber.StatusUnprocessableEntity,
+}
+
+// Problem is an RFC 7807 application/problem+json body. Code is stable and
+// meant for clients to match on; Detail is for humans and may change.
+type Problem struct {
+	Type        string                `json:"type"`
+	Title       string                `json:"title"`
+	Status      int                   `json:"status"`
+	Code        string                `json:"code"`
+	Rule        string                `json:"rule,omitempty"` // the transfer rule or limit that rejected the request
+	Item        *int                  `json:"item,omitempty"` // the index of the transfer that rejected a batch
+	Detail      string                `json:"detail,omitempty"`
+	FieldErrors []services.FieldError `json:"field_errors,omitempty"`
+	RequestID   string                `json:"request_id,omitempty"`
+}
+
+// NewProblem describes err for the client in lang. Service errors get the
+// status of their code, fiber errors keep their status, and anything else is
+// a 500 whose cause is not exposed.
+func NewProblem(err error, lang string) *Problem {
+	p := &Problem{
+		Type:   "about:blank",
+		Status: fiber.StatusInternalServerError,
+		Code:   "internal_error",
+		Detail: i18n.T(lang, "internal_error", nil),
+	}
+
+	var invalid *services.ValidationError
+	var serviceErr *services.Error
+	var fiberErr *fiber.Error
+	switch {
+	case errors.As(err, &invalid):
+		p.Status = errorStatus[services.ErrValidation.Code]
+		p.Code = services.ErrValidation.Code
+		p.Detail = services.ErrValidation.Message(lang)
+		p.FieldErrors = make([]services.FieldError, len(invalid.Fields))
+		for i, f := range invalid.Fields {
+			p.FieldErrors[i] = f.Localize(lang)
+		}
+	case errors.As(err, &serviceErr):
+		if status, ok := errorStatus[serviceErr.Code]; ok {
+			p.Status = status
+			p.Code = serviceErr.Code
+			p.Detail = serviceErr.Message(lang)
+		}
+	case errors.As(err, &fiberErr):
+		p.Status = fiberErr.Code
+		p.Code = strings.ToLower(strings.ReplaceAll(http.StatusText(fiberErr.Code), " ", "_"))
+		p.Detail = fiberErr.Message
+	}
+
+	var ruleErr *services.RuleError
+	if errors.As(err, &ruleErr) {
+		p.Rule = ruleErr.Rule
+	}
+	var batchErr *services.BatchError
+	if errors.As(err, &batchErr) {
+		p.Item = &batchErr.Index
+	}
+
+	p.Title = http.StatusText(p.Status)
+	return p
+}
+
+// Language picks the language of messages for the request: the locale
+// preference of the signed-in user, then the Accept-Language header, then
+// English.
+func Language(c *fiber.Ctx) string {
+	if p := principal(c); p != nil && p.Locale != "" && i18n.Supported(p.Locale) {
+		return p.Locale
+	}
+	return i18n.Match(c.Get(fiber.HeaderAcceptLanguage))
+}
+
+// actor identifies who triggered a state change in audit records.
+func actor(c *fiber.Ctx) string {
+	if p := principal(c); p != nil && p.APIKeyID != 0 {
+		return fmt.Sprintf("apikey:%d", p.APIKeyID)
+	}
+	if p := principal(c); p != nil {
+		return fmt.Sprintf("user:%d", p.UserID)
+	}
+	return "api"
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/services"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type APIKeyHandler struct {
+	service *services.APIKeyService
+}
+
+func NewAPIKeyHandler(service *services.APIKeyService) *APIKeyHandler {
+	return &APIKeyHandler{service: service}
+}
+
+// CreateAPIKey responds with the raw key; it is not shown again.
+func (h *APIKeyHandler) CreateAPIKey(c *fiber.Ctx) error {
+	var req models.CreateAPIKeyRequest
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+
+	key, err := h.service.Create(&req)
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Status(fiber.StatusCreated).JSON(key)
+}
+
+func (h *APIKeyHandler) ListAPIKeys(c *fiber.Ctx) error {
+	keys, err := h.service.List()
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"data": keys})
+}
+
+func (h *APIKeyHandler) RevokeAPIKey(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return invalidParam("id", "integer")
+	}
+
+	if err := h.service.Revoke(id); err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type AuthHandler struct {
+	service *services.AuthService
+}
+
+func NewAuthHandler(service *services.AuthService) *AuthHandler {
+	return &AuthHandler{service: service}
+}
+
+func (h *AuthHandler) Register(c *fiber.Ctx) error {
+	var req models.RegisterRequest
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+
+	user, err := h.service.Register(&req)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(user)
+}
+
+func (h *AuthHandler) Login(c *fiber.Ctx) error {
+	var req models.LoginRequest
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+
+	token, err := h.service.Login(&req)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(token)
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/services"
+	"bufio"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type LedgerHandler struct {
+	service *services.LedgerService
+}
+
+func NewLedgerHandler(service *services.LedgerService) *LedgerHandler {
+	return &LedgerHandler{service: service}
+}
+
+func (h *LedgerHandler) ListUserLedger(c *fiber.Ctx) error {
+	userID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return invalidParam("id", "integer")
+	}
+
+	q := models.LedgerListQuery{
+		UserID:    userID,
+		EventType: c.Query("event_type"),
+	}
+
+	if v := c.Query("from"); v != "" {
+		from, err := parseTimeQuery(v, false)
+		if err != nil {
+			return invalidParam("from", "time")
+		}
+		q.From = &from
+	}
+	if v := c.Query("to"); v != "" {
+		to, err := parseTimeQuery(v, true)
+		if err != nil {
+			return invalidParam("to", "time")
+		}
+		q.To = &to
+	}
+	if v := c.Query("transfer_id"); v != "" {
+		transferID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return invalidParam("transfer_id", "integer")
+		}
+		q.TransferID = &transferID
+	}
+	if v := c.Query("cursor"); v != "" {
+		q.Cursor, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || q.Cursor < 1 {
+			return services.ErrInvalidQuery.Variant("invalid_cursor", nil)
+		}
+	}
+	q.Limit, _ = strconv.Atoi(c.Query("limit"))
+
+	result, err := h.service.List(&q)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(result)
+}
+
+// ExportStatement streams the statement of a user for a period as CSV, JSON
+// Lines or printable HTML. Problems with the query are reported as usual;
+// once the first byte is sent, an error can only cut the body short.
+func (h *LedgerHandler) ExportStatement(c *fiber.Ctx) error {
+	userID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return invalidParam("id", "integer")
+	}
+
+	q := models.StatementQuery{
+		UserID: userID,
+		Format: c.Query("format"),
+	}
+	if v := c.Query("from"); v != "" {
+		from, err := parseTimeQuery(v, false)
+		if err != nil {
+			return invalidParam("from", "time")
+		}
+		q.From = &from
+	}
+	if v := c.Query("to"); v != "" {
+		to, err := parseTimeQuery(v, true)
+		if err != nil {
+			return invalidParam("to", "time")
+		}
+		q.To = &to
+	}
+
+	st, err := h.service.Statement(&q)
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderContentType, statementTypes[st.Format])
+	if st.Format != "html" {
+		c.Attachment(fmt.Sprintf("statement-%d-%s.%s", st.User.ID, st.From.Format("2006-01-02"), st.Format))
+	}
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := writeStatement(w, st, func(fn func(*models.StatementEntry) error) error {
+			return h.service.StreamStatement(st, fn)
+		}); err != nil {
+			log.Printf("Failed to stream the statement of user %d: %v", st.User.ID, err)
+		}
+	})
+	return nil
+}
+
+// parseTimeQuery accepts RFC 3339 timestamps or plain dates. A plain date used
+// as an upper bound covers the whole day, so it is moved to the next midnight.
+func parseTimeQuery(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/services"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type LimitsHandler struct {
+	service *services.TransferService
+}
+
+func NewLimitsHandler(service *services.TransferService) *LimitsHandler {
+	return &LimitsHandler{service: service}
+}
+
+// GetLimits responds with the limits of the user and their usage over the
+// rolling day and month.
+func (h *LimitsHandler) GetLimits(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return invalidParam("id", "integer")
+	}
+
+	limits, err := h.service.GetLimits(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(limits)
+}
+
+func (h *LimitsHandler) SetLimits(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return invalidParam("id", "integer")
+	}
+
+	var req models.SetLimitsRequest
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+
+	limits, err := h.service.SetLimits(id, &req)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(limits)
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/services"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type PointsHandler struct {
+	service *services.PointsService
+}
+
+func NewPointsHandler(service *services.PointsService) *PointsHandler {
+	return &PointsHandler{service: service}
+}
+
+// pointsOperation is an earn, redeem or adjust of the points service; Req is
+// the type of its body.
+type pointsOperation[Req any] func(userID int64, req *Req, idemKey string) (*models.PointLedger, bool, error)
+
+func (h *PointsHandler) Earn(c *fiber.Ctx) error {
+	return handlePoints(c, h.service.Earn)
+}
+
+func (h *PointsHandler) Redeem(c *fiber.Ctx) error {
+	return handlePoints(c, h.service.Redeem)
+}
+
+func (h *PointsHandler) Adjust(c *fiber.Ctx) error {
+	return handlePoints(c, h.service.Adjust)
+}
+
+func handlePoints[Req any](c *fiber.Ctx, op pointsOperation[Req]) error {
+	userID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return invalidParam("id", "integer")
+	}
+
+	var req Req
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+
+	idemKey := c.Get("Idempotency-Key")
+	entry, replayed, err := op(userID, &req, idemKey)
+	if err != nil {
+		return err
+	}
+
+	if idemKey != "" {
+		c.Set("Idempotency-Key", idemKey)
+	}
+	if replayed {
+		c.Set("Idempotent-Replayed", "true")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"entry": entry,
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"backend/models"
 	"backend/services"
 	"strconv"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -18,29 +19,103 @@ func NewTransferHandler(service *services.TransferService) *TransferHandler {
 
 func (h *TransferHandler) CreateTransfer(c *fiber.Ctx) error {
 	var req models.CreateTransferRequest
-	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+
+	if err := setSender(c, &req.FromUserID); err != nil {
+		return err
 	}
 
-	transfer, err := h.service.CreateTransfer(&req)
+	transfer, idemKey, replayed, err := h.service.CreateTransfer(&req, c.Get("Idempotency-Key"))
 	if err != nil {
 		return err
 	}
 
-	// Set Idempotency-Key header
-	c.Set("Idempotency-Key", transfer.IdemKey)
+	c.Set("Idempotency-Key", idemKey)
+	if replayed {
+		c.Set("Idempotent-Replayed", "true")
+	}
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"transfer": transfer,
 	})
 }
 
+// CreateBatchTransfer sends points from the caller to every recipient of the
+// request in one transaction. The Idempotency-Key covers the whole batch.
+func (h *TransferHandler) CreateBatchTransfer(c *fiber.Ctx) error {
+	var req models.CreateBatchTransferRequest
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+	if err := setSender(c, &req.FromUserID); err != nil {
+		return err
+	}
+
+	batch, idemKey, replayed, err := h.service.CreateBatch(&req, c.Get("Idempotency-Key"))
+	if err != nil {
+		return err
+	}
+
+	c.Set("Idempotency-Key", idemKey)
+	if replayed {
+		c.Set("Idempotent-Replayed", "true")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(batch)
+}
+
+// DryRunTransfer evaluates the transfer rules for a transfer without
+// creating it. Rejections are reported per rule with a 200.
+func (h *TransferHandler) DryRunTransfer(c *fiber.Ctx) error {
+	var req models.CreateTransferRequest
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+	if err := setSender(c, &req.FromUserID); err != nil {
+		return err
+	}
+
+	results, err := h.service.DryRun(&req)
+	if err != nil {
+		return err
+	}
+
+	lang := Language(c)
+	resp := models.TransferDryRunResponse{Allowed: true, Rules: make([]models.TransferRuleResult, len(results))}
+	for i, r := range results {
+		resp.Rules[i] = models.TransferRuleResult{Rule: r.Rule, Type: r.Type, Passed: r.Err == nil}
+		if r.Err != nil {
+			resp.Allowed = false
+			resp.Rules[i].Code = r.Err.Code
+			resp.Rules[i].Detail = r.Err.Message(lang)
+		}
+	}
+	c.Set(fiber.HeaderContentLanguage, lang)
+	return c.JSON(resp)
+}
+
+// setSender makes the caller the sender of a request; fromUserId may be
+// omitted.
+func setSender(c *fiber.Ctx, fromUserID *int64) error {
+	caller := principal(c).UserID
+	if *fromUserID != 0 && *fromUserID != caller {
+		return services.ErrForbidden
+	}
+	*fromUserID = caller
+	return nil
+}
+
 func (h *TransferHandler) GetTransfer(c *fiber.Ctx) error {
 	idemKey := c.Params("id")
 
 	transfer, err := h.service.GetByIdemKey(idemKey)
 	if err != nil {
-		return fiber.NewError(fiber.StatusNotFound, err.Error())
+		return err
+	}
+	if !isParty(c, transfer, true, true) {
+		return services.ErrForbidden
 	}
 
 	return c.JSON(fiber.Map{
@@ -48,24 +123,176 @@ func (h *TransferHandler) GetTransfer(c *fiber.Ctx) error {
 	})
 }
 
-func (h *TransferHandler) ListTransfers(c *fiber.Ctx) error {
-	userIDStr := c.Query("userId")
-	if userIDStr == "" {
-		return fiber.NewError(fiber.StatusBadRequest, "userId query parameter is required")
+func (h *TransferHandler) ReverseTransfer(c *fiber.Ctx) error {
+	var req models.ReverseTransferRequest
+	if len(c.Body()) > 0 {
+		if err := parseBody(c, &req); err != nil {
+			return err
+		}
+	}
+
+	// Only the recipient or support may give the points back, and only
+	// admins may overdraw them
+	if err := h.authorize(c, false, true); err != nil {
+		return err
+	}
+	if req.AllowNegative && !principal(c).Can(models.PermTransfersOverdraw) {
+		return services.ErrForbidden
+	}
+
+	transfer, err := h.service.ReverseTransfer(c.Params("id"), &req, actor(c))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"transfer": transfer,
+	})
+}
+
+func (h *TransferHandler) ConfirmTransfer(c *fiber.Ctx) error {
+	if err := h.authorize(c, true, false); err != nil {
+		return err
+	}
+
+	transfer, err := h.service.ConfirmTransfer(c.Params("id"), actor(c))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"transfer": transfer,
+	})
+}
+
+func (h *TransferHandler) CancelTransfer(c *fiber.Ctx) error {
+	var req models.CancelTransferRequest
+	if len(c.Body()) > 0 {
+		if err := parseBody(c, &req); err != nil {
+			return err
+		}
+	}
+
+	if err := h.authorize(c, true, false); err != nil {
+		return err
+	}
+
+	transfer, err := h.service.CancelTransfer(c.Params("id"), &req, actor(c))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"transfer": transfer,
+	})
+}
+
+func (h *TransferHandler) GetTransferHistory(c *fiber.Ctx) error {
+	if err := h.authorize(c, true, true); err != nil {
+		return err
 	}
 
-	userID, err := strconv.ParseInt(userIDStr, 10, 64)
+	history, err := h.service.GetStatusHistory(c.Params("id"))
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid userId")
+		return err
 	}
 
-	page, _ := strconv.Atoi(c.Query("page", "1"))
-	pageSize, _ := strconv.Atoi(c.Query("pageSize", "20"))
+	return c.JSON(fiber.Map{
+		"history": history,
+	})
+}
+
+// ListTransfers lists transfers; see models.TransferListQuery for the
+// filters. Without userId, callers with the permission of the route list the
+// transfers of every user and anyone else their own.
+func (h *TransferHandler) ListTransfers(c *fiber.Ctx) error {
+	q := models.TransferListQuery{
+		Direction: c.Query("direction"),
+		Note:      c.Query("note"),
+		BatchID:   c.Query("batchId"),
+		Cursor:    c.Query("cursor"),
+	}
+
+	if v := c.Query("userId"); v != "" {
+		userID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return invalidParam("userId", "integer")
+		}
+		if err := requireSelf(c, userID); err != nil {
+			return err
+		}
+		q.UserID = userID
+	} else if !granted(c) {
+		q.UserID = principal(c).UserID
+	}
+
+	if v := c.Query("counterparty"); v != "" {
+		counterparty, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return invalidParam("counterparty", "integer")
+		}
+		q.Counterparty = counterparty
+	}
+	for name, bound := range map[string]**int64{"min_amount": &q.MinAmount, "max_amount": &q.MaxAmount} {
+		if v := c.Query(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return invalidParam(name, "integer")
+			}
+			*bound = &n
+		}
+	}
+	if v := c.Query("status"); v != "" {
+		for _, status := range strings.Split(v, ",") {
+			q.Statuses = append(q.Statuses, models.TransferStatus(strings.TrimSpace(status)))
+		}
+	}
+	if v := c.Query("from"); v != "" {
+		from, err := parseTimeQuery(v, false)
+		if err != nil {
+			return invalidParam("from", "time")
+		}
+		q.From = &from
+	}
+	if v := c.Query("to"); v != "" {
+		to, err := parseTimeQuery(v, true)
+		if err != nil {
+			return invalidParam("to", "time")
+		}
+		q.To = &to
+	}
+	q.Page, _ = strconv.Atoi(c.Query("page", "1"))
+	q.PageSize, _ = strconv.Atoi(c.Query("pageSize"))
 
-	result, err := h.service.GetByUserID(userID, page, pageSize)
+	result, err := h.service.List(&q)
 	if err != nil {
 		return err
 	}
 
 	return c.JSON(result)
 }
+
+// authorize allows the request only when the caller is the sender or the
+// recipient of the transfer in the :id parameter, as selected.
+func (h *TransferHandler) authorize(c *fiber.Ctx, sender, recipient bool) error {
+	transfer, err := h.service.GetByIdemKey(c.Params("id"))
+	if err != nil {
+		return err
+	}
+	if !isParty(c, transfer, sender, recipient) {
+		return services.ErrForbidden
+	}
+	return nil
+}
+
+// isParty also admits callers whose role has the permission of the route.
+func isParty(c *fiber.Ctx, transfer *models.Transfer, sender, recipient bool) bool {
+	p := principal(c)
+	if p == nil {
+		return false
+	}
+	if granted(c) {
+		return true
+	}
+	return (sender && p.UserID == transfer.FromUserID) || (recipient && p.UserID == transfer.ToUserID)
+}
@@ -1,9 +1,16 @@
 package handlers
 
 import (
+	"backend/i18n"
 	"backend/models"
 	"backend/services"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
 	"strconv"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -16,18 +23,53 @@ func NewUserHandler(service *services.UserService) *UserHandler {
 	return &UserHandler{service: service}
 }
 
+// GetUsers lists users; see models.UserListQuery for the filters.
 func (h *UserHandler) GetUsers(c *fiber.Ctx) error {
-	users, err := h.service.GetAll()
+	q := models.UserListQuery{
+		Search: c.Query("q"),
+		Status: c.Query("status"),
+		Sort:   c.Query("sort"),
+		Cursor: c.Query("cursor"),
+	}
+
+	for name, bound := range map[string]**int64{"min_balance": &q.MinBalance, "max_balance": &q.MaxBalance} {
+		if v := c.Query(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return invalidParam(name, "integer")
+			}
+			*bound = &n
+		}
+	}
+	if v := c.Query("from"); v != "" {
+		from, err := parseTimeQuery(v, false)
+		if err != nil {
+			return invalidParam("from", "time")
+		}
+		q.From = &from
+	}
+	if v := c.Query("to"); v != "" {
+		to, err := parseTimeQuery(v, true)
+		if err != nil {
+			return invalidParam("to", "time")
+		}
+		q.To = &to
+	}
+	q.Page, _ = strconv.Atoi(c.Query("page", "1"))
+	q.PageSize, _ = strconv.Atoi(c.Query("pageSize"))
+
+	result, err := h.service.List(&q)
 	if err != nil {
 		return err
 	}
-	return c.JSON(users)
+
+	return c.JSON(result)
 }
 
 func (h *UserHandler) GetUser(c *fiber.Ctx) error {
 	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid user id")
+		return invalidParam("id", "integer")
 	}
 
 	user, err := h.service.GetByID(id)
@@ -35,13 +77,14 @@ func (h *UserHandler) GetUser(c *fiber.Ctx) error {
 		return err
 	}
 
+	c.Set(fiber.HeaderETag, user.ETag())
 	return c.JSON(user)
 }
 
 func (h *UserHandler) CreateUser(c *fiber.Ctx) error {
 	var req models.CreateUserRequest
-	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	if err := parseBody(c, &req); err != nil {
+		return err
 	}
 
 	user, err := h.service.Create(&req)
@@ -52,35 +95,172 @@ func (h *UserHandler) CreateUser(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusCreated).JSON(user)
 }
 
+// ImportUsers creates users from a CSV body, or from the file field of a
+// multipart form, and reports the outcome of every row. With dryRun=true the
+// rows are only checked.
+func (h *UserHandler) ImportUsers(c *fiber.Ctx) error {
+	var body io.Reader = bytes.NewReader(c.Body())
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		header, err := c.FormFile("file")
+		if err != nil {
+			return invalidParam("file", "required")
+		}
+		file, err := header.Open()
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		body = file
+	}
+
+	dryRun := c.QueryBool("dryRun")
+	rows, err := h.service.Import(body, dryRun)
+	if err != nil {
+		return err
+	}
+
+	lang := Language(c)
+	resp := models.UserImportResponse{DryRun: dryRun, Total: len(rows), Rows: make([]models.UserImportRowResult, len(rows))}
+	for i, row := range rows {
+		result := models.UserImportRowResult{Row: row.Line, Status: models.ImportRowValid}
+		switch {
+		case row.Err != nil:
+			result.Status = models.ImportRowFailed
+			for _, f := range row.Err.Fields {
+				f = f.Localize(lang)
+				result.Errors = append(result.Errors, models.ImportFieldError{Field: f.Field, Code: f.Code, Message: f.Message})
+			}
+			resp.Failed++
+		case row.Failed != nil:
+			result.Status = models.ImportRowFailed
+			result.Errors = []models.ImportFieldError{importFailure(row, lang)}
+			resp.Failed++
+		case row.Skipped:
+			result.Status = models.ImportRowSkipped
+		case row.User != nil:
+			result.Status = models.ImportRowCreated
+			result.UserID = row.User.ID
+			resp.Created++
+		}
+		resp.Rows[i] = result
+	}
+	c.Set(fiber.HeaderContentLanguage, lang)
+	return c.JSON(resp)
+}
+
+// importFailure reports why a valid row could not be created. Only domain
+// errors are shown; the cause of anything else goes to the server log.
+func importFailure(row services.ImportRow, lang string) models.ImportFieldError {
+	var domainErr *services.Error
+	if errors.As(row.Failed, &domainErr) {
+		return models.ImportFieldError{Code: domainErr.Code, Message: domainErr.Message(lang)}
+	}
+	log.Printf("Failed to import row %d: %v", row.Line, row.Failed)
+	return models.ImportFieldError{Code: "internal_error", Message: i18n.T(lang, "internal_error", nil)}
+}
+
 func (h *UserHandler) UpdateUser(c *fiber.Ctx) error {
 	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+		return invalidParam("id", "integer")
 	}
 
 	var req models.UpdateUserRequest
-	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+
+	user, err := h.service.Replace(id, &req, c.Get(fiber.HeaderIfMatch))
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderETag, user.ETag())
+	return c.JSON(user)
+}
+
+// mimeMergePatch is the media type of JSON Merge Patch documents.
+const mimeMergePatch = "application/merge-patch+json"
+
+// PatchUser takes a JSON Merge Patch; plain application/json is accepted too.
+func (h *UserHandler) PatchUser(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return invalidParam("id", "integer")
+	}
+
+	contentType := strings.ToLower(c.Get(fiber.HeaderContentType))
+	if !strings.HasPrefix(contentType, mimeMergePatch) && !strings.HasPrefix(contentType, fiber.MIMEApplicationJSON) {
+		return services.ErrUnsupportedMediaType
+	}
+
+	var patch map[string]any
+	if err := json.Unmarshal(c.Body(), &patch); err != nil || patch == nil {
+		return services.ErrInvalidBody
 	}
 
-	user, err := h.service.Update(id, &req)
+	user, err := h.service.Patch(id, patch, c.Get(fiber.HeaderIfMatch))
 	if err != nil {
 		return err
 	}
 
+	c.Set(fiber.HeaderETag, user.ETag())
 	return c.JSON(user)
 }
 
-func (h *UserHandler) DeleteUser(c *fiber.Ctx) error {
+// CloseUser closes the account; the optional sweep_to query parameter names
+// the user that receives the remaining balance.
+func (h *UserHandler) CloseUser(c *fiber.Ctx) error {
 	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid user id")
+		return invalidParam("id", "integer")
+	}
+
+	var req models.CloseUserRequest
+	if v := c.Query("sweep_to"); v != "" {
+		req.SweepTo, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || req.SweepTo < 1 {
+			return invalidParam("sweep_to", "integer")
+		}
 	}
 
-	err = h.service.Delete(id)
+	err = h.service.Close(id, &req, actor(c))
 	if err != nil {
 		return err
 	}
 
 	return c.SendStatus(fiber.StatusNoContent)
 }
+
+func (h *UserHandler) ReopenUser(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return invalidParam("id", "integer")
+	}
+
+	user, err := h.service.Reopen(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(user)
+}
+
+func (h *UserHandler) SetRole(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return invalidParam("id", "integer")
+	}
+
+	var req models.UpdateRoleRequest
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+
+	user, err := h.service.SetRole(id, req.Role)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(user)
+}
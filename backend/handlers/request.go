@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"backend/services"
+	"backend/validation"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// parseBody decodes the JSON request body into v strictly: unknown fields,
+// also of nested objects, and values of the wrong type are reported together
+// as a validation error. Other content types are refused with 415.
+func parseBody(c *fiber.Ctx, v any) error {
+	if !strings.HasPrefix(strings.ToLower(c.Get(fiber.HeaderContentType)), fiber.MIMEApplicationJSON) {
+		return services.ErrUnsupportedMediaType
+	}
+
+	violations, err := validation.Decode(c.Body(), v)
+	if err != nil {
+		return services.ErrInvalidBody
+	}
+	return services.Invalid(violations)
+}
+
+// invalidParam reports a path or query parameter that cannot be parsed as a
+// field error with code, like the fields of a body.
+func invalidParam(name, code string) error {
+	return services.Invalid([]validation.Violation{{Field: name, Code: code}})
+}
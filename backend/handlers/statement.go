@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"backend/models"
+	"encoding/csv"
+	"encoding/json"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// statementTypes are the content types of the statement formats.
+var statementTypes = map[string]string{
+	"csv":   "text/csv; charset=utf-8",
+	"jsonl": "application/jsonl; charset=utf-8",
+	"html":  fiber.MIMETextHTMLCharsetUTF8,
+}
+
+// eachEntry calls fn with the entries of a statement, oldest first.
+type eachEntry func(fn func(*models.StatementEntry) error) error
+
+// writeStatement writes st in its format, reading the entries one at a time
+// from each.
+func writeStatement(w io.Writer, st *models.Statement, each eachEntry) error {
+	switch st.Format {
+	case "jsonl":
+		return writeStatementJSONL(w, st, each)
+	case "html":
+		return writeStatementHTML(w, st, each)
+	default:
+		return writeStatementCSV(w, st, each)
+	}
+}
+
+// writeStatementCSV writes a row per entry between an opening_balance and a
+// closing_balance row.
+func writeStatementCSV(w io.Writer, st *models.Statement, each eachEntry) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"date", "event_type", "transfer_id", "counterparty_id", "counterparty_name", "note", "reference", "change", "balance_after"})
+	out.Write([]string{st.From.Format(time.RFC3339), "opening_balance", "", "", "", "", "", "", strconv.FormatInt(st.OpeningBalance, 10)})
+
+	err := each(func(e *models.StatementEntry) error {
+		return out.Write([]string{
+			e.CreatedAt.UTC().Format(time.RFC3339),
+			e.EventType,
+			optionalID(e.TransferID),
+			optionalID(e.CounterpartyID),
+			csvText(e.CounterpartyName),
+			csvText(e.Note),
+			csvText(e.Reference),
+			strconv.FormatInt(e.Change, 10),
+			strconv.FormatInt(e.BalanceAfter, 10),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	out.Write([]string{st.To.Format(time.RFC3339), "closing_balance", "", "", "", "", "", "", strconv.FormatInt(st.ClosingBalance, 10)})
+	out.Flush()
+	return out.Error()
+}
+
+// csvText keeps spreadsheets from running text typed by users as a formula.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func optionalID(id *int64) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.FormatInt(*id, 10)
+}
+
+// statementBalance is the first and last line of a JSON Lines statement.
+type statementBalance struct {
+	Record  string    `json:"record"`
+	UserID  int64     `json:"user_id"`
+	At      time.Time `json:"at"`
+	Balance int64     `json:"balance"`
+}
+
+// writeStatementJSONL writes an object per line; the record field tells the
+// opening_balance and closing_balance lines from the entry lines.
+func writeStatementJSONL(w io.Writer, st *models.Statement, each eachEntry) error {
+	enc := json.NewEncoder(w)
+	err := enc.Encode(statementBalance{Record: "opening_balance", UserID: st.User.ID, At: st.From, Balance: st.OpeningBalance})
+	if err != nil {
+		return err
+	}
+
+	err = each(func(e *models.StatementEntry) error {
+		return enc.Encode(struct {
+			Record string `json:"record"`
+			*models.StatementEntry
+		}{"entry", e})
+	})
+	if err != nil {
+		return err
+	}
+
+	return enc.Encode(statementBalance{Record: "closing_balance", UserID: st.User.ID, At: st.To, Balance: st.ClosingBalance})
+}
+
+// statementHTML is a printable statement, split into the part before the
+// entries, a row per entry and the part after them so it can be streamed.
+var statementHTML = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"date": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04") },
+}).Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Statement of {{.User.FirstName}} {{.User.LastName}}</title>
+<style>
+body { font: 14px/1.4 sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.num { text-align: right; font-variant-numeric: tabular-nums; }
+.balance td { font-weight: bold; }
+@media print { body { margin: 0; } thead { display: table-header-group; } tr { break-inside: avoid; } }
+</style>
+</head>
+<body>
+<h1>Account statement</h1>
+<p>{{.User.FirstName}} {{.User.LastName}}, account {{.User.ID}}<br>
+{{date .From}} to {{date .To}} UTC</p>
+<table>
+<thead><tr><th>Date</th><th>Type</th><th>Counterparty</th><th>Note</th><th class="num">Change</th><th class="num">Balance</th></tr></thead>
+<tbody>
+<tr class="balance"><td>{{date .From}}</td><td colspan="4">Opening balance</td><td class="num">{{.OpeningBalance}}</td></tr>
+{{end}}
+{{define "entry"}}<tr><td>{{date .CreatedAt}}</td><td>{{.EventType}}</td><td>{{.CounterpartyName}}</td><td>{{.Note}}{{if and .Note .Reference}} · {{end}}{{.Reference}}</td><td class="num">{{.Change}}</td><td class="num">{{.BalanceAfter}}</td></tr>
+{{end}}
+{{define "foot"}}<tr class="balance"><td>{{date .To}}</td><td colspan="4">Closing balance</td><td class="num">{{.ClosingBalance}}</td></tr>
+</tbody>
+</table>
+</body>
+</html>
+{{end}}`))
+
+func writeStatementHTML(w io.Writer, st *models.Statement, each eachEntry) error {
+	if err := statementHTML.ExecuteTemplate(w, "head", st); err != nil {
+		return err
+	}
+	err := each(func(e *models.StatementEntry) error {
+		return statementHTML.ExecuteTemplate(w, "entry", e)
+	})
+	if err != nil {
+		return err
+	}
+	return statementHTML.ExecuteTemplate(w, "foot", st)
+}
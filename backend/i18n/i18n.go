@@ -0,0 +1,147 @@
+// Package i18n translates error and validation messages. Catalogs are the
+// JSON files in locales, one per language, mapping a message key to a
+// template; {name} in a template is replaced with the parameter name.
+//
+// English is the reference catalog: a key missing from another language
+// falls back to English, and Missing lists such keys so a test can catch
+// them.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	English = "en"
+	Thai    = "th"
+)
+
+// Params are the values a message template refers to.
+type Params map[string]any
+
+//go:embed locales/*.json
+var files embed.FS
+
+var catalogs = map[string]map[string]string{}
+
+func init() {
+	entries, err := files.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		body, err := files.ReadFile(path.Join("locales", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(body, &catalog); err != nil {
+			panic(fmt.Sprintf("i18n: locales/%s: %v", entry.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(entry.Name(), ".json")] = catalog
+	}
+}
+
+// Languages lists the languages that have a catalog.
+func Languages() []string {
+	langs := make([]string, 0, len(catalogs))
+	for lang := range catalogs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Supported reports whether lang has a catalog.
+func Supported(lang string) bool {
+	_, ok := catalogs[lang]
+	return ok
+}
+
+// T renders the message key in lang. Keys the language lacks are rendered in
+// English, and unknown keys are returned as is.
+func T(lang, key string, params Params) string {
+	tmpl, ok := catalogs[lang][key]
+	if !ok {
+		tmpl, ok = catalogs[English][key]
+	}
+	if !ok {
+		return key
+	}
+
+	for name, value := range params {
+		tmpl = strings.ReplaceAll(tmpl, "{"+name+"}", fmt.Sprint(value))
+	}
+	return tmpl
+}
+
+// Match picks the best supported language for an Accept-Language header,
+// honouring q-values, and falls back to English.
+func Match(acceptLanguage string) string {
+	best, bestQ := English, 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+
+		// th-TH and th both select th
+		base, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if Supported(base) && q > bestQ {
+			best, bestQ = base, q
+		}
+	}
+	return best
+}
+
+// Missing lists the keys of the English catalog that lang does not
+// translate, and the keys whose translation uses other parameters.
+func Missing(lang string) []string {
+	var missing []string
+	for key, en := range catalogs[English] {
+		tmpl, ok := catalogs[lang][key]
+		if !ok || !sameParams(en, tmpl) {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func sameParams(a, b string) bool {
+	pa, pb := placeholders(a), placeholders(b)
+	if len(pa) != len(pb) {
+		return false
+	}
+	for name := range pa {
+		if !pb[name] {
+			return false
+		}
+	}
+	return true
+}
+
+func placeholders(tmpl string) map[string]bool {
+	names := map[string]bool{}
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			return names
+		}
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end < 0 {
+			return names
+		}
+		names[tmpl[start+1:start+end]] = true
+		tmpl = tmpl[start+end+1:]
+	}
+}
@@ -1,74 +1,248 @@
 package main
 
 import (
+	"backend/config"
 	"backend/handlers"
+	"backend/models"
 	"backend/repositories"
 	"backend/services"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 )
 
 func main() {
-	// Initialize database
-	db, err := InitDB("./data.db")
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+
+	if cfg.PrintConfig {
+		out, _ := json.MarshalIndent(cfg.Redacted(), "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	if len(cfg.Args) > 0 && cfg.Args[0] == "migrate" {
+		runMigrate(cfg, cfg.Args[1:])
+		return
+	}
+
+	if len(cfg.Args) > 0 && cfg.Args[0] == "role" {
+		runRole(cfg, cfg.Args[1:])
+		return
+	}
+
+	// Initialize database; the DSN may point at PostgreSQL
+	db, dialect, err := InitDB(cfg.DatabaseURL)
 	if err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
 	defer db.Close()
 
 	// Run migrations
-	if err := Migrate(db); err != nil {
+	if err := Migrate(db, dialect); err != nil {
 		log.Fatal("Failed to run migrations:", err)
 	}
 
 	// Initialize repositories
-	userRepo := repositories.NewUserRepository(db)
-	transferRepo := repositories.NewTransferRepository(db)
-	ledgerRepo := repositories.NewLedgerRepository(db)
+	store := repositories.NewStore(db, dialect)
 
 	// Initialize services
-	userService := services.NewUserService(userRepo)
-	transferService := services.NewTransferService(transferRepo, ledgerRepo, userRepo)
+	userService := services.NewUserService(store)
+	userService.SetMaxNameLength(cfg.Rules.MaxNameLength)
+	userService.SetPageSize(cfg.Pagination.DefaultPageSize, cfg.Pagination.MaxPageSize)
+	userService.SetImport(cfg.Import.Commit, cfg.Import.MaxRows)
+	transferService := services.NewTransferService(store)
+	transferService.SetIdempotencyRetention(time.Duration(cfg.IdempotencyRetention))
+	transferService.SetHoldTTL(time.Duration(cfg.HoldTTL))
+	transferService.SetPageSize(cfg.Pagination.DefaultPageSize, cfg.Pagination.MaxPageSize)
+	transferService.SetNoRepeatRecipient(cfg.Rules.NoRepeatRecipient)
+	if err := transferService.SetTransferRules(cfg.Rules.Transfer); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	transferService.SetLimitTiers(cfg.Limits.Tiers, cfg.Limits.DefaultTier)
+	ledgerService := services.NewLedgerService(store)
+	ledgerService.SetLimit(cfg.Pagination.DefaultLedgerLimit, cfg.Pagination.MaxPageSize)
+	pointsService := services.NewPointsService(store)
+	pointsService.SetIdempotencyRetention(time.Duration(cfg.IdempotencyRetention))
+	authService := services.NewAuthService(store, userService, signingKey(cfg))
+	authService.SetTokenTTL(time.Duration(cfg.Auth.TokenTTL))
+	apiKeyService := services.NewAPIKeyService(store)
+
+	// Cancel pending transfers whose hold expired and free the
+	// Idempotency-Keys past their retention
+	go func() {
+		for range time.Tick(time.Minute) {
+			if n, err := transferService.ExpirePendingTransfers(models.Now()); err != nil {
+				log.Println("Failed to expire pending transfers:", err)
+			} else if n > 0 && cfg.LogEnabled("info") {
+				log.Printf("Expired %d pending transfers", n)
+			}
+			if _, err := transferService.ReleaseIdempotencyKeys(models.Now()); err != nil {
+				log.Println("Failed to release idempotency keys:", err)
+			}
+			if _, err := pointsService.ReleaseIdempotencyKeys(models.Now()); err != nil {
+				log.Println("Failed to release points idempotency keys:", err)
+			}
+		}
+	}()
 
 	// Initialize handlers
-	userHandler := handlers.NewUserHandler(userService)
-	transferHandler := handlers.NewTransferHandler(transferService)
+	h := &apiHandlers{
+		authService:   authService,
+		apiKeyService: apiKeyService,
+		auth:          handlers.NewAuthHandler(authService),
+		apiKey:        handlers.NewAPIKeyHandler(apiKeyService),
+		user:          handlers.NewUserHandler(userService),
+		transfer:      handlers.NewTransferHandler(transferService),
+		ledger:        handlers.NewLedgerHandler(ledgerService),
+		points:        handlers.NewPointsHandler(pointsService),
+		limits:        handlers.NewLimitsHandler(transferService),
+	}
 
 	// Setup Fiber app
-	app := fiber.New(fiber.Config{
-		ErrorHandler: ErrorHandler,
-	})
+	app := newApp()
 
 	// Middleware
-	app.Use(cors.New())
-	app.Use(logger.New())
+	app.Use(cors.New(cors.Config{
+		AllowOrigins:  strings.Join(cfg.CORSOrigins, ","),
+		ExposeHeaders: fiber.HeaderETag,
+	}))
+	if cfg.LogEnabled("info") {
+		app.Use(logger.New(logger.Config{
+			Format: "[${time}] ${locals:requestid} ${status} - ${latency} ${method} ${path}\n",
+		}))
+	}
 
 	// Swagger UI
-	SetupSwagger(app)
+	SetupSwagger(app, cfg.SwaggerFile)
 
 	// Routes
-	api := app.Group("/api")
+	registerRoutes(app, h)
 
-	// User routes
-	users := api.Group("/users")
-	users.Get("/", userHandler.GetUsers)
-	users.Get("/:id", userHandler.GetUser)
-	users.Post("/", userHandler.CreateUser)
-	users.Put("/:id", userHandler.UpdateUser)
-	users.Delete("/:id", userHandler.DeleteUser)
-
-	// Transfer routes
-	transfers := api.Group("/transfers")
-	transfers.Post("/", transferHandler.CreateTransfer)
-	transfers.Get("/", transferHandler.ListTransfers)
-	transfers.Get("/:id", transferHandler.GetTransfer)
-
-	log.Println("Server starting on :3000")
-	log.Println("Swagger UI available at: http://localhost:3000/swagger")
-	if err := app.Listen(":3000"); err != nil {
+	log.Println("Server starting on " + cfg.ListenAddr)
+	log.Println("Swagger UI available at: /swagger")
+	if err := app.Listen(cfg.ListenAddr); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// apiHandlers are the handlers the API routes dispatch to.
+type apiHandlers struct {
+	authService   *services.AuthService
+	apiKeyService *services.APIKeyService
+
+	auth     *handlers.AuthHandler
+	apiKey   *handlers.APIKeyHandler
+	user     *handlers.UserHandler
+	transfer *handlers.TransferHandler
+	ledger   *handlers.LedgerHandler
+	points   *handlers.PointsHandler
+	limits   *handlers.LimitsHandler
+}
+
+// route is an authenticated API route together with who may call it.
+type route struct {
+	method  string
+	path    string
+	rule    handlers.Rule
+	handler fiber.Handler
+}
+
+// routes is the permission table of the API: every route behind RequireAuth,
+// relative to /api, with its access rule. Users act on their own account;
+// the permissions of the support and admin roles are in models.rolePermissions.
+func routes(h *apiHandlers) []route {
+	return []route{
+		// Users
+		{fiber.MethodGet, "/users", handlers.Allow(models.PermUsersList), h.user.GetUsers},
+		{fiber.MethodPost, "/users", handlers.Allow(models.PermUsersCreate), h.user.CreateUser},
+		{fiber.MethodGet, "/users/:id", handlers.AllowSelf(models.PermUsersRead), h.user.GetUser},
+		{fiber.MethodPut, "/users/:id", handlers.AllowSelf(models.PermUsersUpdate), h.user.UpdateUser},
+		{fiber.MethodPatch, "/users/:id", handlers.AllowSelf(models.PermUsersUpdate), h.user.PatchUser},
+		{fiber.MethodDelete, "/users/:id", handlers.Allow(models.PermUsersDelete), h.user.CloseUser},
+		{fiber.MethodPost, "/users/:id/reopen", handlers.Allow(models.PermUsersDelete), h.user.ReopenUser},
+		{fiber.MethodPut, "/users/:id/role", handlers.Allow(models.PermUsersRole), h.user.SetRole},
+		{fiber.MethodGet, "/users/:id/limits", handlers.AllowSelf(models.PermUsersRead), h.limits.GetLimits},
+		{fiber.MethodPut, "/users/:id/limits", handlers.Allow(models.PermUsersLimits), h.limits.SetLimits},
+		{fiber.MethodGet, "/users/:id/ledger", handlers.AllowSelf(models.PermLedgerRead), h.ledger.ListUserLedger},
+		{fiber.MethodGet, "/users/:id/statement", handlers.AllowSelf(models.PermLedgerRead), h.ledger.ExportStatement},
+		{fiber.MethodPost, "/users/:id/points/earn", handlers.Allow(models.PermPointsEarn), h.points.Earn},
+		{fiber.MethodPost, "/users/:id/points/redeem", handlers.AllowSelf(models.PermPointsRedeem), h.points.Redeem},
+		{fiber.MethodPost, "/users/:id/points/adjust", handlers.Allow(models.PermPointsAdjust), h.points.Adjust},
+		{fiber.MethodPost, "/admin/users/import", handlers.Allow(models.PermUsersImport), h.user.ImportUsers},
+
+		// Transfers; the handlers check that the caller is the sender or the
+		// recipient
+		{fiber.MethodPost, "/transfers", handlers.AllowOwner(""), h.transfer.CreateTransfer},
+		{fiber.MethodPost, "/transfers/dry-run", handlers.AllowOwner(""), h.transfer.DryRunTransfer},
+		{fiber.MethodPost, "/transfers/batch", handlers.AllowOwner(""), h.transfer.CreateBatchTransfer},
+		{fiber.MethodGet, "/transfers", handlers.AllowOwner(models.PermTransfersRead), h.transfer.ListTransfers},
+		{fiber.MethodGet, "/transfers/:id", handlers.AllowOwner(models.PermTransfersRead), h.transfer.GetTransfer},
+		{fiber.MethodGet, "/transfers/:id/history", handlers.AllowOwner(models.PermTransfersRead), h.transfer.GetTransferHistory},
+		{fiber.MethodPost, "/transfers/:id/reverse", handlers.AllowOwner(models.PermTransfersReverse), h.transfer.ReverseTransfer},
+		{fiber.MethodPost, "/transfers/:id/confirm", handlers.AllowOwner(models.PermTransfersEdit), h.transfer.ConfirmTransfer},
+		{fiber.MethodPost, "/transfers/:id/cancel", handlers.AllowOwner(models.PermTransfersEdit), h.transfer.CancelTransfer},
+
+		// API keys of partner integrations
+		{fiber.MethodPost, "/api-keys", handlers.Allow(models.PermAPIKeys), h.apiKey.CreateAPIKey},
+		{fiber.MethodGet, "/api-keys", handlers.Allow(models.PermAPIKeys), h.apiKey.ListAPIKeys},
+		{fiber.MethodDelete, "/api-keys/:id", handlers.Allow(models.PermAPIKeys), h.apiKey.RevokeAPIKey},
+	}
+}
+
+// newApp returns a Fiber app that tags every request with an X-Request-ID
+// and reports errors as problem+json.
+func newApp() *fiber.App {
+	app := fiber.New(fiber.Config{
+		ErrorHandler: ErrorHandler,
+	})
+	app.Use(requestid.New())
+	return app
+}
+
+// registerRoutes installs the public auth routes and the permission table.
+func registerRoutes(app *fiber.App, h *apiHandlers) {
+	api := app.Group("/api")
+
+	// Auth routes are public; everything registered after RequireAuth needs
+	// a bearer token or an API key
+	auth := api.Group("/auth")
+	auth.Post("/register", h.auth.Register)
+	auth.Post("/login", h.auth.Login)
+	api.Use(handlers.RequireAuth(h.authService, h.apiKeyService))
+
+	for _, r := range routes(h) {
+		api.Add(r.method, r.path, handlers.Authorize(r.rule), r.handler)
+	}
+}
+
+// signingKey returns the configured JWT secret, or a random key when none is
+// set so development setups work without configuration.
+func signingKey(cfg *config.Config) []byte {
+	if cfg.Auth.JWTSecret != "" {
+		return []byte(cfg.Auth.JWTSecret)
+	}
+
+	log.Println("JWT_SECRET is not set; using a random signing key, tokens will not survive a restart")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal("Failed to generate signing key:", err)
+	}
+	return key
+}
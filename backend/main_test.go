@@ -1,56 +1,116 @@
 package main
 
 import (
+	"backend/config"
 	"backend/handlers"
+	"backend/i18n"
+	"backend/migrations"
 	"backend/models"
 	"backend/repositories"
 	"backend/services"
+	"backend/validation"
 	"bytes"
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
 )
 
-func setupTestApp(t *testing.T) (*fiber.App, *sql.DB) {
-	db, err := InitDB(":memory:")
+// testDB runs the raw SQL of the tests, written with ? placeholders, against
+// whichever database the app under test uses.
+type testDB struct {
+	*sql.DB
+	dialect repositories.Dialect
+}
+
+func (d *testDB) Exec(query string, args ...any) (sql.Result, error) {
+	return d.DB.Exec(d.dialect.Rebind(query), args...)
+}
+
+func (d *testDB) QueryRow(query string, args ...any) *sql.Row {
+	return d.DB.QueryRow(d.dialect.Rebind(query), args...)
+}
+
+// setupTestApp uses an in-memory SQLite database, or the PostgreSQL database
+// in TEST_DATABASE_URL when it is set. Postgres tables are emptied first.
+func setupTestApp(t *testing.T) (*fiber.App, *testDB) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		dsn = ":memory:"
+	}
+
+	db, dialect, err := InitDB(dsn)
 	if err != nil {
 		t.Fatalf("Failed to init test DB: %v", err)
 	}
 
-	if err := Migrate(db); err != nil {
+	if err := Migrate(db, dialect); err != nil {
 		t.Fatalf("Failed to migrate test DB: %v", err)
 	}
 
-	userRepo := repositories.NewUserRepository(db)
-	transferRepo := repositories.NewTransferRepository(db)
-	ledgerRepo := repositories.NewLedgerRepository(db)
+	if dialect == repositories.Postgres {
+		_, err := db.Exec("TRUNCATE users, transfers, point_ledger, transfer_status_history, transfer_rules RESTART IDENTITY CASCADE")
+		if err != nil {
+			t.Fatalf("Failed to reset test DB: %v", err)
+		}
+	}
 
-	userService := services.NewUserService(userRepo)
-	transferService := services.NewTransferService(transferRepo, ledgerRepo, userRepo)
+	store := repositories.NewStore(db, dialect)
 
-	userHandler := handlers.NewUserHandler(userService)
-	transferHandler := handlers.NewTransferHandler(transferService)
+	userService := services.NewUserService(store)
+	transferService := services.NewTransferService(store)
+	ledgerService := services.NewLedgerService(store)
+	pointsService := services.NewPointsService(store)
+	authService := services.NewAuthService(store, userService, testSigningKey)
+	apiKeyService := services.NewAPIKeyService(store)
 
-	app := fiber.New(fiber.Config{
-		ErrorHandler: ErrorHandler,
+	app := newApp()
+	registerRoutes(app, &apiHandlers{
+		authService:   authService,
+		apiKeyService: apiKeyService,
+		auth:          handlers.NewAuthHandler(authService),
+		apiKey:        handlers.NewAPIKeyHandler(apiKeyService),
+		user:          handlers.NewUserHandler(userService),
+		transfer:      handlers.NewTransferHandler(transferService),
+		ledger:        handlers.NewLedgerHandler(ledgerService),
+		points:        handlers.NewPointsHandler(pointsService),
+		limits:        handlers.NewLimitsHandler(transferService),
 	})
 
-	api := app.Group("/api")
-	users := api.Group("/users")
-	users.Get("/", userHandler.GetUsers)
-	users.Get("/:id", userHandler.GetUser)
-	users.Post("/", userHandler.CreateUser)
-	users.Put("/:id", userHandler.UpdateUser)
-	users.Delete("/:id", userHandler.DeleteUser)
+	return app, &testDB{DB: db, dialect: dialect}
+}
+
+// testSigningKey signs the access tokens of the test app and of bearer.
+var testSigningKey = []byte("test-signing-key-that-is-32-bytes!")
 
-	transfers := api.Group("/transfers")
-	transfers.Post("/", transferHandler.CreateTransfer)
-	transfers.Get("/:id", transferHandler.GetTransfer)
+// bearer mints an access token for userID with the test signing key and
+// returns it as an Authorization header value.
+func bearer(t *testing.T, userID int64) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    services.TokenIssuer,
+		Subject:   fmt.Sprint(userID),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).SignedString(testSigningKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
 
-	return app, db
+func asUser(t *testing.T, req *http.Request, userID int64) *http.Request {
+	req.Header.Set("Authorization", bearer(t, userID))
+	return req
 }
 
 // Test Case 1: Names must not exceed 3 characters
@@ -58,6 +118,8 @@ func TestUserNameValidation(t *testing.T) {
 	app, db := setupTestApp(t)
 	defer db.Close()
 
+	admin := createTestAdmin(t, db)
+
 	tests := []struct {
 		name      string
 		firstName string
@@ -82,6 +144,7 @@ func TestUserNameValidation(t *testing.T) {
 
 			req := httptest.NewRequest("POST", "/api/users", bytes.NewReader(jsonBody))
 			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", bearer(t, admin))
 
 			resp, err := app.Test(req)
 			if err != nil {
@@ -133,6 +196,7 @@ func TestTransferAmountValidation(t *testing.T) {
 
 			req := httptest.NewRequest("POST", "/api/transfers", bytes.NewReader(jsonBody))
 			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", bearer(t, user1ID))
 
 			resp, err := app.Test(req)
 			if err != nil {
@@ -173,6 +237,7 @@ func TestNoConsecutiveSameRecipient(t *testing.T) {
 	jsonBody1, _ := json.Marshal(transfer1)
 	req1 := httptest.NewRequest("POST", "/api/transfers", bytes.NewReader(jsonBody1))
 	req1.Header.Set("Content-Type", "application/json")
+	req1.Header.Set("Authorization", bearer(t, userA))
 	resp1, _ := app.Test(req1)
 
 	if resp1.StatusCode != 201 {
@@ -188,6 +253,7 @@ func TestNoConsecutiveSameRecipient(t *testing.T) {
 	jsonBody2, _ := json.Marshal(transfer2)
 	req2 := httptest.NewRequest("POST", "/api/transfers", bytes.NewReader(jsonBody2))
 	req2.Header.Set("Content-Type", "application/json")
+	req2.Header.Set("Authorization", bearer(t, userA))
 	resp2, _ := app.Test(req2)
 
 	if resp2.StatusCode == 201 {
@@ -203,6 +269,7 @@ func TestNoConsecutiveSameRecipient(t *testing.T) {
 	jsonBody3, _ := json.Marshal(transfer3)
 	req3 := httptest.NewRequest("POST", "/api/transfers", bytes.NewReader(jsonBody3))
 	req3.Header.Set("Content-Type", "application/json")
+	req3.Header.Set("Authorization", bearer(t, userA))
 	resp3, _ := app.Test(req3)
 
 	if resp3.StatusCode != 201 {
@@ -218,6 +285,7 @@ func TestNoConsecutiveSameRecipient(t *testing.T) {
 	jsonBody4, _ := json.Marshal(transfer4)
 	req4 := httptest.NewRequest("POST", "/api/transfers", bytes.NewReader(jsonBody4))
 	req4.Header.Set("Content-Type", "application/json")
+	req4.Header.Set("Authorization", bearer(t, userA))
 	resp4, _ := app.Test(req4)
 
 	if resp4.StatusCode != 201 {
@@ -227,17 +295,1914 @@ func TestNoConsecutiveSameRecipient(t *testing.T) {
 	}
 }
 
-func createTestUserWithBalance(t *testing.T, db *sql.DB, firstName, lastName string, balance int64) int64 {
+// Test Case 6: Ledger can be filtered and paged with a cursor
+func TestUserLedgerPagination(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	userA := createTestUserWithBalance(t, db, "Jo", "Yu", 1000)
+	userB := createTestUserWithBalance(t, db, "Kai", "Po", 0)
+	userC := createTestUserWithBalance(t, db, "Lu", "Xi", 0)
+
+	for _, to := range []int64{userB, userC, userB, userC, userB} {
+		if resp := postTransfer(t, app, userA, to, 10); resp.StatusCode != 201 {
+			t.Fatalf("Transfer failed with status %d", resp.StatusCode)
+		}
+	}
+	if resp := postTransfer(t, app, userB, userA, 5); resp.StatusCode != 201 {
+		t.Fatalf("Transfer failed with status %d", resp.StatusCode)
+	}
+
+	var seen []models.PointLedger
+	url := fmt.Sprintf("/api/users/%d/ledger?limit=2", userA)
+	for page := 0; page < 10; page++ {
+		resp, err := app.Test(asUser(t, httptest.NewRequest("GET", url, nil), userA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("Ledger request failed with status %d", resp.StatusCode)
+		}
+
+		var body models.LedgerListResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+		seen = append(seen, body.Data...)
+		if body.NextCursor == nil {
+			break
+		}
+		url = fmt.Sprintf("/api/users/%d/ledger?limit=2&cursor=%d", userA, *body.NextCursor)
+	}
+
+	if len(seen) != 6 {
+		t.Fatalf("Paged through %d entries, want 6", len(seen))
+	}
+	for i := 1; i < len(seen); i++ {
+		if seen[i].ID >= seen[i-1].ID {
+			t.Errorf("Entries are not ordered newest first: %d after %d", seen[i].ID, seen[i-1].ID)
+		}
+	}
+	if seen[0].EventType != "transfer_in" || seen[0].BalanceAfter != 955 {
+		t.Errorf("Newest entry = %s balance %d, want transfer_in balance 955", seen[0].EventType, seen[0].BalanceAfter)
+	}
+
+	resp, _ := app.Test(asUser(t, httptest.NewRequest("GET", fmt.Sprintf("/api/users/%d/ledger?event_type=transfer_out", userA), nil), userA))
+	var outgoing models.LedgerListResponse
+	json.NewDecoder(resp.Body).Decode(&outgoing)
+	if len(outgoing.Data) != 5 {
+		t.Errorf("event_type=transfer_out returned %d entries, want 5", len(outgoing.Data))
+	}
+
+	resp, _ = app.Test(asUser(t, httptest.NewRequest("GET", fmt.Sprintf("/api/users/%d/ledger?event_type=bogus", userA), nil), userA))
+	if resp.StatusCode != 400 {
+		t.Errorf("Unknown event_type should return 400, got %d", resp.StatusCode)
+	}
+
+	resp, _ = app.Test(asUser(t, httptest.NewRequest("GET", "/api/users/999999/ledger", nil), createTestAdmin(t, db)))
+	if resp.StatusCode != 404 {
+		t.Errorf("Unknown user should return 404, got %d", resp.StatusCode)
+	}
+}
+
+// Test Case 7: Earn, redeem and adjust update the balance and the ledger
+func TestPointsOperations(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	userID := createTestUserWithBalance(t, db, "Max", "Ra", 0)
+	admin := createTestAdmin(t, db)
+
+	// Users redeem their own points; earn and adjust are admin operations
+	post := func(op, key string, body map[string]interface{}) (int, models.PointLedger) {
+		caller := admin
+		if op == "redeem" {
+			caller = userID
+		}
+		jsonBody, _ := json.Marshal(body)
+		req := httptest.NewRequest("POST", fmt.Sprintf("/api/users/%d/points/%s", userID, op), bytes.NewReader(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearer(t, caller))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result map[string]models.PointLedger
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result["entry"]
+	}
+
+	earn := map[string]interface{}{"amount": 500, "reference": "order-42", "metadata": map[string]string{"channel": "pos"}}
+	status, entry := post("earn", "earn-order-42", earn)
+	if status != 201 || entry.BalanceAfter != 500 || entry.EventType != "earn" {
+		t.Fatalf("Earn returned %d %+v", status, entry)
+	}
+	if entry.Metadata != `{"channel":"pos"}` {
+		t.Errorf("Metadata = %q", entry.Metadata)
+	}
+
+	// Retrying the same earn must not credit twice
+	if status, replay := post("earn", "earn-order-42", earn); status != 201 || replay.ID != entry.ID {
+		t.Errorf("Earn retry returned %d entry %d, want 201 entry %d", status, replay.ID, entry.ID)
+	}
+	if status, _ := post("earn", "earn-order-42", map[string]interface{}{"amount": 900}); status != 422 {
+		t.Errorf("Reusing an earn key with another payload should return 422, got %d", status)
+	}
+
+	if status, entry = post("redeem", "", map[string]interface{}{"amount": 200}); status != 201 || entry.Change != -200 || entry.BalanceAfter != 300 {
+		t.Errorf("Redeem returned %d %+v", status, entry)
+	}
+	if status, _ = post("redeem", "", map[string]interface{}{"amount": 301}); status != 409 {
+		t.Errorf("Redeeming more than the balance should return 409, got %d", status)
+	}
+
+	if status, _ = post("adjust", "", map[string]interface{}{"amount": -50}); status != 400 {
+		t.Errorf("Adjust without reference should return 400, got %d", status)
+	}
+	if status, entry = post("adjust", "", map[string]interface{}{"amount": -50, "reference": "ticket-7"}); status != 201 || entry.BalanceAfter != 250 {
+		t.Errorf("Adjust returned %d %+v", status, entry)
+	}
+
+	var balance, ledgerSum int64
+	db.QueryRow("SELECT points_balance FROM users WHERE id = ?", userID).Scan(&balance)
+	db.QueryRow("SELECT SUM(change) FROM point_ledger WHERE user_id = ?", userID).Scan(&ledgerSum)
+	if balance != 250 || ledgerSum != 250 {
+		t.Errorf("Balance = %d, ledger sum = %d, want 250", balance, ledgerSum)
+	}
+
+	// Keys belong to the user whose points change
+	other := createTestUserWithBalance(t, db, "Nia", "Ra", 0)
+	earnFor := func(target int64, amount int64) (int, models.PointLedger, string) {
+		jsonBody, _ := json.Marshal(map[string]interface{}{"amount": amount})
+		req := httptest.NewRequest("POST", fmt.Sprintf("/api/users/%d/points/earn", target), bytes.NewReader(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearer(t, admin))
+		req.Header.Set("Idempotency-Key", "earn-order-42")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result map[string]models.PointLedger
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result["entry"], resp.Header.Get("Idempotent-Replayed")
+	}
+	if status, entry, replayed := earnFor(other, 70); status != 201 || replayed != "" || entry.UserID != other {
+		t.Errorf("Another user's earn with the key = %d %+v replayed=%q, want a new entry", status, entry, replayed)
+	}
+
+	// Past the retention a key is free again, even for another payload
+	db.Exec("UPDATE point_ledger SET created_at = ? WHERE idempotency_key = ?", models.Now().Add(-48*time.Hour), "earn-order-42")
+	status, reused, replayed := earnFor(userID, 30)
+	if status != 201 || replayed != "" || reused.BalanceAfter != 280 {
+		t.Errorf("Reusing an expired key = %d %+v replayed=%q, want a new entry", status, reused, replayed)
+	}
+	if status, retry, replayed := earnFor(userID, 30); status != 201 || replayed != "true" || retry.ID != reused.ID {
+		t.Errorf("Retrying the reused key = %d %+v replayed=%q, want a replay", status, retry, replayed)
+	}
+	var otherKey string
+	db.QueryRow("SELECT COALESCE(idempotency_key, '') FROM point_ledger WHERE user_id = ?", other).Scan(&otherKey)
+	if otherKey != "earn-order-42" {
+		t.Errorf("Another user's expired key = %q after the reuse, want it kept until the sweep", otherKey)
+	}
+}
+
+// Test Case 8: Reversal moves the points back and refuses to overdraw the recipient
+func TestTransferReversal(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	userA := createTestUserWithBalance(t, db, "Ned", "Bo", 1000)
+	userB := createTestUserWithBalance(t, db, "Oli", "Su", 0)
+	userC := createTestUserWithBalance(t, db, "Pam", "Vo", 0)
+
+	admin := createTestAdmin(t, db)
+
+	reverseAs := func(caller int64, idemKey string, body string) *http.Response {
+		req := httptest.NewRequest("POST", "/api/transfers/"+idemKey+"/reverse", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearer(t, caller))
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	reverse := func(idemKey string, body string) *http.Response {
+		return reverseAs(userB, idemKey, body)
+	}
+	balanceOf := func(id int64) int64 {
+		var balance int64
+		db.QueryRow("SELECT points_balance FROM users WHERE id = ?", id).Scan(&balance)
+		return balance
+	}
+
+	first := decodeTransfer(t, postTransfer(t, app, userA, userB, 100))
+	resp := reverse(first.IdemKey, `{"reason":"sent by mistake"}`)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Reversal failed with status %d", resp.StatusCode)
+	}
+	if reversed := decodeTransfer(t, resp); reversed.Status != "reversed" {
+		t.Errorf("Status = %s, want reversed", reversed.Status)
+	}
+	if balanceOf(userA) != 1000 || balanceOf(userB) != 0 {
+		t.Errorf("Balances after reversal = %d/%d, want 1000/0", balanceOf(userA), balanceOf(userB))
+	}
+
+	var compensating int
+	db.QueryRow("SELECT COUNT(*) FROM point_ledger WHERE transfer_id = ? AND reference = 'reversal'", first.TransferID).Scan(&compensating)
+	if compensating != 2 {
+		t.Errorf("Found %d compensating ledger entries, want 2", compensating)
+	}
+
+	if resp := reverse(first.IdemKey, ""); resp.StatusCode != 409 {
+		t.Errorf("Reversing twice should return 409, got %d", resp.StatusCode)
+	}
+
+	// B spends most of the points before the mistake is noticed
+	second := decodeTransfer(t, postTransfer(t, app, userA, userB, 300))
+	if resp := postTransfer(t, app, userB, userC, 250); resp.StatusCode != 201 {
+		t.Fatalf("Transfer B -> C failed with status %d", resp.StatusCode)
+	}
+
+	if resp := reverse(second.IdemKey, ""); resp.StatusCode != 409 {
+		t.Errorf("Reversal exceeding the recipient balance should return 409, got %d", resp.StatusCode)
+	}
+	// Only admins may overdraw the recipient, or two users could mint points
+	if resp := reverse(second.IdemKey, `{"allowNegative":true}`); resp.StatusCode != 403 {
+		t.Errorf("Reversal with allowNegative by the recipient should return 403, got %d", resp.StatusCode)
+	}
+	if balanceOf(userA) != 700 || balanceOf(userB) != 50 {
+		t.Errorf("Balances after refused reversal = %d/%d, want 700/50", balanceOf(userA), balanceOf(userB))
+	}
+	if resp := reverseAs(admin, second.IdemKey, `{"allowNegative":true}`); resp.StatusCode != 200 {
+		t.Errorf("Reversal with allowNegative by an admin should succeed, got %d", resp.StatusCode)
+	}
+	if balanceOf(userA) != 1000 || balanceOf(userB) != -250 {
+		t.Errorf("Balances after forced reversal = %d/%d, want 1000/-250", balanceOf(userA), balanceOf(userB))
+	}
+
+	if resp := reverse("does-not-exist", ""); resp.StatusCode != 404 {
+		t.Errorf("Reversing an unknown transfer should return 404, got %d", resp.StatusCode)
+	}
+}
+
+// Test Case 9: Pending transfers hold points until confirmed or cancelled
+func TestPendingTransferConfirmAndCancel(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	userA := createTestUserWithBalance(t, db, "Quy", "Do", 1000)
+	userB := createTestUserWithBalance(t, db, "Ray", "Ko", 0)
+	userC := createTestUserWithBalance(t, db, "Sam", "Le", 0)
+	userD := createTestUserWithBalance(t, db, "Tim", "Qi", 0)
+
+	hold := func(to, amount int64) models.Transfer {
+		jsonBody, _ := json.Marshal(models.CreateTransferRequest{FromUserID: userA, ToUserID: to, Amount: amount, Hold: true})
+		req := httptest.NewRequest("POST", "/api/transfers", bytes.NewReader(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearer(t, userA))
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 201 {
+			t.Fatalf("Pending transfer failed with status %d", resp.StatusCode)
+		}
+		return decodeTransfer(t, resp)
+	}
+	action := func(idemKey, name string) *http.Response {
+		resp, err := app.Test(asUser(t, httptest.NewRequest("POST", "/api/transfers/"+idemKey+"/"+name, nil), userA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	balances := func(id int64) (points, held int64) {
+		db.QueryRow("SELECT points_balance, held_balance FROM users WHERE id = ?", id).Scan(&points, &held)
+		return points, held
+	}
+
+	pending := hold(userB, 600)
+	if pending.Status != "pending" || pending.ExpiresAt == nil || pending.CompletedAt != nil {
+		t.Errorf("Hold created %+v, want pending with expiresAt", pending)
+	}
+	if points, held := balances(userA); points != 1000 || held != 600 {
+		t.Errorf("Sender after hold = %d/%d held, want 1000/600", points, held)
+	}
+	if resp := postTransfer(t, app, userA, userC, 500); resp.StatusCode != 409 {
+		t.Errorf("Spending held points should return 409, got %d", resp.StatusCode)
+	}
+
+	resp := action(pending.IdemKey, "confirm")
+	if resp.StatusCode != 200 {
+		t.Fatalf("Confirm failed with status %d", resp.StatusCode)
+	}
+	if confirmed := decodeTransfer(t, resp); confirmed.Status != "completed" || confirmed.CompletedAt == nil {
+		t.Errorf("Confirmed transfer = %+v, want completed", confirmed)
+	}
+	if points, held := balances(userA); points != 400 || held != 0 {
+		t.Errorf("Sender after confirm = %d/%d held, want 400/0", points, held)
+	}
+	if points, _ := balances(userB); points != 600 {
+		t.Errorf("Recipient after confirm = %d, want 600", points)
+	}
+	if resp := action(pending.IdemKey, "cancel"); resp.StatusCode != 409 {
+		t.Errorf("Cancelling a completed transfer should return 409, got %d", resp.StatusCode)
+	}
+
+	cancelled := hold(userC, 300)
+	if resp := action(cancelled.IdemKey, "cancel"); resp.StatusCode != 200 {
+		t.Errorf("Cancel failed with status %d", resp.StatusCode)
+	}
+	if points, held := balances(userA); points != 400 || held != 0 {
+		t.Errorf("Sender after cancel = %d/%d held, want 400/0", points, held)
+	}
+
+	stale := hold(userD, 100)
+	db.Exec("UPDATE transfers SET expires_at = ? WHERE transfer_id = ?", models.Now().Add(-time.Minute), stale.TransferID)
+	if resp := action(stale.IdemKey, "confirm"); resp.StatusCode != 409 {
+		t.Errorf("Confirming an expired hold should return 409, got %d", resp.StatusCode)
+	}
+	var status string
+	db.QueryRow("SELECT status FROM transfers WHERE transfer_id = ?", stale.TransferID).Scan(&status)
+	if points, held := balances(userA); status != "cancelled" || points != 400 || held != 0 {
+		t.Errorf("Expired hold left status %s and sender %d/%d held, want cancelled 400/0", status, points, held)
+	}
+}
+
+// Test Case 10: Every status change is recorded and illegal transitions are rejected
+func TestTransferStatusHistory(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	userA := createTestUserWithBalance(t, db, "Uma", "Ro", 1000)
+	userB := createTestUserWithBalance(t, db, "Vic", "Ye", 0)
+
+	jsonBody, _ := json.Marshal(models.CreateTransferRequest{FromUserID: userA, ToUserID: userB, Amount: 100, Hold: true})
+	req := httptest.NewRequest("POST", "/api/transfers", bytes.NewReader(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", bearer(t, userA))
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer := decodeTransfer(t, resp)
+
+	for _, step := range []struct {
+		action string
+		caller int64
+		status int
+	}{
+		{"confirm", userA, 200},
+		{"cancel", userA, 409},
+		{"reverse", userB, 200},
+		{"reverse", userB, 409},
+	} {
+		resp, err := app.Test(asUser(t, httptest.NewRequest("POST", "/api/transfers/"+transfer.IdemKey+"/"+step.action, nil), step.caller))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != step.status {
+			t.Errorf("%s returned %d, want %d", step.action, resp.StatusCode, step.status)
+		}
+	}
+
+	resp, err = app.Test(asUser(t, httptest.NewRequest("GET", "/api/transfers/"+transfer.IdemKey+"/history", nil), userB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		History []models.TransferStatusHistory `json:"history"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+
+	want := []struct{ from, to models.TransferStatus }{
+		{"", models.TransferPending},
+		{models.TransferPending, models.TransferProcessing},
+		{models.TransferProcessing, models.TransferCompleted},
+		{models.TransferCompleted, models.TransferReversed},
+	}
+	if len(body.History) != len(want) {
+		t.Fatalf("History has %d entries, want %d: %+v", len(body.History), len(want), body.History)
+	}
+	for i, w := range want {
+		h := body.History[i]
+		var from models.TransferStatus
+		if h.FromStatus != nil {
+			from = *h.FromStatus
+		}
+		if from != w.from || h.ToStatus != w.to || h.Actor == "" {
+			t.Errorf("History[%d] = %s -> %s by %q, want %s -> %s", i, from, h.ToStatus, h.Actor, w.from, w.to)
+		}
+	}
+}
+
+func postTransfer(t *testing.T, app *fiber.App, fromUserID, toUserID, amount int64) *http.Response {
+	jsonBody, _ := json.Marshal(models.CreateTransferRequest{
+		FromUserID: fromUserID,
+		ToUserID:   toUserID,
+		Amount:     amount,
+	})
+	req := httptest.NewRequest("POST", "/api/transfers", bytes.NewReader(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", bearer(t, fromUserID))
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func decodeTransfer(t *testing.T, resp *http.Response) models.Transfer {
+	var body map[string]models.Transfer
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body["transfer"]
+}
+
+func createTestUserWithBalance(t *testing.T, db *testDB, firstName, lastName string, balance int64) int64 {
 	now := models.Now()
-	result, err := db.Exec(`
+	var id int64
+	err := db.QueryRow(`
 		INSERT INTO users (first_name, last_name, email, phone, avatar_url, bio, points_balance, created_at, updated_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, firstName, lastName, "", "", "", "", balance, now, now)
+		RETURNING id
+	`, firstName, lastName, "", "", "", "", balance, now, now).Scan(&id)
 
 	if err != nil {
 		t.Fatalf("Failed to create test user: %v", err)
 	}
 
-	id, _ := result.LastInsertId()
 	return id
 }
+
+func createTestAdmin(t *testing.T, db *testDB) int64 {
+	id := createTestUserWithBalance(t, db, "Adm", "In", 0)
+	if _, err := db.Exec("UPDATE users SET role = 'admin' WHERE id = ?", id); err != nil {
+		t.Fatalf("Failed to promote admin: %v", err)
+	}
+	return id
+}
+
+// Test Case 4: Idempotency-Key replays the original transfer
+func TestTransferIdempotencyKey(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	userA := createTestUserWithBalance(t, db, "Dan", "Ong", 1000)
+	userB := createTestUserWithBalance(t, db, "Eve", "Wu", 0)
+
+	post := func(key string, amount int64) (int, map[string]models.Transfer, string) {
+		jsonBody, _ := json.Marshal(models.CreateTransferRequest{
+			FromUserID: userA,
+			ToUserID:   userB,
+			Amount:     amount,
+		})
+		req := httptest.NewRequest("POST", "/api/transfers", bytes.NewReader(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearer(t, userA))
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]models.Transfer
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body, resp.Header.Get("Idempotent-Replayed")
+	}
+
+	status1, body1, _ := post("order-0001-retry", 100)
+	if status1 != 201 {
+		t.Fatalf("First request failed with status %d", status1)
+	}
+
+	status2, body2, replayed := post("order-0001-retry", 100)
+	if status2 != 201 || replayed != "true" {
+		t.Fatalf("Retry should replay with 201, got status %d replayed=%q", status2, replayed)
+	}
+	if body2["transfer"].TransferID != body1["transfer"].TransferID {
+		t.Errorf("Retry returned transfer %d, want %d", body2["transfer"].TransferID, body1["transfer"].TransferID)
+	}
+
+	var balance int64
+	db.QueryRow("SELECT points_balance FROM users WHERE id = ?", userA).Scan(&balance)
+	if balance != 900 {
+		t.Errorf("Sender balance = %d after retry, want 900", balance)
+	}
+
+	if status, _, _ := post("order-0001-retry", 200); status != 422 {
+		t.Errorf("Reusing key with a different payload should return 422, got %d", status)
+	}
+
+	// Keys belong to their sender
+	userC := createTestUserWithBalance(t, db, "Fin", "Oh", 1000)
+	jsonBody, _ := json.Marshal(models.CreateTransferRequest{ToUserID: userB, Amount: 100})
+	req := httptest.NewRequest("POST", "/api/transfers", bytes.NewReader(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", bearer(t, userC))
+	req.Header.Set("Idempotency-Key", "order-0001-retry")
+	if resp, _ := app.Test(req); resp.StatusCode != 201 || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("Another sender's key = %d replayed=%q, want a new transfer", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+	}
+
+	// Past the retention a key is free again
+	postTransfer(t, app, userA, userC, 10)
+	db.Exec("UPDATE transfers SET created_at = ? WHERE client_key = ?", models.Now().Add(-48*time.Hour), "order-0001-retry")
+	status3, body3, replayed := post("order-0001-retry", 200)
+	if status3 != 201 || replayed != "" || body3["transfer"].TransferID == body1["transfer"].TransferID {
+		t.Errorf("Reusing an expired key = %d replayed=%q, want a new transfer", status3, replayed)
+	}
+	if status, _, replayed := post("order-0001-retry", 200); status != 201 || replayed != "true" {
+		t.Errorf("Retrying the reused key = %d replayed=%q, want a replay", status, replayed)
+	}
+	var otherKey string
+	db.QueryRow("SELECT COALESCE(client_key, '') FROM transfers WHERE from_user_id = ?", userC).Scan(&otherKey)
+	if otherKey != "order-0001-retry" {
+		t.Errorf("Another sender's expired key = %q after the reuse, want it kept until the sweep", otherKey)
+	}
+
+	// A retry that changes the hold is not a replay, whatever the note
+	postNote := func(note string, hold bool) (int, string) {
+		jsonBody, _ := json.Marshal(models.CreateTransferRequest{ToUserID: userC, Amount: 5, Note: note, Hold: hold})
+		req := httptest.NewRequest("POST", "/api/transfers", bytes.NewReader(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearer(t, userA))
+		req.Header.Set("Idempotency-Key", "order-0002-hold")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header.Get("Idempotent-Replayed")
+	}
+	if status, _ := postNote("x|hold", false); status != 201 {
+		t.Fatalf("Transfer with a note = %d, want 201", status)
+	}
+	if status, replayed := postNote("x", true); status != 422 || replayed != "" {
+		t.Errorf("Retry as a hold = %d replayed=%q, want 422", status, replayed)
+	}
+}
+
+// Test Case 5: Concurrent transfers never overdraw an account
+func TestConcurrentTransfersNeverOverdraw(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	const senderBalance = 1000
+	sender := createTestUserWithBalance(t, db, "Fay", "Ng", senderBalance)
+	recipients := make([]int64, 300)
+	for i := range recipients {
+		recipients[i] = createTestUserWithBalance(t, db, "Gus", "Ho", 0)
+	}
+
+	auth := bearer(t, sender)
+	var wg sync.WaitGroup
+	for _, recipient := range recipients {
+		wg.Add(1)
+		go func(recipient int64) {
+			defer wg.Done()
+			jsonBody, _ := json.Marshal(models.CreateTransferRequest{
+				FromUserID: sender,
+				ToUserID:   recipient,
+				Amount:     30,
+			})
+			req := httptest.NewRequest("POST", "/api/transfers", bytes.NewReader(jsonBody))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", auth)
+			if _, err := app.Test(req, -1); err != nil {
+				t.Error(err)
+			}
+		}(recipient)
+	}
+	wg.Wait()
+
+	var balance, received, ledgerSum int64
+	db.QueryRow("SELECT points_balance FROM users WHERE id = ?", sender).Scan(&balance)
+	db.QueryRow("SELECT COALESCE(SUM(points_balance), 0) FROM users WHERE id != ?", sender).Scan(&received)
+	db.QueryRow("SELECT COALESCE(SUM(change), 0) FROM point_ledger WHERE user_id = ?", sender).Scan(&ledgerSum)
+
+	if balance < 0 {
+		t.Errorf("Sender balance went negative: %d", balance)
+	}
+	if balance+received != senderBalance {
+		t.Errorf("Points were created or lost: sender %d + recipients %d != %d", balance, received, senderBalance)
+	}
+	if balance != senderBalance+ledgerSum {
+		t.Errorf("Sender balance %d does not match ledger (%d + %d)", balance, senderBalance, ledgerSum)
+	}
+
+	var negative int
+	db.QueryRow("SELECT COUNT(*) FROM point_ledger WHERE balance_after < 0").Scan(&negative)
+	if negative != 0 {
+		t.Errorf("Found %d ledger entries with a negative balance_after", negative)
+	}
+}
+
+// Test Case 11: Migrations roll back and re-apply, and legacy databases are adopted
+func TestMigrations(t *testing.T) {
+	db, dialect, err := InitDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A database created by the old unversioned Migrate, before holds existed
+	for _, stmt := range []string{
+		`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, first_name TEXT NOT NULL, last_name TEXT NOT NULL, email TEXT, phone TEXT, avatar_url TEXT, bio TEXT, points_balance INTEGER NOT NULL DEFAULT 0, created_at DATETIME NOT NULL, updated_at DATETIME NOT NULL)`,
+		`CREATE TABLE transfers (transfer_id INTEGER PRIMARY KEY AUTOINCREMENT, from_user_id INTEGER NOT NULL, to_user_id INTEGER NOT NULL, amount INTEGER NOT NULL, status TEXT NOT NULL, note TEXT, idempotency_key TEXT NOT NULL UNIQUE, request_hash TEXT, created_at DATETIME NOT NULL, updated_at DATETIME NOT NULL, completed_at DATETIME, fail_reason TEXT)`,
+		`CREATE TABLE point_ledger (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, change INTEGER NOT NULL, balance_after INTEGER NOT NULL, event_type TEXT NOT NULL, transfer_id INTEGER, reference TEXT, metadata TEXT, idempotency_key TEXT, request_hash TEXT, created_at DATETIME NOT NULL)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrator, err := migrations.New(db, dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatalf("Up on legacy database: %v", err)
+	}
+	if len(applied) == 0 || applied[0].Version != 3 {
+		t.Fatalf("Up on legacy database applied %d migrations, want them to start at 0003", len(applied))
+	}
+
+	// Roll back everything the legacy database did not have
+	rolledBack, err := migrator.Down(len(applied))
+	if err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+	if len(rolledBack) != len(applied) || rolledBack[len(rolledBack)-1].Version != 3 {
+		t.Fatalf("Down rolled back %d migrations, want %d ending at 0003", len(rolledBack), len(applied))
+	}
+
+	var held int
+	db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('users') WHERE name = 'held_balance'").Scan(&held)
+	if held != 0 {
+		t.Error("held_balance still exists after rolling back 0003")
+	}
+
+	status, err := migrator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if wantApplied := s.Version <= 2; (s.AppliedAt != nil) != wantApplied {
+			t.Errorf("Migration %04d applied = %v, want %v", s.Version, s.AppliedAt != nil, wantApplied)
+		}
+	}
+
+	if _, err := migrator.Up(); err != nil {
+		t.Fatalf("Up after Down: %v", err)
+	}
+	if _, err := db.Exec("SELECT held_balance FROM users"); err != nil {
+		t.Errorf("held_balance missing after re-applying: %v", err)
+	}
+}
+
+// Test Case 12: Config layers file, env and flags, validates and redacts secrets
+func TestConfigLoad(t *testing.T) {
+	file := t.TempDir() + "/config.json"
+	os.WriteFile(file, []byte(`{"listenAddr": ":4000", "logLevel": "warn", "pagination": {"maxPageSize": 100}}`), 0o600)
+
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("LOG_LEVEL", "debug")
+	t.Setenv("DATABASE_URL", "postgres://app:s3cret@db:5432/points")
+
+	cfg, err := config.Load([]string{"--listen", ":5000", "migrate", "status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenAddr != ":5000" || cfg.LogLevel != "debug" || cfg.Pagination.MaxPageSize != 100 || cfg.Pagination.DefaultPageSize != 20 {
+		t.Errorf("Unexpected layering: %+v", cfg)
+	}
+	if len(cfg.Args) != 2 || cfg.Args[0] != "migrate" {
+		t.Errorf("Args = %v, want [migrate status]", cfg.Args)
+	}
+
+	redacted, _ := json.Marshal(cfg.Redacted())
+	if strings.Contains(string(redacted), "s3cret") {
+		t.Errorf("Redacted config leaks the database password: %s", redacted)
+	}
+	if cfg.DatabaseURL != "postgres://app:s3cret@db:5432/points" {
+		t.Error("Redacted modified the original config")
+	}
+
+	if _, err := config.Load([]string{"--default-page-size", "500"}); err == nil {
+		t.Error("Expected a default page size above maxPageSize to be rejected")
+	}
+}
+
+// Test Case 13: Tokens are required and the sender of a transfer is the caller
+func TestAuthAndTransferOwnership(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	postJSON := func(url, body, authorization string) *http.Response {
+		req := httptest.NewRequest("POST", url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := postJSON("/api/auth/register", `{"first_name":"Wan","last_name":"Li","username":"wan.li","password":"correct horse"}`, "")
+	if resp.StatusCode != 201 {
+		t.Fatalf("Register returned %d, want 201", resp.StatusCode)
+	}
+	var registered models.User
+	json.NewDecoder(resp.Body).Decode(&registered)
+
+	if resp := postJSON("/api/auth/register", `{"first_name":"Wan","last_name":"Li","username":"wan.li","password":"correct horse"}`, ""); resp.StatusCode != 409 {
+		t.Errorf("Registering a taken username returned %d, want 409", resp.StatusCode)
+	}
+	if resp := postJSON("/api/auth/login", `{"username":"wan.li","password":"wrong password"}`, ""); resp.StatusCode != 401 {
+		t.Errorf("Login with a wrong password returned %d, want 401", resp.StatusCode)
+	}
+
+	resp = postJSON("/api/auth/login", `{"username":"wan.li","password":"correct horse"}`, "")
+	var token models.TokenResponse
+	json.NewDecoder(resp.Body).Decode(&token)
+	if resp.StatusCode != 200 || token.AccessToken == "" {
+		t.Fatalf("Login returned %d with token %q", resp.StatusCode, token.AccessToken)
+	}
+
+	db.Exec("UPDATE users SET points_balance = 500 WHERE id = ?", registered.ID)
+	victim := createTestUserWithBalance(t, db, "Xu", "Ma", 1000)
+	other := createTestUserWithBalance(t, db, "Yan", "Ng", 0)
+
+	transfer := fmt.Sprintf(`{"toUserId":%d,"amount":100}`, other)
+	if resp := postJSON("/api/transfers", transfer, ""); resp.StatusCode != 401 {
+		t.Errorf("Transfer without a token returned %d, want 401", resp.StatusCode)
+	}
+	if resp := postJSON("/api/transfers", transfer, "Bearer "+token.AccessToken+"x"); resp.StatusCode != 401 {
+		t.Errorf("Transfer with a tampered token returned %d, want 401", resp.StatusCode)
+	}
+
+	stolen := fmt.Sprintf(`{"fromUserId":%d,"toUserId":%d,"amount":100}`, victim, other)
+	if resp := postJSON("/api/transfers", stolen, "Bearer "+token.AccessToken); resp.StatusCode != 403 {
+		t.Errorf("Transfer from another user's account returned %d, want 403", resp.StatusCode)
+	}
+
+	resp = postJSON("/api/transfers", transfer, "Bearer "+token.AccessToken)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Transfer with a login token returned %d, want 201", resp.StatusCode)
+	}
+	created := decodeTransfer(t, resp)
+	if created.FromUserID != registered.ID {
+		t.Errorf("Sender = %d, want the caller %d", created.FromUserID, registered.ID)
+	}
+
+	resp, _ = app.Test(asUser(t, httptest.NewRequest("GET", "/api/transfers/"+created.IdemKey, nil), victim))
+	if resp.StatusCode != 403 {
+		t.Errorf("Reading someone else's transfer returned %d, want 403", resp.StatusCode)
+	}
+	resp, _ = app.Test(asUser(t, httptest.NewRequest("GET", "/api/transfers/"+created.IdemKey, nil), other))
+	if resp.StatusCode != 200 {
+		t.Errorf("Recipient reading the transfer returned %d, want 200", resp.StatusCode)
+	}
+}
+
+// Test Case 14: Routes enforce the permission table for each role
+func TestRolePermissions(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	user := createTestUserWithBalance(t, db, "Uma", "Re", 100)
+	other := createTestUserWithBalance(t, db, "Vic", "So", 100)
+	support := createTestUserWithBalance(t, db, "Sue", "Pp", 0)
+	db.Exec("UPDATE users SET role = 'support' WHERE id = ?", support)
+	admin := createTestAdmin(t, db)
+
+	call := func(method, path, body string, caller int64) *http.Response {
+		req := httptest.NewRequest(method, "/api"+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(asUser(t, req, caller))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Every route that needs a permission refuses a plain user acting on
+	// someone else's account with a stable error code, and admits an admin.
+	// The target may be deleted along the way, so it is not reused below.
+	target := createTestUserWithBalance(t, db, "Tar", "Ge", 100)
+	for _, r := range routes(&apiHandlers{}) {
+		if r.rule.Owner {
+			continue
+		}
+		path := strings.Replace(r.path, ":id", fmt.Sprint(target), 1)
+
+		resp := call(r.method, path, "{}", user)
+		var body map[string]any
+		json.NewDecoder(resp.Body).Decode(&body)
+		if resp.StatusCode != 403 || body["code"] != services.ErrForbidden.Code {
+			t.Errorf("%s %s as user = %d %v, want 403 %s", r.method, path, resp.StatusCode, body, services.ErrForbidden.Code)
+		}
+		if resp := call(r.method, path, "{}", admin); resp.StatusCode == 403 {
+			t.Errorf("%s %s as admin = 403", r.method, path)
+		}
+	}
+
+	// Users read and edit their own profile
+	if resp := call("GET", fmt.Sprintf("/users/%d", user), "", user); resp.StatusCode != 200 {
+		t.Errorf("Reading own profile returned %d, want 200", resp.StatusCode)
+	}
+	if resp := call("PATCH", fmt.Sprintf("/users/%d", user), `{"bio":"hi"}`, user); resp.StatusCode != 200 {
+		t.Errorf("Editing own profile returned %d, want 200", resp.StatusCode)
+	}
+
+	// Support reads every account but cannot change them
+	if resp := call("GET", "/users", "", support); resp.StatusCode != 200 {
+		t.Errorf("Support listing users returned %d, want 200", resp.StatusCode)
+	}
+	if resp := call("GET", fmt.Sprintf("/users/%d/ledger", other), "", support); resp.StatusCode != 200 {
+		t.Errorf("Support reading a ledger returned %d, want 200", resp.StatusCode)
+	}
+	if resp := call("DELETE", fmt.Sprintf("/users/%d", other), "", support); resp.StatusCode != 403 {
+		t.Errorf("Support deleting a user returned %d, want 403", resp.StatusCode)
+	}
+
+	// Owning a transfer lets a user reverse it but not overdraw themselves;
+	// that is a permission of its own
+	received := decodeTransfer(t, postTransfer(t, app, other, user, 50))
+	resp := call("POST", "/transfers/"+received.IdemKey+"/reverse", `{"allowNegative":true}`, user)
+	var body map[string]any
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != 403 || body["code"] != services.ErrForbidden.Code {
+		t.Errorf("Overdrawing reversal as user = %d %v, want 403 %s", resp.StatusCode, body, services.ErrForbidden.Code)
+	}
+	if models.RoleUser.Can(models.PermTransfersOverdraw) || models.RoleSupport.Can(models.PermTransfersOverdraw) {
+		t.Error("Only admins should have transfers:overdraw")
+	}
+	if resp := call("POST", "/transfers/"+received.IdemKey+"/reverse", "", user); resp.StatusCode != 200 {
+		t.Errorf("Reversing an owned transfer returned %d, want 200", resp.StatusCode)
+	}
+
+	// Support undoes mistaken transfers between other users, but not past
+	// what the recipient holds
+	mistaken := decodeTransfer(t, postTransfer(t, app, other, user, 20))
+	if resp := call("POST", "/transfers/"+mistaken.IdemKey+"/reverse", `{"allowNegative":true}`, support); resp.StatusCode != 403 {
+		t.Errorf("Overdrawing reversal as support returned %d, want 403", resp.StatusCode)
+	}
+	if resp := call("POST", "/transfers/"+mistaken.IdemKey+"/reverse", `{"reason":"wrong recipient"}`, support); resp.StatusCode != 200 {
+		t.Errorf("Support reversing another user's transfer returned %d, want 200", resp.StatusCode)
+	}
+
+	// A role change applies to tokens that were already issued
+	if resp := call("PUT", fmt.Sprintf("/users/%d/role", user), `{"role":"root"}`, admin); resp.StatusCode != 400 {
+		t.Errorf("Unknown role returned %d, want 400", resp.StatusCode)
+	}
+	if resp := call("PUT", fmt.Sprintf("/users/%d/role", user), `{"role":"support"}`, admin); resp.StatusCode != 200 {
+		t.Fatalf("Setting a role returned %d, want 200", resp.StatusCode)
+	}
+	if resp := call("GET", "/users", "", user); resp.StatusCode != 200 {
+		t.Errorf("Listing users after promotion to support returned %d, want 200", resp.StatusCode)
+	}
+}
+
+// Test Case 15: API keys are shown once, limited to their scopes and revocable
+func TestAPIKeys(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	admin := createTestAdmin(t, db)
+	merchant := createTestUserWithBalance(t, db, "Mer", "Ch", 0)
+	customer := createTestUserWithBalance(t, db, "Cu", "St", 100)
+
+	call := func(method, path, body, authorization string) *http.Response {
+		req := httptest.NewRequest(method, "/api"+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", authorization)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := call("POST", "/api-keys", fmt.Sprintf(`{"name":"shop","ownerId":%d,"scopes":["points:fly"]}`, merchant), bearer(t, admin)); resp.StatusCode != 400 {
+		t.Errorf("Unknown scope returned %d, want 400", resp.StatusCode)
+	}
+	if resp := call("POST", "/api-keys", fmt.Sprintf(`{"name":"shop","ownerId":%d,"scopes":["points:earn"]}`, merchant), bearer(t, merchant)); resp.StatusCode != 403 {
+		t.Errorf("Non-admin creating a key returned %d, want 403", resp.StatusCode)
+	}
+
+	resp := call("POST", "/api-keys", fmt.Sprintf(`{"name":"shop","ownerId":%d,"scopes":["points:earn"]}`, merchant), bearer(t, admin))
+	var created models.CreateAPIKeyResponse
+	json.NewDecoder(resp.Body).Decode(&created)
+	if resp.StatusCode != 201 || !strings.HasPrefix(created.Key, "pk_"+created.Prefix+"_") {
+		t.Fatalf("Creating a key returned %d with key %q", resp.StatusCode, created.Key)
+	}
+	apiKey := "ApiKey " + created.Key
+
+	earn := fmt.Sprintf("/users/%d/points/earn", customer)
+	if resp := call("POST", earn, `{"amount":50,"reference":"order-1"}`, apiKey); resp.StatusCode != 201 {
+		t.Errorf("Earn with a points:earn key returned %d, want 201", resp.StatusCode)
+	}
+	if resp := call("POST", fmt.Sprintf("/users/%d/points/redeem", merchant), `{"amount":1}`, apiKey); resp.StatusCode != 403 {
+		t.Errorf("Redeem outside the key's scopes returned %d, want 403", resp.StatusCode)
+	}
+	if resp := call("POST", earn, `{"amount":50}`, "ApiKey pk_"+created.Prefix+"_guessed"); resp.StatusCode != 401 {
+		t.Errorf("Earn with a wrong secret returned %d, want 401", resp.StatusCode)
+	}
+
+	// Listings never contain the secret
+	resp = call("GET", "/api-keys", "", bearer(t, admin))
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || strings.Contains(string(raw), created.Key) || !strings.Contains(string(raw), `"lastUsedAt"`) {
+		t.Errorf("Listing keys returned %d %s", resp.StatusCode, raw)
+	}
+
+	if resp := call("DELETE", fmt.Sprintf("/api-keys/%d", created.ID), "", bearer(t, admin)); resp.StatusCode != 204 {
+		t.Fatalf("Revoking the key returned %d, want 204", resp.StatusCode)
+	}
+	if resp := call("POST", earn, `{"amount":50}`, apiKey); resp.StatusCode != 401 {
+		t.Errorf("Earn with a revoked key returned %d, want 401", resp.StatusCode)
+	}
+}
+
+// Test Case 16: Errors are problem+json with a stable code and the request ID
+func TestProblemDetails(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	admin := createTestAdmin(t, db)
+	poor := createTestUserWithBalance(t, db, "Po", "Or", 10)
+	rich := createTestUserWithBalance(t, db, "Ri", "Ch", 1000)
+
+	problem := func(resp *http.Response) handlers.Problem {
+		t.Helper()
+		if ct := resp.Header.Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("Content-Type = %q, want application/problem+json", ct)
+		}
+		var p handlers.Problem
+		json.NewDecoder(resp.Body).Decode(&p)
+		if p.Status != resp.StatusCode || p.RequestID == "" || p.RequestID != resp.Header.Get("X-Request-ID") {
+			t.Errorf("Problem %+v does not match status %d and request ID %q", p, resp.StatusCode, resp.Header.Get("X-Request-ID"))
+		}
+		return p
+	}
+
+	resp := postTransfer(t, app, poor, rich, 50)
+	if p := problem(resp); resp.StatusCode != 409 || p.Code != "insufficient_balance" || p.Title != "Conflict" {
+		t.Errorf("Overdraft = %d %+v, want 409 insufficient_balance", resp.StatusCode, p)
+	}
+
+	postTransfer(t, app, rich, poor, 10)
+	resp = postTransfer(t, app, rich, poor, 10)
+	if p := problem(resp); resp.StatusCode != 422 || p.Code != "same_recipient" {
+		t.Errorf("Repeat recipient = %d %+v, want 422 same_recipient", resp.StatusCode, p)
+	}
+
+	resp, _ = app.Test(asUser(t, httptest.NewRequest("GET", "/api/users/999999", nil), admin))
+	if p := problem(resp); resp.StatusCode != 404 || p.Code != "user_not_found" {
+		t.Errorf("Unknown user = %d %+v, want 404 user_not_found", resp.StatusCode, p)
+	}
+
+	req := httptest.NewRequest("POST", "/api/users", strings.NewReader(`{"first_name":"Thomas"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ = app.Test(asUser(t, req, admin))
+	p := problem(resp)
+	if resp.StatusCode != 400 || p.Code != "validation_failed" {
+		t.Fatalf("Invalid user = %d %+v, want 400 validation_failed", resp.StatusCode, p)
+	}
+	fields := map[string]bool{}
+	for _, f := range p.FieldErrors {
+		fields[f.Field] = true
+	}
+	if len(p.FieldErrors) != 2 || !fields["first_name"] || !fields["last_name"] {
+		t.Errorf("Field errors = %+v, want first_name and last_name", p.FieldErrors)
+	}
+}
+
+// Test Case 17: Messages follow the locale preference or Accept-Language
+func TestLocalizedErrors(t *testing.T) {
+	if missing := i18n.Missing(i18n.Thai); len(missing) > 0 {
+		t.Errorf("Thai catalog is missing %v", missing)
+	}
+	if got, want := i18n.T("fr", "insufficient_balance", i18n.Params{"amount": 5}), i18n.T(i18n.English, "insufficient_balance", i18n.Params{"amount": 5}); got != want {
+		t.Errorf("Unsupported language = %q, want English %q", got, want)
+	}
+	if got := i18n.Match("fr-CH, th-TH;q=0.8, en;q=0.5"); got != i18n.Thai {
+		t.Errorf("Match = %q, want th", got)
+	}
+
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	admin := createTestAdmin(t, db)
+	poor := createTestUserWithBalance(t, db, "Po", "Or", 10)
+	rich := createTestUserWithBalance(t, db, "Ri", "Ch", 1000)
+
+	overdraft := func(lang string) (*http.Response, handlers.Problem) {
+		t.Helper()
+		body, _ := json.Marshal(models.CreateTransferRequest{ToUserID: rich, Amount: 50})
+		req := httptest.NewRequest("POST", "/api/transfers", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if lang != "" {
+			req.Header.Set("Accept-Language", lang)
+		}
+		resp, _ := app.Test(asUser(t, req, poor))
+		var p handlers.Problem
+		json.NewDecoder(resp.Body).Decode(&p)
+		return resp, p
+	}
+
+	resp, p := overdraft("th-TH,th;q=0.9")
+	if p.Code != "insufficient_balance" || p.Detail != "ยอดคงเหลือไม่พอ: ต้องการ 50 แต้ม" || resp.Header.Get("Content-Language") != "th" {
+		t.Errorf("Thai overdraft = %q %+v", resp.Header.Get("Content-Language"), p)
+	}
+	if _, p := overdraft(""); p.Detail != "insufficient balance: 50 points needed" {
+		t.Errorf("Default overdraft detail = %q, want English", p.Detail)
+	}
+
+	body, _ := json.Marshal(models.UpdateUserRequest{Locale: "th"})
+	req := httptest.NewRequest("PATCH", fmt.Sprintf("/api/users/%d", poor), bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, _ := app.Test(asUser(t, req, poor)); resp.StatusCode != 200 {
+		t.Fatalf("Setting locale = %d, want 200", resp.StatusCode)
+	}
+	if _, p := overdraft("en"); p.Detail != "ยอดคงเหลือไม่พอ: ต้องการ 50 แต้ม" {
+		t.Errorf("Locale preference overdraft detail = %q, want Thai", p.Detail)
+	}
+
+	req = httptest.NewRequest("POST", "/api/users", strings.NewReader(`{"first_name":"Tom","last_name":"Li","locale":"fr"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Language", "th")
+	resp, _ = app.Test(asUser(t, req, admin))
+	json.NewDecoder(resp.Body).Decode(&p)
+	if resp.StatusCode != 400 || len(p.FieldErrors) != 1 || p.FieldErrors[0].Field != "locale" ||
+		p.FieldErrors[0].Message != i18n.T(i18n.Thai, "field.one_of", i18n.Params{"values": "en, th"}) {
+		t.Errorf("Unsupported locale = %d %+v, want a Thai field error", resp.StatusCode, p)
+	}
+
+	// Bad query parameters are field errors from the catalog too
+	req = httptest.NewRequest("GET", "/api/transfers?userId=abc&from=yesterday", nil)
+	req.Header.Set("Accept-Language", "th")
+	resp, _ = app.Test(asUser(t, req, admin))
+	p = handlers.Problem{}
+	json.NewDecoder(resp.Body).Decode(&p)
+	if resp.StatusCode != 400 || p.Code != services.ErrValidation.Code || len(p.FieldErrors) != 1 ||
+		p.FieldErrors[0].Field != "userId" || p.FieldErrors[0].Message != i18n.T(i18n.Thai, "field.integer", nil) {
+		t.Errorf("Bad userId = %d %+v, want a Thai field error", resp.StatusCode, p)
+	}
+
+	req = httptest.NewRequest("GET", "/api/transfers", nil)
+	req.Header.Set("Accept-Language", "th")
+	resp, _ = app.Test(req)
+	p = handlers.Problem{}
+	json.NewDecoder(resp.Body).Decode(&p)
+	if resp.StatusCode != 401 || p.Code != services.ErrUnauthenticated.Code || p.Detail != i18n.T(i18n.Thai, "unauthenticated", nil) {
+		t.Errorf("Missing token = %d %+v, want 401 %s in Thai", resp.StatusCode, p, services.ErrUnauthenticated.Code)
+	}
+}
+
+// Test Case 18: Requests are validated from their tags and unknown fields are rejected
+func TestRequestValidation(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	admin := createTestAdmin(t, db)
+
+	post := func(url, body string) (int, map[string]string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(asUser(t, req, admin))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p handlers.Problem
+		json.NewDecoder(resp.Body).Decode(&p)
+		codes := map[string]string{}
+		for _, f := range p.FieldErrors {
+			codes[f.Field] = f.Code
+		}
+		return resp.StatusCode, codes
+	}
+
+	tests := []struct {
+		name  string
+		url   string
+		body  string
+		codes map[string]string
+	}{
+		{
+			"All field errors at once", "/api/users",
+			`{"first_name":"Thomas","email":"somchai@","phone":"12","avatar_url":"ftp://example.com/a.png","locale":"fr"}`,
+			map[string]string{"first_name": "max_length", "last_name": "required", "email": "email", "phone": "phone", "avatar_url": "url", "locale": "one_of"},
+		},
+		{
+			"Unknown fields and wrong types", "/api/users",
+			`{"first_name":"Tom","last_name":"Li","nickname":"T","bio":5}`,
+			map[string]string{"nickname": "unknown_field", "bio": "type"},
+		},
+		{
+			"Unknown transfer field", "/api/transfers",
+			`{"toUserId":2,"amount":10,"memo":"hi"}`,
+			map[string]string{"memo": "unknown_field"},
+		},
+		{
+			"Transfer tags", "/api/transfers",
+			`{"amount":-5,"note":"` + strings.Repeat("x", 513) + `"}`,
+			map[string]string{"toUserId": "required", "amount": "positive", "note": "max_length"},
+		},
+		{
+			"Unknown field of a batch item", "/api/transfers/batch",
+			`{"transfers":[{"toUserId":2,"amount":10},{"toUserId":3,"amount":"ten","memo":"hi"}]}`,
+			map[string]string{"transfers[1].amount": "type", "transfers[1].memo": "unknown_field"},
+		},
+		{
+			"Points tags", fmt.Sprintf("/api/users/%d/points/earn", admin),
+			`{"amount":0}`,
+			map[string]string{"amount": "positive"},
+		},
+		{
+			"Adjust tags", fmt.Sprintf("/api/users/%d/points/adjust", admin),
+			`{"amount":0,"metadata":{}}`,
+			map[string]string{"amount": "non_zero", "reference": "required"},
+		},
+		{
+			"API key tags", "/api/api-keys",
+			`{"name":"` + strings.Repeat("k", 101) + `","ownerId":1,"scopes":[]}`,
+			map[string]string{"name": "max_length", "scopes": "required"},
+		},
+		{
+			"Register tags", "/api/auth/register",
+			`{"first_name":"Tom","last_name":"Li","username":"t!","password":"` + strings.Repeat("ก", 25) + `"}`,
+			map[string]string{"username": "username_format", "password": "max_bytes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, codes := post(tt.url, tt.body)
+			if status != 400 || len(codes) != len(tt.codes) {
+				t.Fatalf("Got %d %v, want 400 %v", status, codes, tt.codes)
+			}
+			for field, code := range tt.codes {
+				if codes[field] != code {
+					t.Errorf("Field %s = %q, want %q", field, codes[field], code)
+				}
+			}
+		})
+	}
+
+	status, codes := post("/api/users", `{"first_name":"Tom","last_name":"Li","email":"tom@example.com","phone":"+66 81 234 5678","avatar_url":"https://example.com/tom.png"}`)
+	if status != 201 {
+		t.Errorf("Valid user = %d %v, want 201", status, codes)
+	}
+
+	// Bodies that are not JSON are refused rather than parsed leniently
+	req := httptest.NewRequest("POST", "/api/transfers", strings.NewReader("toUserId=2&amount=10"))
+	req.Header.Set("Content-Type", fiber.MIMEApplicationForm)
+	if resp, _ := app.Test(asUser(t, req, admin)); resp.StatusCode != 415 {
+		t.Errorf("Form body = %d, want 415", resp.StatusCode)
+	}
+
+	// Lengths count characters, not bytes
+	if v := validation.Struct(&models.CreateTransferRequest{ToUserID: 2, Amount: 1, Note: strings.Repeat("ก", 512)}); len(v) != 0 {
+		t.Errorf("Valid transfer has violations %+v", v)
+	}
+}
+
+// Test Case 19: Transfer rules from the transfer_rules table name the rule that rejects a transfer
+func TestTransferRules(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	alice := createTestUserWithBalance(t, db, "Ali", "Ce", 10000)
+	bob := createTestUserWithBalance(t, db, "Bob", "B", 0)
+	carol := createTestUserWithBalance(t, db, "Car", "Ol", 0)
+	dave := createTestUserWithBalance(t, db, "Dav", "E", 0)
+
+	store := repositories.NewStore(db.DB, db.dialect)
+	addRule := func(rule models.TransferRule) {
+		t.Helper()
+		if err := store.TransferRules().Create(&rule, models.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addRule(models.TransferRule{Name: "max-500", Type: models.RuleMaxAmount, Amount: 500})
+	addRule(models.TransferRule{Name: "daily", Type: models.RuleDailyLimit, Amount: 600, Timezone: "Asia/Bangkok"})
+	addRule(models.TransferRule{Name: "no-alice-to-carol", Type: models.RuleBlockedPair, FromUserID: alice, ToUserID: carol})
+
+	rejected := func(resp *http.Response, code, rule string) {
+		t.Helper()
+		var p handlers.Problem
+		json.NewDecoder(resp.Body).Decode(&p)
+		if resp.StatusCode != 422 || p.Code != code || p.Rule != rule {
+			t.Errorf("Got %d %s by %q, want 422 %s by %q", resp.StatusCode, p.Code, p.Rule, code, rule)
+		}
+	}
+
+	rejected(postTransfer(t, app, alice, bob, 700), "amount_above_maximum", "max-500")
+	if resp := postTransfer(t, app, alice, bob, 400); resp.StatusCode != 201 {
+		t.Fatalf("Transfer within the rules = %d, want 201", resp.StatusCode)
+	}
+	rejected(postTransfer(t, app, alice, carol, 100), "transfer_blocked", "no-alice-to-carol")
+	rejected(postTransfer(t, app, alice, dave, 300), "daily_limit_exceeded", "daily")
+	rejected(postTransfer(t, app, alice, bob, 100), "same_recipient", "same_recipient")
+
+	// A window that closed an hour ago and opens in an hour
+	now := models.Now()
+	addRule(models.TransferRule{Name: "office-hours", Type: models.RuleTimeWindow,
+		Start: now.Add(time.Hour).Format("15:04"), End: now.Add(-time.Hour).Format("15:04")})
+
+	dryRun := func(to, amount int64) models.TransferDryRunResponse {
+		t.Helper()
+		body, _ := json.Marshal(models.CreateTransferRequest{ToUserID: to, Amount: amount})
+		req := httptest.NewRequest("POST", "/api/transfers/dry-run", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := app.Test(asUser(t, req, alice))
+		if resp.StatusCode != 200 {
+			t.Fatalf("Dry run = %d, want 200", resp.StatusCode)
+		}
+		var result models.TransferDryRunResponse
+		json.NewDecoder(resp.Body).Decode(&result)
+		return result
+	}
+
+	result := dryRun(bob, 200)
+	failed := map[string]string{}
+	for _, r := range result.Rules {
+		if !r.Passed {
+			failed[r.Rule] = r.Code
+		}
+	}
+	want := map[string]string{"same_recipient": "same_recipient", "office-hours": "outside_transfer_window"}
+	if result.Allowed || len(result.Rules) != 5 || len(failed) != len(want) || failed["same_recipient"] != want["same_recipient"] || failed["office-hours"] != want["office-hours"] {
+		t.Errorf("Dry run = %+v, want %v to fail", result, want)
+	}
+
+	var balance int64
+	db.QueryRow("SELECT points_balance FROM users WHERE id = ?", alice).Scan(&balance)
+	if balance != 9600 {
+		t.Errorf("Balance after dry runs = %d, want 9600", balance)
+	}
+
+	transferService := services.NewTransferService(store)
+	if err := transferService.SetTransferRules([]models.TransferRule{{Type: "max_amount"}}); err == nil {
+		t.Error("A max_amount rule without an amount was accepted")
+	}
+	if err := transferService.SetTransferRules([]models.TransferRule{{Type: "sunday_only"}}); err == nil {
+		t.Error("A rule of unknown type was accepted")
+	}
+}
+
+// Test Case 20: Per-user limits reject transfers over the rolling day and report usage
+func TestTransferLimits(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	admin := createTestAdmin(t, db)
+	alice := createTestUserWithBalance(t, db, "Ali", "Ce", 10000)
+	bob := createTestUserWithBalance(t, db, "Bob", "B", 0)
+	carol := createTestUserWithBalance(t, db, "Car", "Ol", 0)
+
+	setLimits := func(caller int64, body string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest("PUT", fmt.Sprintf("/api/users/%d/limits", alice), strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := app.Test(asUser(t, req, caller))
+		return resp
+	}
+	if resp := setLimits(alice, `{"dailyAmount": 1000000}`); resp.StatusCode != 403 {
+		t.Errorf("User raising their own limits = %d, want 403", resp.StatusCode)
+	}
+	if resp := setLimits(admin, `{"tier": "platinum"}`); resp.StatusCode != 400 {
+		t.Errorf("Unknown tier = %d, want 400", resp.StatusCode)
+	}
+	if resp := setLimits(admin, `{"dailyAmount": -1}`); resp.StatusCode != 400 {
+		t.Errorf("Negative limit = %d, want 400", resp.StatusCode)
+	}
+	if resp := setLimits(admin, `{"dailyAmount": 500, "dailyCount": 2}`); resp.StatusCode != 200 {
+		t.Fatalf("Set limits = %d, want 200", resp.StatusCode)
+	}
+
+	rejected := func(resp *http.Response, rule string) {
+		t.Helper()
+		var p handlers.Problem
+		json.NewDecoder(resp.Body).Decode(&p)
+		if resp.StatusCode != 422 || p.Code != "transfer_limit_exceeded" || p.Rule != rule {
+			t.Errorf("Got %d %s by %q, want 422 transfer_limit_exceeded by %q", resp.StatusCode, p.Code, p.Rule, rule)
+		}
+	}
+
+	if resp := postTransfer(t, app, alice, bob, 300); resp.StatusCode != 201 {
+		t.Fatalf("Transfer within the limits = %d, want 201", resp.StatusCode)
+	}
+	rejected(postTransfer(t, app, alice, carol, 300), "daily_amount")
+	if resp := postTransfer(t, app, alice, carol, 200); resp.StatusCode != 201 {
+		t.Fatalf("Transfer up to the limit = %d, want 201", resp.StatusCode)
+	}
+	rejected(postTransfer(t, app, alice, bob, 1), "daily_amount")
+	if resp := setLimits(admin, `{"dailyCount": 2}`); resp.StatusCode != 200 {
+		t.Fatalf("Set limits = %d, want 200", resp.StatusCode)
+	}
+	rejected(postTransfer(t, app, alice, bob, 1), "daily_count")
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/users/%d/limits", alice), nil)
+	if resp, _ := app.Test(asUser(t, req, bob)); resp.StatusCode != 403 {
+		t.Errorf("Reading another user's limits = %d, want 403", resp.StatusCode)
+	}
+	req = httptest.NewRequest("GET", fmt.Sprintf("/api/users/%d/limits", alice), nil)
+	resp, _ := app.Test(asUser(t, req, alice))
+	var limits models.UserLimitsResponse
+	json.NewDecoder(resp.Body).Decode(&limits)
+	daily := limits.Daily
+	if resp.StatusCode != 200 || limits.Tier != services.DefaultTier || daily.Amount.Used != 500 || daily.Amount.Limit != nil ||
+		daily.Count.Used != 2 || daily.Count.Limit == nil || *daily.Count.Remaining != 0 || limits.Monthly.Count.Used != 2 {
+		t.Errorf("Limits = %d %+v, want 500 sent in 2 of 2 transfers today", resp.StatusCode, limits)
+	}
+}
+
+// Test Case 21: PATCH merges and clears fields, PUT replaces the profile and If-Match prevents lost updates
+func TestUserPatchAndReplace(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	admin := createTestAdmin(t, db)
+	req := httptest.NewRequest("POST", "/api/users", strings.NewReader(`{"first_name":"Tom","last_name":"Li","bio":"hello","phone":"0812345678"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := app.Test(asUser(t, req, admin))
+	var user models.User
+	json.NewDecoder(resp.Body).Decode(&user)
+	id := user.ID
+
+	var p handlers.Problem
+	send := func(method, contentType, ifMatch, body string) (*http.Response, models.User) {
+		t.Helper()
+		req := httptest.NewRequest(method, fmt.Sprintf("/api/users/%d", id), strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp, _ := app.Test(asUser(t, req, id))
+		raw, _ := io.ReadAll(resp.Body)
+		var u models.User
+		json.Unmarshal(raw, &u)
+		json.Unmarshal(raw, &p)
+		return resp, u
+	}
+
+	resp, _ = send("GET", "", "", "")
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("GET /api/users/:id has no ETag")
+	}
+
+	resp, u := send("PATCH", "application/merge-patch+json", etag, `{"bio":null,"email":"tom@example.com"}`)
+	if resp.StatusCode != 200 || u.Bio != "" || u.Email != "tom@example.com" || u.Phone != "0812345678" || u.FirstName != "Tom" {
+		t.Errorf("Merge patch = %d %+v, want bio cleared, email set and the rest kept", resp.StatusCode, u)
+	}
+	if resp.Header.Get("ETag") == etag || resp.Header.Get("ETag") == "" {
+		t.Errorf("ETag after a change = %q, want a new one", resp.Header.Get("ETag"))
+	}
+
+	resp, _ = send("PATCH", "application/merge-patch+json", etag, `{"bio":"stale"}`)
+	if resp.StatusCode != 412 || p.Code != "precondition_failed" {
+		t.Errorf("Patch with a stale ETag = %d %s, want 412 precondition_failed", resp.StatusCode, p.Code)
+	}
+
+	for _, tc := range []struct {
+		method, contentType, body string
+		want                      int
+	}{
+		{"PATCH", "application/merge-patch+json", `{"first_name":null}`, 400},
+		{"PATCH", "application/merge-patch+json", `{"points_balance":1000000}`, 400},
+		{"PATCH", "application/merge-patch+json", `[]`, 400},
+		{"PATCH", "text/plain", `{"bio":"hi"}`, 415},
+		{"PUT", "application/json", `{"bio":"no names"}`, 400},
+	} {
+		if resp, _ := send(tc.method, tc.contentType, "", tc.body); resp.StatusCode != tc.want {
+			t.Errorf("%s %s = %d, want %d", tc.method, tc.body, resp.StatusCode, tc.want)
+		}
+	}
+
+	resp, u = send("PUT", "application/json", "*", `{"first_name":"Tim","last_name":"Li"}`)
+	if resp.StatusCode != 200 || u.FirstName != "Tim" || u.Email != "" || u.Phone != "" {
+		t.Errorf("Replace = %d %+v, want omitted fields cleared", resp.StatusCode, u)
+	}
+	var phone string
+	db.QueryRow("SELECT phone FROM users WHERE id = ?", id).Scan(&phone)
+	if phone != "" {
+		t.Errorf("Stored phone after replace = %q, want empty", phone)
+	}
+}
+
+// Test Case 22: Closing an account sweeps its balance, keeps its history and blocks it until reopened
+func TestAccountClosure(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	admin := createTestAdmin(t, db)
+	alice := createTestUserWithBalance(t, db, "Ali", "Ce", 300)
+	bob := createTestUserWithBalance(t, db, "Bob", "B", 0)
+	if resp := postTransfer(t, app, alice, bob, 100); resp.StatusCode != 201 {
+		t.Fatalf("Transfer before closing = %d, want 201", resp.StatusCode)
+	}
+
+	call := func(method, path string, caller int64) (*http.Response, handlers.Problem) {
+		t.Helper()
+		resp, _ := app.Test(asUser(t, httptest.NewRequest(method, "/api"+path, nil), caller))
+		var p handlers.Problem
+		json.NewDecoder(resp.Body).Decode(&p)
+		return resp, p
+	}
+
+	if resp, p := call("DELETE", fmt.Sprintf("/users/%d", alice), admin); resp.StatusCode != 409 || p.Code != "balance_remaining" {
+		t.Errorf("Closing with a balance = %d %s, want 409 balance_remaining", resp.StatusCode, p.Code)
+	}
+	if resp, _ := call("DELETE", fmt.Sprintf("/users/%d?sweep_to=%d", alice, alice), admin); resp.StatusCode != 400 {
+		t.Errorf("Sweeping to the closed account itself = %d, want 400", resp.StatusCode)
+	}
+	if resp, _ := call("DELETE", fmt.Sprintf("/users/%d?sweep_to=%d", alice, bob), admin); resp.StatusCode != 204 {
+		t.Fatalf("Closing with a sweep = %d, want 204", resp.StatusCode)
+	}
+
+	var aliceBalance, bobBalance, entries int64
+	var status string
+	db.QueryRow("SELECT points_balance, status FROM users WHERE id = ?", alice).Scan(&aliceBalance, &status)
+	db.QueryRow("SELECT points_balance FROM users WHERE id = ?", bob).Scan(&bobBalance)
+	db.QueryRow("SELECT COUNT(*) FROM point_ledger WHERE user_id = ?", alice).Scan(&entries)
+	if aliceBalance != 0 || bobBalance != 300 || status != "closed" || entries != 2 {
+		t.Errorf("After closing: alice %d %s with %d ledger entries, bob %d; want 0 closed with 2, bob 300", aliceBalance, status, entries, bobBalance)
+	}
+
+	resp, _ := app.Test(asUser(t, httptest.NewRequest("GET", "/api/users", nil), admin))
+	var users models.UserListResponse
+	json.NewDecoder(resp.Body).Decode(&users)
+	for _, u := range users.Data {
+		if u.ID == alice {
+			t.Error("A closed account is listed")
+		}
+	}
+
+	var p handlers.Problem
+	json.NewDecoder(postTransfer(t, app, bob, alice, 50).Body).Decode(&p)
+	if p.Status != 409 || p.Code != "account_closed" {
+		t.Errorf("Transfer to a closed account = %d %s, want 409 account_closed", p.Status, p.Code)
+	}
+	if resp, _ := call("GET", fmt.Sprintf("/users/%d", alice), alice); resp.StatusCode != 401 {
+		t.Errorf("Token of a closed account = %d, want 401", resp.StatusCode)
+	}
+
+	if resp, _ := call("POST", fmt.Sprintf("/users/%d/reopen", alice), admin); resp.StatusCode != 200 {
+		t.Fatalf("Reopen = %d, want 200", resp.StatusCode)
+	}
+	if resp := postTransfer(t, app, bob, alice, 50); resp.StatusCode != 201 {
+		t.Errorf("Transfer to a reopened account = %d, want 201", resp.StatusCode)
+	}
+}
+
+// Test Case 23: Users can be searched, filtered, sorted and paged
+func TestUserSearch(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	admin := createTestAdmin(t, db)
+	ann := createTestUserWithBalance(t, db, "Ann", "Lee", 500)
+	ben := createTestUserWithBalance(t, db, "Ben", "Lee", 50)
+	createTestUserWithBalance(t, db, "Cat", "Kim", 900)
+	db.Exec("UPDATE users SET email = 'ann@example.com' WHERE id = ?", ann)
+	db.Exec("UPDATE users SET status = 'closed' WHERE id = ?", ben)
+
+	list := func(query string) (*http.Response, models.UserListResponse) {
+		t.Helper()
+		resp, _ := app.Test(asUser(t, httptest.NewRequest("GET", "/api/users?"+query, nil), admin))
+		var result models.UserListResponse
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp, result
+	}
+	names := func(result models.UserListResponse) string {
+		var names []string
+		for _, u := range result.Data {
+			names = append(names, u.FirstName)
+		}
+		return strings.Join(names, ",")
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  string
+		total int
+	}{
+		{"q=lee", "Ann", 1},
+		{"q=EXAMPLE.com", "Ann", 1},
+		{"q=lee&status=all&sort=-first_name", "Ben,Ann", 2},
+		{"q=%25", "", 0},
+		{"min_balance=100&max_balance=900&sort=-points_balance", "Cat,Ann", 2},
+		{"status=closed", "Ben", 1},
+		{"sort=points_balance&pageSize=1&page=2", "Ann", 3},
+	} {
+		resp, result := list(tc.query)
+		if resp.StatusCode != 200 || names(result) != tc.want || result.Total != tc.total {
+			t.Errorf("GET /api/users?%s = %d %q of %d, want %q of %d", tc.query, resp.StatusCode, names(result), result.Total, tc.want, tc.total)
+		}
+	}
+
+	for _, query := range []string{"sort=password", "status=deleted", "min_balance=10&max_balance=1", "min_balance=lots"} {
+		if resp, _ := list(query); resp.StatusCode != 400 {
+			t.Errorf("GET /api/users?%s = %d, want 400", query, resp.StatusCode)
+		}
+	}
+
+	// Cursors page through the (sort key, id) order and new users do not
+	// shift the pages that follow
+	_, first := list("status=all&sort=-last_name&pageSize=2")
+	if names(first) != "Ben,Ann" || first.Page != 1 || first.NextCursor == "" {
+		t.Fatalf("First page = %q page %d cursor %q, want Ben,Ann and a cursor", names(first), first.Page, first.NextCursor)
+	}
+	createTestUserWithBalance(t, db, "Dee", "Lee", 0)
+	resp, second := list("status=all&sort=-last_name&pageSize=2&cursor=" + first.NextCursor)
+	if resp.StatusCode != 200 || names(second) != "Cat,Adm" || second.Page != 0 || second.NextCursor != "" || second.Total != 5 {
+		t.Errorf("Second page = %d %+v, want Cat,Adm of 5 without a page or cursor", resp.StatusCode, second)
+	}
+	seen := map[int64]bool{}
+	for query := "status=all&sort=created_at&pageSize=1"; ; {
+		_, page := list(query)
+		for _, u := range page.Data {
+			seen[u.ID] = true
+		}
+		if page.NextCursor == "" || len(seen) > 5 {
+			break
+		}
+		query = "status=all&sort=created_at&pageSize=1&cursor=" + page.NextCursor
+	}
+	if len(seen) != 5 {
+		t.Errorf("Paging by created_at saw %d users, want 5", len(seen))
+	}
+	for _, query := range []string{"sort=last_name&cursor=" + first.NextCursor, "cursor=not-a-cursor"} {
+		if resp, _ := list(query); resp.StatusCode != 400 {
+			t.Errorf("GET /api/users?%s = %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
+
+// Test Case 24: Transfers can be filtered and paged with a cursor that new transfers do not shift
+func TestTransferListFilters(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	admin := createTestAdmin(t, db)
+	ann := createTestUserWithBalance(t, db, "Ann", "Lee", 1000)
+	ben := createTestUserWithBalance(t, db, "Ben", "Lee", 100)
+	cat := createTestUserWithBalance(t, db, "Cat", "Kim", 0)
+	for _, tr := range []struct{ from, to, amount int64 }{{ann, ben, 100}, {ann, cat, 200}, {ben, ann, 50}, {ann, ben, 300}} {
+		if resp := postTransfer(t, app, tr.from, tr.to, tr.amount); resp.StatusCode != 201 {
+			t.Fatalf("POST /api/transfers = %d, want 201", resp.StatusCode)
+		}
+	}
+	db.Exec("UPDATE transfers SET note = 'Lunch money' WHERE amount = 200")
+
+	list := func(query string, as int64) (*http.Response, models.TransferListResponse) {
+		t.Helper()
+		resp, _ := app.Test(asUser(t, httptest.NewRequest("GET", "/api/transfers?"+query, nil), as))
+		var result models.TransferListResponse
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp, result
+	}
+	amounts := func(result models.TransferListResponse) string {
+		var amounts []string
+		for _, tr := range result.Data {
+			amounts = append(amounts, fmt.Sprint(tr.Amount))
+		}
+		return strings.Join(amounts, ",")
+	}
+
+	userID := fmt.Sprintf("userId=%d&", ann)
+	for _, tc := range []struct {
+		query string
+		as    int64
+		want  string
+	}{
+		{userID, ann, "300,50,200,100"},
+		{userID + "direction=sent", ann, "300,200,100"},
+		{userID + "direction=received", ann, "50"},
+		{userID + fmt.Sprintf("counterparty=%d", ben), ann, "300,50,100"},
+		{userID + "min_amount=150&max_amount=250", ann, "200"},
+		{userID + "note=LUNCH", ann, "200"},
+		{userID + "status=pending,failed", ann, ""},
+		{"", cat, "200"},
+		{"", admin, "300,50,200,100"},
+	} {
+		resp, result := list(tc.query, tc.as)
+		if resp.StatusCode != 200 || amounts(result) != tc.want {
+			t.Errorf("GET /api/transfers?%s as %d = %d %q, want %q", tc.query, tc.as, resp.StatusCode, amounts(result), tc.want)
+		}
+	}
+
+	_, first := list(userID+"pageSize=2", ann)
+	if amounts(first) != "300,50" || first.NextCursor == "" || first.Total != 4 {
+		t.Fatalf("first page = %q of %d, cursor %q", amounts(first), first.Total, first.NextCursor)
+	}
+	postTransfer(t, app, ann, cat, 10)
+	_, second := list(userID+"pageSize=2&cursor="+first.NextCursor, ann)
+	if amounts(second) != "200,100" || second.NextCursor != "" || second.Page != 0 {
+		t.Errorf("second page = %q page %d, cursor %q, want 200,100 without a next cursor", amounts(second), second.Page, second.NextCursor)
+	}
+	if _, paged := list(userID+"pageSize=2&page=2", ann); amounts(paged) != "50,200" || paged.Page != 2 || paged.NextCursor == "" {
+		t.Errorf("page 2 = %q page %d, cursor %q, want 50,200 and a cursor", amounts(paged), paged.Page, paged.NextCursor)
+	}
+
+	for _, query := range []string{"cursor=bogus", "status=lost", "direction=sent", "min_amount=5&max_amount=1", "from=2026-02-01&to=2026-01-01"} {
+		if resp, _ := list(query, admin); resp.StatusCode != 400 {
+			t.Errorf("GET /api/transfers?%s = %d, want 400", query, resp.StatusCode)
+		}
+	}
+	if resp, _ := list(userID, cat); resp.StatusCode != 403 {
+		t.Errorf("GET /api/transfers?%s as another user = %d, want 403", userID, resp.StatusCode)
+	}
+}
+
+// Test Case 25: Statements list the entries of a period between its opening and closing balances
+func TestAccountStatement(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	ann := createTestUserWithBalance(t, db, "Ann", "Lee", 1000)
+	ben := createTestUserWithBalance(t, db, "Ben", "Lee", 100)
+	postTransfer(t, app, ann, ben, 100)
+	postTransfer(t, app, ben, ann, 30)
+	db.Exec("UPDATE transfers SET note = '<b>Lunch</b>, thanks' WHERE amount = 100")
+
+	statement := func(query string, as int64) (*http.Response, string) {
+		t.Helper()
+		req := asUser(t, httptest.NewRequest("GET", fmt.Sprintf("/api/users/%d/statement?%s", ann, query), nil), as)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := statement("from=2000-01-01", ann)
+	rows, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if resp.StatusCode != 200 || err != nil || len(rows) != 5 {
+		t.Fatalf("CSV statement = %d %q (%v), want a header and 4 rows", resp.StatusCode, body, err)
+	}
+	if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/csv") {
+		t.Errorf("Content-Type = %q, want text/csv", got)
+	}
+	for i, want := range [][]string{
+		{"opening_balance", "", "1000"},
+		{"transfer_out", "Ben Lee", "900"},
+		{"transfer_in", "Ben Lee", "930"},
+		{"closing_balance", "", "930"},
+	} {
+		row := rows[i+1]
+		if row[1] != want[0] || row[4] != want[1] || row[8] != want[2] {
+			t.Errorf("CSV row %d = %v, want type %s, counterparty %q and balance %s", i+1, row, want[0], want[1], want[2])
+		}
+	}
+	if rows[2][5] != "<b>Lunch</b>, thanks" {
+		t.Errorf("CSV note = %q", rows[2][5])
+	}
+
+	_, body = statement("from=2000-01-01&format=jsonl", ann)
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	var first, last struct {
+		Record  string
+		Balance int64
+	}
+	if len(lines) != 4 || json.Unmarshal([]byte(lines[0]), &first) != nil || json.Unmarshal([]byte(lines[3]), &last) != nil {
+		t.Fatalf("JSON Lines statement = %q, want 4 lines", body)
+	}
+	if first.Record != "opening_balance" || first.Balance != 1000 || last.Record != "closing_balance" || last.Balance != 930 {
+		t.Errorf("JSON Lines balances = %+v, %+v, want 1000 and 930", first, last)
+	}
+
+	_, body = statement("from=2000-01-01&format=html", ann)
+	if !strings.Contains(body, "&lt;b&gt;Lunch&lt;/b&gt;") || !strings.Contains(body, "Closing balance") {
+		t.Errorf("HTML statement does not escape the note or lacks the closing balance:\n%s", body)
+	}
+
+	// A period before any transfer has the balance from before them
+	if _, body = statement("from=2000-01-01&to=2000-01-31&format=jsonl", ann); strings.Count(body, `"balance":1000`) != 2 {
+		t.Errorf("empty period statement = %q, want opening and closing balances of 1000", body)
+	}
+
+	// Long statements are read a page at a time and stay complete
+	for i := int64(1); i <= 1200; i++ {
+		db.Exec("INSERT INTO point_ledger (user_id, change, balance_after, event_type, reference, created_at) VALUES (?, 1, ?, 'earn', 'bulk', ?)",
+			ben, 170+i, models.Now())
+	}
+	db.Exec("UPDATE users SET points_balance = points_balance + 1200 WHERE id = ?", ben)
+	req := asUser(t, httptest.NewRequest("GET", fmt.Sprintf("/api/users/%d/statement?from=2000-01-01&format=jsonl", ben), nil), ben)
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	longBody, _ := io.ReadAll(resp.Body)
+	lines = strings.Split(strings.TrimSpace(string(longBody)), "\n")
+	if len(lines) != 1204 || json.Unmarshal([]byte(lines[1203]), &last) != nil || last.Balance != 1370 {
+		t.Errorf("Long statement has %d lines ending in %+v, want 1204 lines and a closing balance of 1370", len(lines), last)
+	}
+
+	for _, query := range []string{"format=pdf", "from=2000-02-01&to=2000-01-01", "from=yesterday"} {
+		if resp, _ := statement(query, ann); resp.StatusCode != 400 {
+			t.Errorf("GET statement?%s = %d, want 400", query, resp.StatusCode)
+		}
+	}
+	if resp, _ := statement("", ben); resp.StatusCode != 403 {
+		t.Errorf("GET statement of another user = %d, want 403", resp.StatusCode)
+	}
+}
+
+// Test Case 26: CSV imports check every row, support dry runs and credit initial balances
+func TestUserImport(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	admin := createTestAdmin(t, db)
+	importCSV := func(query, body string, as int64) (*http.Response, models.UserImportResponse) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/admin/users/import"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/csv")
+		resp, err := app.Test(asUser(t, req, as))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var report models.UserImportResponse
+		json.NewDecoder(resp.Body).Decode(&report)
+		return resp, report
+	}
+	countUsers := func() (n int) {
+		db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n)
+		return n
+	}
+
+	mixed := "first_name,last_name,email,initial_balance\nAnn,Lee,ann@example.com,500\nBen,Kim,not-an-email,10\nCat,Oh,,lots\n"
+	resp, report := importCSV("?dryRun=true", mixed, admin)
+	if resp.StatusCode != 200 || report.Total != 3 || report.Failed != 2 || report.Created != 0 || countUsers() != 1 {
+		t.Fatalf("dry run = %d %+v with %d users, want 2 of 3 rows failed and nothing created", resp.StatusCode, report, countUsers())
+	}
+	if r := report.Rows[0]; r.Row != 2 || r.Status != models.ImportRowValid {
+		t.Errorf("row 2 = %+v, want valid", r)
+	}
+	if r := report.Rows[1]; r.Row != 3 || len(r.Errors) != 1 || r.Errors[0].Field != "email" {
+		t.Errorf("row 3 = %+v, want an email error", r)
+	}
+	if r := report.Rows[2]; len(r.Errors) != 1 || r.Errors[0].Code != "integer" {
+		t.Errorf("row 4 = %+v, want an integer error for initial_balance", r)
+	}
+
+	// By default one invalid row rejects the whole file
+	if _, report = importCSV("", mixed, admin); report.Rows[0].Status != models.ImportRowSkipped || countUsers() != 1 {
+		t.Errorf("import with invalid rows = %+v, want the valid row skipped and nothing created", report)
+	}
+
+	_, report = importCSV("", "last_name,first_name,initial_balance\nLee,Ann,500\nKim,Ben,\n", admin)
+	if report.Created != 2 || report.Rows[0].UserID == 0 {
+		t.Fatalf("import = %+v, want 2 users created", report)
+	}
+	var balance, credited int64
+	var reference string
+	db.QueryRow("SELECT points_balance FROM users WHERE id = ?", report.Rows[0].UserID).Scan(&balance)
+	db.QueryRow("SELECT change, reference FROM point_ledger WHERE user_id = ? AND event_type = 'earn'", report.Rows[0].UserID).Scan(&credited, &reference)
+	if balance != 500 || credited != 500 || reference != "import" {
+		t.Errorf("imported balance = %d, earn entry %d %q, want 500 credited by an import entry", balance, credited, reference)
+	}
+
+	// Committing row by row creates the valid rows of a file
+	userService := services.NewUserService(repositories.NewStore(db.DB, db.dialect))
+	userService.SetImport(models.ImportCommitRow, 10)
+	rows, err := userService.Import(strings.NewReader(mixed), false)
+	if err != nil || rows[0].User == nil || rows[1].User != nil || rows[2].Err == nil {
+		t.Errorf("row by row import = %+v, %v, want only the first row created", rows, err)
+	}
+
+	// A row that cannot be written is failed and the rows after it still created
+	if _, err := db.Exec("CREATE UNIQUE INDEX idx_test_users_email ON users(email) WHERE email = 'dan@example.com'"); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DROP INDEX idx_test_users_email")
+	before := countUsers()
+	rows, err = userService.Import(strings.NewReader("first_name,last_name,email\nDan,Lee,dan@example.com\nDan,Kim,dan@example.com\nEve,Oh,\n"), false)
+	if err != nil || rows[0].User == nil || rows[1].Failed == nil || rows[1].User != nil || rows[2].User == nil || countUsers() != before+2 {
+		t.Errorf("row by row import with a failing row = %+v, %v with %d new users, want the second row failed and 2 created", rows, err, countUsers()-before)
+	}
+
+	for _, body := range []string{"", "first_name\nAnn\n", "first_name,last_name,age\nAnn,Lee,30\n", "first_name,last_name\nAnn\n"} {
+		if resp, _ := importCSV("", body, admin); resp.StatusCode != 400 {
+			t.Errorf("import of %q = %d, want 400", body, resp.StatusCode)
+		}
+	}
+	user := createTestUserWithBalance(t, db, "Dee", "Ng", 0)
+	if resp, _ := importCSV("", "first_name,last_name\nAnn,Lee\n", user); resp.StatusCode != 403 {
+		t.Errorf("import by a user = %d, want 403", resp.StatusCode)
+	}
+}
+
+// Test Case 27: Batch transfers are made together or not at all and share a batch ID
+func TestBatchTransfers(t *testing.T) {
+	app, db := setupTestApp(t)
+	defer db.Close()
+
+	lead := createTestUserWithBalance(t, db, "Ann", "Lee", 500)
+	ben := createTestUserWithBalance(t, db, "Ben", "Lee", 0)
+	cat := createTestUserWithBalance(t, db, "Cat", "Kim", 0)
+
+	postBatch := func(items []models.BatchTransferItem, idemKey string) (*http.Response, []byte) {
+		t.Helper()
+		body, _ := json.Marshal(models.CreateBatchTransferRequest{Transfers: items})
+		req := httptest.NewRequest("POST", "/api/transfers/batch", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if idemKey != "" {
+			req.Header.Set("Idempotency-Key", idemKey)
+		}
+		resp, err := app.Test(asUser(t, req, lead))
+		if err != nil {
+			t.Fatal(err)
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		return resp, respBody
+	}
+	balances := func() (total int64) {
+		db.QueryRow("SELECT SUM(points_balance) FROM users WHERE id IN (?, ?)", ben, cat).Scan(&total)
+		return total
+	}
+
+	// The total is over the balance, so no transfer is made
+	resp, body := postBatch([]models.BatchTransferItem{{ToUserID: ben, Amount: 300}, {ToUserID: cat, Amount: 300}}, "")
+	if resp.StatusCode != 409 || balances() != 0 {
+		t.Fatalf("overdrawing batch = %d %s with %d moved, want 409 and nothing moved", resp.StatusCode, body, balances())
+	}
+
+	// A closed recipient rolls back the transfers to the others
+	db.Exec("UPDATE users SET status = 'closed' WHERE id = ?", cat)
+	if resp, _ = postBatch([]models.BatchTransferItem{{ToUserID: ben, Amount: 100}, {ToUserID: cat, Amount: 100}}, ""); resp.StatusCode != 409 || balances() != 0 {
+		t.Fatalf("batch to a closed account = %d with %d moved, want 409 and nothing moved", resp.StatusCode, balances())
+	}
+	db.Exec("UPDATE users SET status = 'active' WHERE id = ?", cat)
+
+	var problem handlers.Problem
+	resp, body = postBatch([]models.BatchTransferItem{{ToUserID: ben, Amount: 0}, {ToUserID: lead, Amount: 5}}, "")
+	json.Unmarshal(body, &problem)
+	if resp.StatusCode != 400 || len(problem.FieldErrors) != 2 || problem.FieldErrors[1].Field != "transfers[1].toUserId" {
+		t.Errorf("invalid batch = %d %+v, want a field error per item", resp.StatusCode, problem.FieldErrors)
+	}
+
+	items := []models.BatchTransferItem{{ToUserID: ben, Amount: 100, Note: "Q3"}, {ToUserID: cat, Amount: 150}}
+	resp, body = postBatch(items, "team-reward-q3")
+	var batch models.BatchTransferResponse
+	json.Unmarshal(body, &batch)
+	if resp.StatusCode != 201 || batch.BatchID == "" || batch.Total != 250 || len(batch.Transfers) != 2 || balances() != 250 {
+		t.Fatalf("batch = %d %s, want 2 transfers of 250 in total", resp.StatusCode, body)
+	}
+	if tr := batch.Transfers[0]; tr.BatchID != batch.BatchID || tr.ToUserID != ben || tr.Status != models.TransferCompleted {
+		t.Errorf("first transfer = %+v, want a completed transfer to %d in the batch", tr, ben)
+	}
+
+	// Retrying with the key replays the batch instead of paying twice
+	resp, body = postBatch(items, "team-reward-q3")
+	var replay models.BatchTransferResponse
+	json.Unmarshal(body, &replay)
+	if resp.Header.Get("Idempotent-Replayed") != "true" || replay.BatchID != batch.BatchID || balances() != 250 {
+		t.Errorf("replayed batch = %s, replayed %q with %d moved, want the first batch", body, resp.Header.Get("Idempotent-Replayed"), balances())
+	}
+
+	// The key of the batch does not reach into the keys of single transfers
+	jsonBody, _ := json.Marshal(models.CreateTransferRequest{ToUserID: ben, Amount: 10})
+	req := httptest.NewRequest("POST", "/api/transfers", bytes.NewReader(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "team-reward-q3:0")
+	if resp, _ := app.Test(asUser(t, req, lead)); resp.StatusCode != 201 || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("single transfer with key team-reward-q3:0 = %d replayed=%q, want a new transfer", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+	}
+
+	resp, _ = app.Test(asUser(t, httptest.NewRequest("GET", "/api/transfers?batchId="+batch.BatchID, nil), lead))
+	var list models.TransferListResponse
+	json.NewDecoder(resp.Body).Decode(&list)
+	if list.Total != 2 {
+		t.Errorf("GET /api/transfers?batchId= = %d transfers, want 2", list.Total)
+	}
+}
+
+// Test Case 28: SQLite DSNs with options of their own still get the connection options
+func TestInitDBSQLiteOptions(t *testing.T) {
+	db, _, err := InitDB("file:" + t.TempDir() + "/points.db?cache=shared")
+	if err != nil {
+		t.Fatalf("InitDB with a query: %v", err)
+	}
+	defer db.Close()
+
+	var foreignKeys int
+	if err := db.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys); err != nil || foreignKeys != 1 {
+		t.Errorf("foreign_keys = %d, %v, want 1", foreignKeys, err)
+	}
+}
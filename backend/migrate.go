@@ -0,0 +1,79 @@
+package main
+
+import (
+	"backend/config"
+	"backend/migrations"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+const migrateUsage = "usage: backend [flags] migrate status|up|down [steps]"
+
+// runMigrate implements the migrate subcommand:
+//
+//	migrate status       list migrations and whether they are applied
+//	migrate up           apply every pending migration
+//	migrate down [n]     roll back the latest n migrations (default 1)
+func runMigrate(cfg *config.Config, args []string) {
+	if len(args) == 0 {
+		log.Fatal(migrateUsage)
+	}
+
+	db, dialect, err := InitDB(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatal("Failed to initialize database:", err)
+	}
+	defer db.Close()
+
+	migrator, err := migrations.New(db, dialect)
+	if err != nil {
+		log.Fatal("Failed to load migrations:", err)
+	}
+
+	switch args[0] {
+	case "status":
+		status, err := migrator.Status()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, applied)
+		}
+
+	case "up":
+		done, err := migrator.Up()
+		for _, m := range done {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(done) == 0 {
+			fmt.Println("no pending migrations")
+		}
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatal(migrateUsage)
+			}
+		}
+		done, err := migrator.Down(steps)
+		for _, m := range done {
+			fmt.Printf("rolled back %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	default:
+		log.Fatal(migrateUsage)
+	}
+}
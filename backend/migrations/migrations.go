@@ -0,0 +1,314 @@
+// Package migrations applies the numbered SQL migrations embedded from the
+// sqlite and postgres directories and records them in schema_migrations.
+//
+// Files are named NNNN_name.up.sql and NNNN_name.down.sql. Every migration
+// runs in its own transaction together with its schema_migrations row.
+package migrations
+
+import (
+	"backend/repositories"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed sqlite/*.sql postgres/*.sql
+var files embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is a migration together with when it was applied; AppliedAt is nil
+// for pending migrations.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// legacyMarkers identify, for databases created before schema_migrations
+// existed, a table or column introduced by each migration.
+var legacyMarkers = map[int]struct{ table, column string }{
+	1: {"users", ""},
+	2: {"transfers", "request_hash"},
+	3: {"users", "held_balance"},
+	4: {"transfer_status_history", ""},
+}
+
+type Migrator struct {
+	db         *sql.DB
+	dialect    repositories.Dialect
+	migrations []Migration
+}
+
+func New(db *sql.DB, dialect repositories.Dialect) (*Migrator, error) {
+	migrations, err := load(dialect.String())
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+func load(dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s: expected .up.sql or .down.sql", name)
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		number, label, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s: expected NNNN_name", name)
+		}
+
+		body, err := fs.ReadFile(files, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s: both up and down files are required", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be contiguous: expected %04d, found %04d", i+1, m.Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Status lists every known migration in order and whether it is applied.
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]Status, len(m.migrations))
+	for i, migration := range m.migrations {
+		status[i] = Status{Migration: migration}
+		if at, ok := applied[migration.Version]; ok {
+			at := at
+			status[i].AppliedAt = &at
+		}
+	}
+	return status, nil
+}
+
+// Up applies every pending migration in order and returns the ones applied.
+func (m *Migrator) Up() ([]Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if err := m.apply(migration, migration.Up, true); err != nil {
+			return done, fmt.Errorf("migration %04d_%s up: %w", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Down rolls back the latest steps applied migrations, newest first, and
+// returns the ones rolled back.
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if err := m.apply(migration, migration.Down, false); err != nil {
+			return done, fmt.Errorf("migration %04d_%s down: %w", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+func (m *Migrator) apply(migration Migration, script string, up bool) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+
+	if up {
+		_, err = tx.Exec(m.dialect.Rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"),
+			migration.Version, migration.Name, time.Now().UTC())
+	} else {
+		_, err = tx.Exec(m.dialect.Rebind("DELETE FROM schema_migrations WHERE version = ?"), migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// applied returns the applied versions, creating schema_migrations first if
+// needed.
+func (m *Migrator) applied() (map[int]time.Time, error) {
+	exists, err := m.hasTable("schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := m.bootstrap(); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := m.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// bootstrap creates schema_migrations. A database that already has tables was
+// set up before migrations were versioned; the migrations whose changes are
+// already present are recorded as applied so they are not run again.
+func (m *Migrator) bootstrap() error {
+	timestamp := "DATETIME"
+	if m.dialect == repositories.Postgres {
+		timestamp = "TIMESTAMPTZ"
+	}
+
+	// Detect legacy changes before the transaction takes the connection
+	var legacy []Migration
+	for _, migration := range m.migrations {
+		marker, ok := legacyMarkers[migration.Version]
+		if !ok {
+			break
+		}
+
+		present, err := m.hasTable(marker.table)
+		if err == nil && present && marker.column != "" {
+			present, err = m.hasColumn(marker.table, marker.column)
+		}
+		if err != nil {
+			return err
+		}
+		if !present {
+			break
+		}
+		legacy = append(legacy, migration)
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`CREATE TABLE schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at ` + timestamp + ` NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, migration := range legacy {
+		_, err = tx.Exec(m.dialect.Rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"),
+			migration.Version, migration.Name, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m *Migrator) hasTable(table string) (bool, error) {
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	if m.dialect == repositories.Postgres {
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?"
+	}
+
+	var n int
+	err := m.db.QueryRow(m.dialect.Rebind(query), table).Scan(&n)
+	return n > 0, err
+}
+
+func (m *Migrator) hasColumn(table, column string) (bool, error) {
+	query := "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+	if m.dialect == repositories.Postgres {
+		query = "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?"
+	}
+
+	var n int
+	err := m.db.QueryRow(m.dialect.Rebind(query), table, column).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,45 @@
+CREATE TABLE users (
+	id BIGSERIAL PRIMARY KEY,
+	first_name TEXT NOT NULL,
+	last_name TEXT NOT NULL,
+	email TEXT,
+	phone TEXT,
+	avatar_url TEXT,
+	bio TEXT,
+	points_balance BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX idx_users_email ON users(email);
+
+CREATE TABLE transfers (
+	transfer_id BIGSERIAL PRIMARY KEY,
+	from_user_id BIGINT NOT NULL REFERENCES users(id),
+	to_user_id BIGINT NOT NULL REFERENCES users(id),
+	amount BIGINT NOT NULL CHECK (amount > 0),
+	status TEXT NOT NULL CHECK (status IN ('pending','processing','completed','failed','cancelled','reversed')),
+	note TEXT,
+	idempotency_key TEXT NOT NULL UNIQUE,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL,
+	completed_at TIMESTAMPTZ,
+	fail_reason TEXT
+);
+CREATE INDEX idx_transfers_from ON transfers(from_user_id);
+CREATE INDEX idx_transfers_to ON transfers(to_user_id);
+CREATE INDEX idx_transfers_created ON transfers(created_at);
+
+CREATE TABLE point_ledger (
+	id BIGSERIAL PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users(id),
+	change BIGINT NOT NULL,
+	balance_after BIGINT NOT NULL,
+	event_type TEXT NOT NULL CHECK (event_type IN ('transfer_out','transfer_in','adjust','earn','redeem')),
+	transfer_id BIGINT REFERENCES transfers(transfer_id),
+	reference TEXT,
+	metadata TEXT,
+	created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX idx_ledger_user ON point_ledger(user_id);
+CREATE INDEX idx_ledger_transfer ON point_ledger(transfer_id);
+CREATE INDEX idx_ledger_created ON point_ledger(created_at);
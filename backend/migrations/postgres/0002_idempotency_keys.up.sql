@@ -0,0 +1,4 @@
+ALTER TABLE transfers ADD COLUMN request_hash TEXT;
+ALTER TABLE point_ledger ADD COLUMN idempotency_key TEXT;
+ALTER TABLE point_ledger ADD COLUMN request_hash TEXT;
+CREATE UNIQUE INDEX idx_ledger_idem ON point_ledger(idempotency_key);
@@ -0,0 +1,3 @@
+DROP INDEX idx_transfers_pending_expiry;
+ALTER TABLE transfers DROP COLUMN expires_at;
+ALTER TABLE users DROP COLUMN held_balance;
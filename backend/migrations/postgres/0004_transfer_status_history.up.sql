@@ -0,0 +1,10 @@
+CREATE TABLE transfer_status_history (
+	id BIGSERIAL PRIMARY KEY,
+	transfer_id BIGINT NOT NULL REFERENCES transfers(transfer_id),
+	from_status TEXT,
+	to_status TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	reason TEXT,
+	created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX idx_transfer_history_transfer ON transfer_status_history(transfer_id);
@@ -0,0 +1,13 @@
+CREATE TABLE api_keys (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	prefix TEXT NOT NULL UNIQUE,
+	secret_hash TEXT NOT NULL,
+	owner_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	scopes TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	last_used_at TIMESTAMPTZ,
+	revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX idx_api_keys_owner ON api_keys(owner_id);
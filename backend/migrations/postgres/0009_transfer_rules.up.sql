@@ -0,0 +1,8 @@
+CREATE TABLE transfer_rules (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	type TEXT NOT NULL,
+	params TEXT NOT NULL DEFAULT '{}',
+	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	created_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,12 @@
+ALTER TABLE users ADD COLUMN tier TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE user_limits (
+	user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+	daily_amount BIGINT,
+	daily_count BIGINT,
+	monthly_amount BIGINT,
+	monthly_count BIGINT,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_transfers_from_created ON transfers(from_user_id, created_at);
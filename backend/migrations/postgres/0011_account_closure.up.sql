@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'closed'));
+ALTER TABLE users ADD COLUMN closed_at TIMESTAMPTZ;
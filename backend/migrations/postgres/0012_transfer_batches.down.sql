@@ -0,0 +1,2 @@
+DROP INDEX idx_transfers_batch;
+ALTER TABLE transfers DROP COLUMN batch_id;
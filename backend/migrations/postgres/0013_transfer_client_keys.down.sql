@@ -0,0 +1,2 @@
+DROP INDEX idx_transfers_client_key;
+ALTER TABLE transfers DROP COLUMN client_key;
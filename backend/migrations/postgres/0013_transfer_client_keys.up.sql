@@ -0,0 +1,5 @@
+ALTER TABLE transfers ADD COLUMN client_key TEXT;
+UPDATE transfers SET client_key = idempotency_key WHERE batch_id IS NULL;
+UPDATE transfers SET client_key = substr(idempotency_key, 1, length(idempotency_key) - 2)
+	WHERE batch_id IS NOT NULL AND idempotency_key LIKE '%:0';
+CREATE UNIQUE INDEX idx_transfers_client_key ON transfers(from_user_id, client_key);
@@ -0,0 +1,2 @@
+DROP INDEX idx_ledger_idem;
+CREATE UNIQUE INDEX idx_ledger_idem ON point_ledger(idempotency_key);
@@ -0,0 +1,3 @@
+DROP TABLE point_ledger;
+DROP TABLE transfers;
+DROP TABLE users;
@@ -0,0 +1,4 @@
+DROP INDEX idx_ledger_idem;
+ALTER TABLE point_ledger DROP COLUMN request_hash;
+ALTER TABLE point_ledger DROP COLUMN idempotency_key;
+ALTER TABLE transfers DROP COLUMN request_hash;
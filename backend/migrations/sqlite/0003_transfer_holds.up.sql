@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN held_balance INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE transfers ADD COLUMN expires_at DATETIME;
+CREATE INDEX idx_transfers_pending_expiry ON transfers(status, expires_at);
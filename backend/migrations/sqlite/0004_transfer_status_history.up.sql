@@ -0,0 +1,11 @@
+CREATE TABLE transfer_status_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	transfer_id INTEGER NOT NULL,
+	from_status TEXT,
+	to_status TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	reason TEXT,
+	created_at DATETIME NOT NULL,
+	FOREIGN KEY (transfer_id) REFERENCES transfers(transfer_id)
+);
+CREATE INDEX idx_transfer_history_transfer ON transfer_status_history(transfer_id);
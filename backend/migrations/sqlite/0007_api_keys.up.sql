@@ -0,0 +1,14 @@
+CREATE TABLE api_keys (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	prefix TEXT NOT NULL UNIQUE,
+	secret_hash TEXT NOT NULL,
+	owner_id INTEGER NOT NULL,
+	scopes TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	last_used_at DATETIME,
+	revoked_at DATETIME,
+	FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_api_keys_owner ON api_keys(owner_id);
@@ -0,0 +1,8 @@
+CREATE TABLE transfer_rules (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	type TEXT NOT NULL,
+	params TEXT NOT NULL DEFAULT '{}',
+	enabled BOOLEAN NOT NULL DEFAULT 1,
+	created_at DATETIME NOT NULL
+);
@@ -0,0 +1,3 @@
+DROP INDEX idx_transfers_from_created;
+DROP TABLE user_limits;
+ALTER TABLE users DROP COLUMN tier;
@@ -0,0 +1,13 @@
+ALTER TABLE users ADD COLUMN tier TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE user_limits (
+	user_id INTEGER PRIMARY KEY,
+	daily_amount INTEGER,
+	daily_count INTEGER,
+	monthly_amount INTEGER,
+	monthly_count INTEGER,
+	updated_at DATETIME NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_transfers_from_created ON transfers(from_user_id, created_at);
@@ -0,0 +1,2 @@
+ALTER TABLE transfers ADD COLUMN batch_id TEXT;
+CREATE INDEX idx_transfers_batch ON transfers(batch_id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_ledger_idem;
+CREATE UNIQUE INDEX idx_ledger_idem ON point_ledger(user_id, idempotency_key);
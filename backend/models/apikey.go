@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// APIKey lets a partner backend call the API as its owner without a user
+// session, limited to its scopes. Only a hash of the secret is stored.
+type APIKey struct {
+	ID         int64        `json:"id"`
+	Name       string       `json:"name"`
+	Prefix     string       `json:"prefix"`
+	SecretHash string       `json:"-"`
+	OwnerID    int64        `json:"ownerId"`
+	Scopes     []Permission `json:"scopes"`
+	CreatedAt  time.Time    `json:"createdAt"`
+	LastUsedAt *time.Time   `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time   `json:"revokedAt,omitempty"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name    string       `json:"name" validate:"required,max=100"`
+	OwnerID int64        `json:"ownerId"`
+	Scopes  []Permission `json:"scopes" validate:"required"`
+}
+
+// CreateAPIKeyResponse carries the raw key. It is only returned once, when
+// the key is created.
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
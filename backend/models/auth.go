@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+// Credential is the local login of a user. The password is only ever stored
+// as a bcrypt hash.
+type Credential struct {
+	UserID       int64
+	Username     string
+	PasswordHash string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+type RegisterRequest struct {
+	CreateUserRequest
+	Username string `json:"username" validate:"required,username"`
+	// bcrypt only uses the first 72 bytes of a password
+	Password string `json:"password" validate:"required,min=8,maxbytes=72"`
+}
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type TokenResponse struct {
+	AccessToken string `json:"accessToken"`
+	TokenType   string `json:"tokenType"`
+	ExpiresIn   int64  `json:"expiresIn"` // seconds
+}
+
+// Principal is the authenticated caller of a request. Callers using an API
+// key act as the owner of the key but only have the scopes of the key.
+type Principal struct {
+	UserID   int64
+	Role     Role
+	Locale   string
+	APIKeyID int64
+	Scopes   []Permission
+}
+
+// Can reports whether the caller has permission p.
+func (p *Principal) Can(perm Permission) bool {
+	if p.APIKeyID == 0 {
+		return p.Role.Can(perm)
+	}
+	for _, scope := range p.Scopes {
+		if scope == perm {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package models
+
+import "time"
+
+// TransferLimits caps what a user may send in a rolling day (the last 24
+// hours) and month (the last 30 days), by total amount and by number of
+// transfers. 0 means no cap.
+type TransferLimits struct {
+	DailyAmount   int64 `json:"dailyAmount"`
+	DailyCount    int64 `json:"dailyCount"`
+	MonthlyAmount int64 `json:"monthlyAmount"`
+	MonthlyCount  int64 `json:"monthlyCount"`
+}
+
+// LimitOverrides are the limits set for one user; nil fields fall back to
+// the limits of the user's tier.
+type LimitOverrides struct {
+	DailyAmount   *int64 `json:"dailyAmount,omitempty" validate:"min=0"`
+	DailyCount    *int64 `json:"dailyCount,omitempty" validate:"min=0"`
+	MonthlyAmount *int64 `json:"monthlyAmount,omitempty" validate:"min=0"`
+	MonthlyCount  *int64 `json:"monthlyCount,omitempty" validate:"min=0"`
+}
+
+// Apply returns limits with the overrides set in o.
+func (o LimitOverrides) Apply(limits TransferLimits) TransferLimits {
+	for _, f := range []struct {
+		override *int64
+		limit    *int64
+	}{
+		{o.DailyAmount, &limits.DailyAmount},
+		{o.DailyCount, &limits.DailyCount},
+		{o.MonthlyAmount, &limits.MonthlyAmount},
+		{o.MonthlyCount, &limits.MonthlyCount},
+	} {
+		if f.override != nil {
+			*f.limit = *f.override
+		}
+	}
+	return limits
+}
+
+// SetLimitsRequest replaces the tier and the overrides of a user. An empty
+// tier puts the user in the default tier; omitted overrides are removed.
+type SetLimitsRequest struct {
+	Tier string `json:"tier,omitempty"`
+	LimitOverrides
+}
+
+// LimitUsage is how much of one limit is used. Limit and Remaining are null
+// when there is no cap.
+type LimitUsage struct {
+	Limit     *int64 `json:"limit"`
+	Used      int64  `json:"used"`
+	Remaining *int64 `json:"remaining"`
+}
+
+// LimitWindow is the usage of the limits of one rolling window, counting the
+// transfers sent since Since.
+type LimitWindow struct {
+	Since  time.Time  `json:"since"`
+	Amount LimitUsage `json:"amount"`
+	Count  LimitUsage `json:"count"`
+}
+
+type UserLimitsResponse struct {
+	UserID    int64          `json:"userId"`
+	Tier      string         `json:"tier"`
+	Limits    TransferLimits `json:"limits"`
+	Overrides LimitOverrides `json:"overrides"`
+	Daily     LimitWindow    `json:"daily"`
+	Monthly   LimitWindow    `json:"monthly"`
+}
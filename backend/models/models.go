@@ -1,32 +1,70 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
 
 type User struct {
-	ID            int64     `json:"id"`
-	FirstName     string    `json:"first_name"`
-	LastName      string    `json:"last_name"`
-	Email         string    `json:"email,omitempty"`
-	Phone         string    `json:"phone,omitempty"`
-	AvatarURL     string    `json:"avatar_url,omitempty"`
-	Bio           string    `json:"bio,omitempty"`
-	PointsBalance int64     `json:"points_balance"`
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
+	ID            int64      `json:"id"`
+	FirstName     string     `json:"first_name"`
+	LastName      string     `json:"last_name"`
+	Email         string     `json:"email,omitempty"`
+	Phone         string     `json:"phone,omitempty"`
+	AvatarURL     string     `json:"avatar_url,omitempty"`
+	Bio           string     `json:"bio,omitempty"`
+	PointsBalance int64      `json:"points_balance"`
+	HeldBalance   int64      `json:"held_balance"`
+	Role          Role       `json:"role"`
+	Locale        string     `json:"locale,omitempty"` // preferred language of messages, e.g. "th"
+	Tier          string     `json:"tier,omitempty"`   // transfer limit tier; empty is the default tier
+	Status        UserStatus `json:"status"`
+	ClosedAt      *time.Time `json:"closed_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// UserStatus is the lifecycle state of an account. Closed accounts keep
+// their history but cannot send, receive or sign in, and are left out of
+// listings.
+type UserStatus string
+
+const (
+	UserActive UserStatus = "active"
+	UserClosed UserStatus = "closed"
+)
+
+// CloseUserRequest closes an account. SweepTo is the user that receives a
+// remaining balance; closing an account that still has points needs one.
+type CloseUserRequest struct {
+	SweepTo int64
+}
+
+// ETag is the entity tag of the user for If-Match: it changes whenever
+// updated_at does. Postgres keeps microseconds, so finer digits are dropped.
+func (u *User) ETag() string {
+	return fmt.Sprintf(`"%d"`, u.UpdatedAt.UnixMicro())
 }
 
 type Transfer struct {
-	TransferID  int64      `json:"transferId" db:"transfer_id"`
-	IdemKey     string     `json:"idemKey" db:"idempotency_key"`
-	FromUserID  int64      `json:"fromUserId" db:"from_user_id"`
-	ToUserID    int64      `json:"toUserId" db:"to_user_id"`
-	Amount      int64      `json:"amount" db:"amount"`
-	Status      string     `json:"status" db:"status"`
-	Note        string     `json:"note" db:"note"`
-	CreatedAt   time.Time  `json:"createdAt" db:"created_at"`
-	UpdatedAt   time.Time  `json:"updatedAt" db:"updated_at"`
-	CompletedAt *time.Time `json:"completedAt,omitempty" db:"completed_at"`
-	FailReason  *string    `json:"failReason,omitempty" db:"fail_reason"`
+	TransferID  int64          `json:"transferId" db:"transfer_id"`
+	IdemKey     string         `json:"idemKey" db:"idempotency_key"`
+	RequestHash string         `json:"-" db:"request_hash"`
+	FromUserID  int64          `json:"fromUserId" db:"from_user_id"`
+	ToUserID    int64          `json:"toUserId" db:"to_user_id"`
+	Amount      int64          `json:"amount" db:"amount"`
+	Status      TransferStatus `json:"status" db:"status"`
+	Note        string         `json:"note" db:"note"`
+	CreatedAt   time.Time      `json:"createdAt" db:"created_at"`
+	UpdatedAt   time.Time      `json:"updatedAt" db:"updated_at"`
+	CompletedAt *time.Time     `json:"completedAt,omitempty" db:"completed_at"`
+	ExpiresAt   *time.Time     `json:"expiresAt,omitempty" db:"expires_at"`
+	FailReason  *string        `json:"failReason,omitempty" db:"fail_reason"`
+	BatchID     string         `json:"batchId,omitempty" db:"batch_id"`
+	// ClientKey is the Idempotency-Key the sender created the transfer with;
+	// keys are unique per sender. IdemKey is the ID of the transfer.
+	ClientKey string `json:"-" db:"client_key"`
 }
 
 type PointLedger struct {
@@ -38,45 +76,236 @@ type PointLedger struct {
 	TransferID   *int64    `json:"transfer_id,omitempty"`
 	Reference    string    `json:"reference,omitempty"`
 	Metadata     string    `json:"metadata,omitempty"`
+	IdemKey      string    `json:"-"`
+	RequestHash  string    `json:"-"`
 	CreatedAt    time.Time `json:"created_at"`
 }
 
+// Request DTOs declare their rules in validate tags; see package validation.
+// The "name" rule is the configurable rules.maxNameLength of the UserService.
+
 type CreateUserRequest struct {
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Email     string `json:"email,omitempty"`
-	Phone     string `json:"phone,omitempty"`
-	AvatarURL string `json:"avatar_url,omitempty"`
-	Bio       string `json:"bio,omitempty"`
+	FirstName string `json:"first_name" validate:"required,name"`
+	LastName  string `json:"last_name" validate:"required,name"`
+	Email     string `json:"email,omitempty" validate:"max=254,email"`
+	Phone     string `json:"phone,omitempty" validate:"phone"`
+	AvatarURL string `json:"avatar_url,omitempty" validate:"max=2048,url"`
+	Bio       string `json:"bio,omitempty" validate:"max=500"`
+	Locale    string `json:"locale,omitempty" validate:"locale"`
 }
 
+// UpdateUserRequest is the whole profile of a user: PUT replaces the profile
+// with it, so omitted fields are cleared, and a PATCH is merged into the
+// current profile before it is checked the same way.
 type UpdateUserRequest struct {
-	FirstName string `json:"first_name,omitempty"`
-	LastName  string `json:"last_name,omitempty"`
-	Email     string `json:"email,omitempty"`
-	Phone     string `json:"phone,omitempty"`
-	AvatarURL string `json:"avatar_url,omitempty"`
-	Bio       string `json:"bio,omitempty"`
+	FirstName string `json:"first_name,omitempty" validate:"required,name"`
+	LastName  string `json:"last_name,omitempty" validate:"required,name"`
+	Email     string `json:"email,omitempty" validate:"max=254,email"`
+	Phone     string `json:"phone,omitempty" validate:"phone"`
+	AvatarURL string `json:"avatar_url,omitempty" validate:"max=2048,url"`
+	Bio       string `json:"bio,omitempty" validate:"max=500"`
+	Locale    string `json:"locale,omitempty" validate:"locale"`
 }
 
 type CreateTransferRequest struct {
 	FromUserID int64  `json:"fromUserId"`
-	ToUserID   int64  `json:"toUserId"`
-	Amount     int64  `json:"amount"` // in cents/points
-	Note       string `json:"note,omitempty"`
+	ToUserID   int64  `json:"toUserId" validate:"required"`
+	Amount     int64  `json:"amount" validate:"positive"` // in cents/points
+	Note       string `json:"note,omitempty" validate:"max=512"`
+	// Hold creates the transfer as pending: the amount is reserved on the
+	// sender's balance and only credited once the transfer is confirmed.
+	Hold bool `json:"hold,omitempty"`
+}
+
+// CreateBatchTransferRequest sends points from one sender to many
+// recipients at once; either every transfer is made or none is.
+type CreateBatchTransferRequest struct {
+	FromUserID int64               `json:"fromUserId"`
+	Transfers  []BatchTransferItem `json:"transfers"`
+}
+
+// BatchTransferItem is one recipient of a batch. Each item is checked like
+// the body of POST /api/transfers.
+type BatchTransferItem struct {
+	ToUserID int64  `json:"toUserId" validate:"required"`
+	Amount   int64  `json:"amount" validate:"positive"`
+	Note     string `json:"note,omitempty" validate:"max=512"`
 }
 
+// BatchTransferResponse lists the transfers of a batch in the order of the
+// request; Total is the sum of their amounts.
+type BatchTransferResponse struct {
+	BatchID   string     `json:"batchId"`
+	Total     int64      `json:"total"`
+	Transfers []Transfer `json:"transfers"`
+}
+
+type CancelTransferRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// PointsRequest is the body of the earn and redeem endpoints.
+type PointsRequest struct {
+	Amount    int64           `json:"amount" validate:"positive"`
+	Reference string          `json:"reference,omitempty"`
+	Metadata  json.RawMessage `json:"metadata,omitempty" validate:"json"`
+}
+
+// AdjustPointsRequest is the body of the adjust endpoint. Amount takes either
+// sign, and a reference is required so every manual correction can be traced
+// back to its cause.
+type AdjustPointsRequest struct {
+	Amount    int64           `json:"amount" validate:"nonzero"`
+	Reference string          `json:"reference,omitempty" validate:"required"`
+	Metadata  json.RawMessage `json:"metadata,omitempty" validate:"json"`
+}
+
+type ReverseTransferRequest struct {
+	Reason string `json:"reason,omitempty"`
+	// AllowNegative lets the reversal go through even when the recipient has
+	// already spent the points, leaving them with a negative balance. Only
+	// callers with models.PermTransfersOverdraw may set it.
+	AllowNegative bool `json:"allowNegative,omitempty"`
+}
+
+// TransferListQuery filters and pages GET /api/transfers, newest first. Zero
+// values do not filter.
 type TransferListQuery struct {
-	UserID   int64 `query:"userId"`
-	Page     int   `query:"page"`
-	PageSize int   `query:"pageSize"`
+	UserID       int64  // transfers sent or received by the user; 0 lists every user
+	Direction    string // sent or received, relative to UserID
+	Statuses     []TransferStatus
+	MinAmount    *int64
+	MaxAmount    *int64
+	Counterparty int64 // the other side of the transfers of UserID, or either side without UserID
+	From         *time.Time
+	To           *time.Time
+	Note         string // case-insensitive substring of the note
+	BatchID      string
+
+	// Cursor is the nextCursor of the previous page; the service decodes it
+	// into After. Without it Page selects the page.
+	Cursor   string
+	After    *TransferCursor
+	Page     int
+	PageSize int
 }
 
+// TransferCursor is the position of the last transfer of a page in the
+// (created_at, transfer_id) order of the list.
+type TransferCursor struct {
+	CreatedAt  time.Time `json:"t"`
+	TransferID int64     `json:"id"`
+}
+
+// TransferListResponse is a page of transfers. NextCursor is set while more
+// transfers follow; Page is left out when the page was selected by a cursor.
 type TransferListResponse struct {
-	Data     []Transfer `json:"data"`
-	Page     int        `json:"page"`
-	PageSize int        `json:"pageSize"`
-	Total    int        `json:"total"`
+	Data       []Transfer `json:"data"`
+	Page       int        `json:"page,omitempty"`
+	PageSize   int        `json:"pageSize"`
+	Total      int        `json:"total"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+}
+
+// UserListQuery filters, sorts and pages GET /api/users. Zero values do not
+// filter.
+type UserListQuery struct {
+	// Search matches words in the name, email or phone; every word must match
+	Search     string
+	Status     string // active, closed or all; empty is active
+	MinBalance *int64
+	MaxBalance *int64
+	From       *time.Time // created at or after
+	To         *time.Time // created before
+	Sort       string     // a field of UserSortFields, with a leading "-" for descending
+
+	// Cursor is the nextCursor of the previous page; the service decodes it
+	// into After. Without it Page selects the page.
+	Cursor   string
+	After    *UserCursor
+	Page     int
+	PageSize int
+}
+
+// UserCursor is the position of the last user of a page in the (sort key, id)
+// order of the list. Sort is the sort it was made for; Key is the value of
+// that field for the user, a string, an int64 or a time.Time.
+type UserCursor struct {
+	Sort string
+	Key  any
+	ID   int64
+}
+
+// UserSortFields are the sort keys of UserListQuery and their columns.
+var UserSortFields = map[string]string{
+	"id":             "id",
+	"first_name":     "first_name",
+	"last_name":      "last_name",
+	"points_balance": "points_balance",
+	"created_at":     "created_at",
+}
+
+// UserListResponse is a page of users, like TransferListResponse.
+type UserListResponse struct {
+	Data       []User `json:"data"`
+	Page       int    `json:"page,omitempty"`
+	PageSize   int    `json:"pageSize"`
+	Total      int    `json:"total"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+type LedgerListQuery struct {
+	UserID     int64
+	EventType  string
+	From       *time.Time
+	To         *time.Time
+	TransferID *int64
+	Cursor     int64 // return entries with id < Cursor; 0 starts from the newest
+	Limit      int
+}
+
+type LedgerListResponse struct {
+	Data       []PointLedger `json:"data"`
+	Limit      int           `json:"limit"`
+	NextCursor *int64        `json:"nextCursor,omitempty"`
+}
+
+// StatementQuery selects the period and format of an account statement. The
+// period includes From and ends before To.
+type StatementQuery struct {
+	UserID int64
+	From   *time.Time
+	To     *time.Time
+	Format string // csv, jsonl or html
+}
+
+// Statement is the header of an account statement; its entries are streamed
+// by LedgerService.StreamStatement.
+type Statement struct {
+	User           *User
+	From           time.Time
+	To             time.Time
+	Format         string
+	OpeningBalance int64
+	ClosingBalance int64
+	// LastEntryID is the newest ledger entry the balances include; entries
+	// made while the statement is streamed are left out.
+	LastEntryID int64
+}
+
+// StatementEntry is a ledger entry of a statement together with the other
+// side and the note of its transfer.
+type StatementEntry struct {
+	ID               int64     `json:"id"`
+	CreatedAt        time.Time `json:"created_at"`
+	EventType        string    `json:"event_type"`
+	Change           int64     `json:"change"`
+	BalanceAfter     int64     `json:"balance_after"`
+	TransferID       *int64    `json:"transfer_id,omitempty"`
+	CounterpartyID   *int64    `json:"counterparty_id,omitempty"`
+	CounterpartyName string    `json:"counterparty_name,omitempty"`
+	Note             string    `json:"note,omitempty"`
+	Reference        string    `json:"reference,omitempty"`
 }
 
 func Now() time.Time {
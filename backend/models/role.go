@@ -0,0 +1,73 @@
+package models
+
+// Role decides which permissions a user has beyond access to their own
+// account.
+type Role string
+
+const (
+	RoleUser    Role = "user"
+	RoleSupport Role = "support"
+	RoleAdmin   Role = "admin"
+)
+
+// Permission grants access to a kind of operation on every account, not just
+// the caller's own.
+type Permission string
+
+const (
+	PermUsersList         Permission = "users:list"
+	PermUsersRead         Permission = "users:read"
+	PermUsersCreate       Permission = "users:create"
+	PermUsersUpdate       Permission = "users:update"
+	PermUsersDelete       Permission = "users:delete"
+	PermUsersRole         Permission = "users:role"
+	PermUsersLimits       Permission = "users:limits"
+	PermUsersImport       Permission = "users:import"
+	PermLedgerRead        Permission = "ledger:read"
+	PermPointsEarn        Permission = "points:earn"
+	PermPointsRedeem      Permission = "points:redeem"
+	PermPointsAdjust      Permission = "points:adjust"
+	PermTransfersRead     Permission = "transfers:read"
+	PermTransfersEdit     Permission = "transfers:edit"
+	PermTransfersReverse  Permission = "transfers:reverse"
+	PermTransfersOverdraw Permission = "transfers:overdraw"
+	PermAPIKeys           Permission = "apikeys:manage"
+)
+
+// rolePermissions lists the permissions of each role. Users only get what the
+// routes allow on their own account.
+var rolePermissions = map[Role][]Permission{
+	RoleSupport: {
+		PermUsersList, PermUsersRead, PermLedgerRead, PermTransfersRead, PermTransfersReverse,
+	},
+	RoleAdmin: {
+		PermUsersList, PermUsersRead, PermUsersCreate, PermUsersUpdate, PermUsersDelete, PermUsersRole, PermUsersLimits, PermUsersImport,
+		PermLedgerRead, PermPointsEarn, PermPointsRedeem, PermPointsAdjust,
+		PermTransfersRead, PermTransfersEdit, PermTransfersReverse, PermTransfersOverdraw, PermAPIKeys,
+	},
+}
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool {
+	return r == RoleUser || r == RoleSupport || r == RoleAdmin
+}
+
+// Valid reports whether p is a known permission. Admins have every
+// permission, so their list is the list of all permissions.
+func (p Permission) Valid() bool {
+	return RoleAdmin.Can(p)
+}
+
+// Can reports whether the role has permission p.
+func (r Role) Can(p Permission) bool {
+	for _, granted := range rolePermissions[r] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+type UpdateRoleRequest struct {
+	Role Role `json:"role"`
+}
@@ -0,0 +1,56 @@
+package models
+
+// Types of transfer rules; see TransferRule for the settings each one uses.
+const (
+	RuleMinAmount     = "min_amount"
+	RuleMaxAmount     = "max_amount"
+	RuleSameRecipient = "same_recipient"
+	RuleDailyLimit    = "daily_limit"
+	RuleWeeklyLimit   = "weekly_limit"
+	RuleBlockedPair   = "blocked_pair"
+	RuleTimeWindow    = "time_window"
+)
+
+// TransferRule is one policy of the chain every new transfer is checked
+// against, configured in the config file (rules.transfer) or as a row of the
+// transfer_rules table. Only the settings of its Type are used.
+type TransferRule struct {
+	ID int64 `json:"id,omitempty"`
+	// Name is reported when the rule rejects a transfer; it defaults to Type
+	Name string `json:"name,omitempty"`
+	Type string `json:"type"`
+
+	// Amount is the bound of min_amount and max_amount, and the most a user
+	// may send per day or week for daily_limit and weekly_limit
+	Amount int64 `json:"amount,omitempty"`
+	// Cooldown of same_recipient, e.g. "24h", is how long a sender must wait
+	// to send to the same recipient again. Without one the sender must first
+	// send to someone else.
+	Cooldown string `json:"cooldown,omitempty"`
+	// FromUserID and ToUserID are the pair blocked by blocked_pair; 0 stands
+	// for any user
+	FromUserID int64 `json:"fromUserId,omitempty"`
+	ToUserID   int64 `json:"toUserId,omitempty"`
+	// Start and End bound the time_window, as "15:04", in which transfers are
+	// allowed; a window may run past midnight, e.g. 22:00 to 06:00
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	// Timezone of time_window and of the days and weeks of the limits, e.g.
+	// "Asia/Bangkok"; it defaults to UTC. Weeks start on Monday.
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// TransferRuleResult is the outcome of one rule in a dry run.
+type TransferRuleResult struct {
+	Rule   string `json:"rule"`
+	Type   string `json:"type"`
+	Passed bool   `json:"passed"`
+	Code   string `json:"code,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// TransferDryRunResponse tells whether a transfer would pass the rules.
+type TransferDryRunResponse struct {
+	Allowed bool                 `json:"allowed"`
+	Rules   []TransferRuleResult `json:"rules"`
+}
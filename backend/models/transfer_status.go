@@ -0,0 +1,51 @@
+package models
+
+import "time"
+
+type TransferStatus string
+
+const (
+	TransferPending    TransferStatus = "pending"
+	TransferProcessing TransferStatus = "processing"
+	TransferCompleted  TransferStatus = "completed"
+	TransferFailed     TransferStatus = "failed"
+	TransferCancelled  TransferStatus = "cancelled"
+	TransferReversed   TransferStatus = "reversed"
+)
+
+// transferTransitions lists, for each status, the statuses a transfer may move
+// to next. Statuses without an entry are final.
+var transferTransitions = map[TransferStatus][]TransferStatus{
+	TransferPending:    {TransferProcessing, TransferCancelled, TransferFailed},
+	TransferProcessing: {TransferCompleted, TransferFailed},
+	TransferCompleted:  {TransferReversed},
+}
+
+// Valid reports whether s is a known status.
+func (s TransferStatus) Valid() bool {
+	switch s {
+	case TransferPending, TransferProcessing, TransferCompleted, TransferFailed, TransferCancelled, TransferReversed:
+		return true
+	}
+	return false
+}
+
+// CanTransitionTo reports whether a transfer in status s may move to next.
+func (s TransferStatus) CanTransitionTo(next TransferStatus) bool {
+	for _, allowed := range transferTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+type TransferStatusHistory struct {
+	ID         int64           `json:"id" db:"id"`
+	TransferID int64           `json:"transferId" db:"transfer_id"`
+	FromStatus *TransferStatus `json:"fromStatus" db:"from_status"` // nil when the transfer was created
+	ToStatus   TransferStatus  `json:"toStatus" db:"to_status"`
+	Actor      string          `json:"actor" db:"actor"`
+	Reason     string          `json:"reason,omitempty" db:"reason"`
+	CreatedAt  time.Time       `json:"createdAt" db:"created_at"`
+}
@@ -0,0 +1,52 @@
+package models
+
+// How an import commits its rows: all in one transaction, so one invalid row
+// rejects the file, or every valid row on its own.
+const (
+	ImportCommitAll = "all"
+	ImportCommitRow = "row"
+)
+
+// ImportColumns are the columns of a user import CSV, named in its header.
+var ImportColumns = []string{"first_name", "last_name", "email", "phone", "initial_balance"}
+
+// ImportUserRow is a row of a user import CSV. It is checked like the body
+// of POST /api/users; initial_balance is credited with an earn ledger entry.
+type ImportUserRow struct {
+	CreateUserRequest
+	InitialBalance int64 `json:"initial_balance" validate:"min=0"`
+}
+
+// Statuses of the rows of an import report.
+const (
+	ImportRowValid   = "valid"   // passed the checks of a dry run
+	ImportRowCreated = "created" // the user was created
+	ImportRowFailed  = "failed"  // the row is invalid or was not created, see its errors
+	ImportRowSkipped = "skipped" // valid, but another row rejected the file
+)
+
+type UserImportResponse struct {
+	DryRun  bool                  `json:"dry_run"`
+	Total   int                   `json:"total"`
+	Created int                   `json:"created"`
+	Failed  int                   `json:"failed"`
+	Rows    []UserImportRowResult `json:"rows"`
+}
+
+// UserImportRowResult reports one row; Row is its line in the CSV, the
+// header being line 1.
+type UserImportRowResult struct {
+	Row    int                `json:"row"`
+	Status string             `json:"status"`
+	UserID int64              `json:"user_id,omitempty"`
+	Errors []ImportFieldError `json:"errors,omitempty"`
+}
+
+// ImportFieldError is a problem with one column of a row, like the
+// field_errors of a problem response. Field is empty when the row could not
+// be created as a whole.
+type ImportFieldError struct {
+	Field   string `json:"field,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,128 @@
+package repositories
+
+import (
+	"backend/models"
+	"time"
+)
+
+// UserRepository stores users and their point balances.
+type UserRepository interface {
+	// List returns a page of the users matching q, plus the first user of
+	// the next page when there is one, and how many match.
+	List(q *models.UserListQuery) ([]models.User, int, error)
+	GetByID(id int64) (*models.User, error)
+	// GetByIDForUpdate reads a user and locks the row until the surrounding
+	// transaction ends.
+	GetByIDForUpdate(id int64) (*models.User, error)
+	Create(user *models.User) error
+	Update(id int64, user *models.User) error
+	UpdateRole(id int64, role models.Role) error
+	UpdateTier(id int64, tier string) error
+	UpdateStatus(id int64, status models.UserStatus, closedAt *time.Time) error
+	UpdateBalance(userID int64, amount int64) error
+	UpdateHeldBalance(userID int64, amount int64) error
+	ForceUpdateBalance(userID int64, amount int64) error
+	GetBalance(userID int64) (int64, error)
+}
+
+// TransferRepository stores transfers and their status history.
+type TransferRepository interface {
+	GetByIdemKey(key string) (*models.Transfer, error)
+	// GetByClientKey returns the transfer fromUserID created with the
+	// Idempotency-Key key, or nil when there is none.
+	GetByClientKey(fromUserID int64, key string) (*models.Transfer, error)
+	// ReleaseClientKeys frees the Idempotency-Keys of the transfers created
+	// before the given time so they can be used again, and returns how many
+	// were freed.
+	ReleaseClientKeys(before time.Time) (int64, error)
+	// ReleaseClientKey frees the Idempotency-Key key of fromUserID when the
+	// transfer created with it is from before the given time.
+	ReleaseClientKey(fromUserID int64, key string, before time.Time) error
+	GetByIdemKeyForUpdate(key string) (*models.Transfer, error)
+	// List returns a page of the transfers matching q, plus the first
+	// transfer of the next page when there is one, and how many match.
+	List(q *models.TransferListQuery) ([]models.Transfer, int, error)
+	// ListByBatch returns the transfers of a batch in the order they were
+	// made.
+	ListByBatch(batchID string) ([]models.Transfer, error)
+	Create(transfer *models.Transfer) error
+	UpdateStatus(transfer *models.Transfer, from, to models.TransferStatus) error
+	CreateStatusHistory(h *models.TransferStatusHistory) error
+	GetStatusHistory(transferID int64) ([]models.TransferStatusHistory, error)
+	ListExpiredPending(now time.Time) ([]string, error)
+	// GetLastSent returns the most recent completed or pending transfer of
+	// fromUserID, only counting transfers to toUserID unless it is 0, or nil
+	// when there is none.
+	GetLastSent(fromUserID, toUserID int64) (*models.Transfer, error)
+	// SumSent returns the total amount and the number of the transfers
+	// fromUserID sent since the given time that are pending, processing or
+	// completed.
+	SumSent(fromUserID int64, since time.Time) (amount int64, count int64, err error)
+}
+
+// LedgerRepository stores point ledger entries.
+type LedgerRepository interface {
+	Create(ledger *models.PointLedger) error
+	GetByIdemKey(userID int64, key string) (*models.PointLedger, error)
+	// ReleaseIdemKeys frees the Idempotency-Keys of the entries written before
+	// the given time so they can be used again, and returns how many were
+	// freed.
+	ReleaseIdemKeys(before time.Time) (int64, error)
+	// ReleaseIdemKey frees the Idempotency-Key key of userID when the entry
+	// written with it is from before the given time.
+	ReleaseIdemKey(userID int64, key string, before time.Time) error
+	List(q *models.LedgerListQuery) ([]models.PointLedger, error)
+	// Balances returns the balance of a user at from and at to, and the ID of
+	// the newest entry of the user, which the balances include.
+	Balances(userID int64, from, to time.Time) (opening, closing, lastID int64, err error)
+	// Statement returns up to limit entries of a user created from from until
+	// to, oldest first, with an ID after afterID and up to lastID.
+	Statement(userID int64, from, to time.Time, afterID, lastID int64, limit int) ([]models.StatementEntry, error)
+}
+
+// CredentialRepository stores the local logins of users.
+type CredentialRepository interface {
+	Create(cred *models.Credential) error
+	GetByUsername(username string) (*models.Credential, error)
+}
+
+// APIKeyRepository stores the API keys of partner integrations.
+type APIKeyRepository interface {
+	Create(key *models.APIKey) error
+	GetByPrefix(prefix string) (*models.APIKey, error)
+	List() ([]models.APIKey, error)
+	Revoke(id int64, at time.Time) error
+	TouchLastUsed(id int64, at time.Time) error
+}
+
+// TransferRuleRepository stores the transfer rules managed in the database.
+type TransferRuleRepository interface {
+	Create(rule *models.TransferRule, createdAt time.Time) error
+	ListEnabled() ([]models.TransferRule, error)
+}
+
+// LimitRepository stores the transfer limits set for individual users.
+type LimitRepository interface {
+	// Get returns the overrides of the user, all nil when none are set.
+	Get(userID int64) (*models.LimitOverrides, error)
+	// Set replaces the overrides of the user.
+	Set(userID int64, o *models.LimitOverrides, at time.Time) error
+}
+
+// Store is the unit of work the services run against. The repositories it
+// returns run their queries directly on the database, or inside the
+// transaction when the Store was handed out by WithTx.
+type Store interface {
+	Users() UserRepository
+	Transfers() TransferRepository
+	Ledger() LedgerRepository
+	Credentials() CredentialRepository
+	APIKeys() APIKeyRepository
+	TransferRules() TransferRuleRepository
+	Limits() LimitRepository
+
+	// WithTx runs fn in a transaction that is committed when fn returns nil
+	// and rolled back otherwise. Calling WithTx on a transactional Store runs
+	// fn in the same transaction.
+	WithTx(fn func(tx Store) error) error
+}
@@ -0,0 +1,106 @@
+package repositories
+
+import (
+	"backend/models"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+type apiKeyRepository struct {
+	conn
+}
+
+const apiKeyColumns = "id, name, prefix, secret_hash, owner_id, scopes, created_at, last_used_at, revoked_at"
+
+func (r *apiKeyRepository) Create(key *models.APIKey) error {
+	return r.queryRow(`
+		INSERT INTO api_keys (name, prefix, secret_hash, owner_id, scopes, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, key.Name, key.Prefix, key.SecretHash, key.OwnerID, joinScopes(key.Scopes), key.CreatedAt).Scan(&key.ID)
+}
+
+func (r *apiKeyRepository) GetByPrefix(prefix string) (*models.APIKey, error) {
+	return scanAPIKey(r.queryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE prefix = ?", prefix))
+}
+
+func (r *apiKeyRepository) List() ([]models.APIKey, error) {
+	rows, err := r.query("SELECT " + apiKeyColumns + " FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+// Revoke marks the key as revoked at the given time. Revoking a key twice
+// keeps the first time.
+func (r *apiKeyRepository) Revoke(id int64, at time.Time) error {
+	result, err := r.exec("UPDATE api_keys SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?", at, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+func (r *apiKeyRepository) TouchLastUsed(id int64, at time.Time) error {
+	_, err := r.exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", at, id)
+	return err
+}
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*models.APIKey, error) {
+	var key models.APIKey
+	var scopes string
+	err := row.Scan(&key.ID, &key.Name, &key.Prefix, &key.SecretHash, &key.OwnerID, &scopes, &key.CreatedAt, &key.LastUsedAt, &key.RevokedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key.Scopes = splitScopes(scopes)
+
+	return &key, nil
+}
+
+// Scopes are stored space-separated, like OAuth scopes.
+func joinScopes(scopes []models.Permission) string {
+	s := make([]string, len(scopes))
+	for i, scope := range scopes {
+		s[i] = string(scope)
+	}
+	return strings.Join(s, " ")
+}
+
+func splitScopes(s string) []models.Permission {
+	scopes := []models.Permission{}
+	for _, scope := range strings.Fields(s) {
+		scopes = append(scopes, models.Permission(scope))
+	}
+	return scopes
+}
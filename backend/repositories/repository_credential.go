@@ -0,0 +1,45 @@
+package repositories
+
+import (
+	"backend/models"
+	"database/sql"
+	"errors"
+)
+
+var (
+	ErrCredentialNotFound = errors.New("credential not found")
+	ErrDuplicateUsername  = errors.New("username already taken")
+)
+
+type credentialRepository struct {
+	conn
+}
+
+func (r *credentialRepository) Create(cred *models.Credential) error {
+	_, err := r.exec(`
+		INSERT INTO credentials (user_id, username, password_hash, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, cred.UserID, cred.Username, cred.PasswordHash, cred.CreatedAt, cred.UpdatedAt)
+
+	if r.isUniqueViolation(err) {
+		return ErrDuplicateUsername
+	}
+	return err
+}
+
+func (r *credentialRepository) GetByUsername(username string) (*models.Credential, error) {
+	var cred models.Credential
+	err := r.queryRow(`
+		SELECT user_id, username, password_hash, created_at, updated_at
+		FROM credentials WHERE username = ?
+	`, username).Scan(&cred.UserID, &cred.Username, &cred.PasswordHash, &cred.CreatedAt, &cred.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrCredentialNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &cred, nil
+}
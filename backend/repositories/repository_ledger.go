@@ -3,31 +3,167 @@ package repositories
 import (
 	"backend/models"
 	"database/sql"
+	"strings"
+	"time"
 )
 
-type LedgerRepository struct {
-	db *sql.DB
+type ledgerRepository struct {
+	conn
 }
 
-func NewLedgerRepository(db *sql.DB) *LedgerRepository {
-	return &LedgerRepository{db: db}
+func (r *ledgerRepository) Create(ledger *models.PointLedger) error {
+	err := r.queryRow(`
+		INSERT INTO point_ledger (user_id, change, balance_after, event_type, transfer_id, reference, metadata, idempotency_key, request_hash, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, ledger.UserID, ledger.Change, ledger.BalanceAfter, ledger.EventType, ledger.TransferID, ledger.Reference, ledger.Metadata, nullString(ledger.IdemKey), nullString(ledger.RequestHash), ledger.CreatedAt).Scan(&ledger.ID)
+
+	if r.isUniqueViolation(err) {
+		return ErrDuplicateIdemKey
+	}
+	return err
 }
 
-func (r *LedgerRepository) Create(tx *sql.Tx, ledger *models.PointLedger) error {
-	result, err := tx.Exec(`
-		INSERT INTO point_ledger (user_id, change, balance_after, event_type, transfer_id, reference, metadata, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, ledger.UserID, ledger.Change, ledger.BalanceAfter, ledger.EventType, ledger.TransferID, ledger.Reference, ledger.Metadata, ledger.CreatedAt)
+// GetByIdemKey returns the entry of userID written with an Idempotency-Key,
+// or nil when the key has not been used.
+func (r *ledgerRepository) GetByIdemKey(userID int64, key string) (*models.PointLedger, error) {
+	var l models.PointLedger
+	err := r.queryRow(`
+		SELECT id, user_id, change, balance_after, event_type, transfer_id, COALESCE(reference, ''), COALESCE(metadata, ''), idempotency_key, COALESCE(request_hash, ''), created_at
+		FROM point_ledger WHERE user_id = ? AND idempotency_key = ?
+	`, userID, key).Scan(&l.ID, &l.UserID, &l.Change, &l.BalanceAfter, &l.EventType, &l.TransferID, &l.Reference, &l.Metadata, &l.IdemKey, &l.RequestHash, &l.CreatedAt)
 
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	id, err := result.LastInsertId()
+	return &l, nil
+}
+
+func (r *ledgerRepository) ReleaseIdemKeys(before time.Time) (int64, error) {
+	result, err := r.exec(`
+		UPDATE point_ledger SET idempotency_key = NULL
+		WHERE idempotency_key IS NOT NULL AND created_at < ?
+	`, before)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	return result.RowsAffected()
+}
+
+func (r *ledgerRepository) ReleaseIdemKey(userID int64, key string, before time.Time) error {
+	_, err := r.exec(`
+		UPDATE point_ledger SET idempotency_key = NULL
+		WHERE user_id = ? AND idempotency_key = ? AND created_at < ?
+	`, userID, key, before)
+	return err
+}
+
+// List returns up to q.Limit entries for q.UserID, newest first, matching the
+// optional filters in q.
+func (r *ledgerRepository) List(q *models.LedgerListQuery) ([]models.PointLedger, error) {
+	where := []string{"user_id = ?"}
+	args := []interface{}{q.UserID}
+
+	if q.EventType != "" {
+		where = append(where, "event_type = ?")
+		args = append(args, q.EventType)
+	}
+	if q.From != nil {
+		where = append(where, "created_at >= ?")
+		args = append(args, *q.From)
+	}
+	if q.To != nil {
+		where = append(where, "created_at < ?")
+		args = append(args, *q.To)
+	}
+	if q.TransferID != nil {
+		where = append(where, "transfer_id = ?")
+		args = append(args, *q.TransferID)
+	}
+	if q.Cursor > 0 {
+		where = append(where, "id < ?")
+		args = append(args, q.Cursor)
+	}
+	args = append(args, q.Limit)
+
+	rows, err := r.query(`
+		SELECT id, user_id, change, balance_after, event_type, transfer_id, COALESCE(reference, ''), COALESCE(metadata, ''), created_at
+		FROM point_ledger
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY id DESC
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.PointLedger
+	for rows.Next() {
+		var l models.PointLedger
+		err := rows.Scan(&l.ID, &l.UserID, &l.Change, &l.BalanceAfter, &l.EventType, &l.TransferID, &l.Reference, &l.Metadata, &l.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, l)
+	}
+
+	return entries, rows.Err()
+}
+
+// Balances works back from the current balance rather than forward from the
+// first entry, as users may have been funded before the ledger existed.
+func (r *ledgerRepository) Balances(userID int64, from, to time.Time) (opening, closing, lastID int64, err error) {
+	err = r.queryRow(`
+		SELECT u.points_balance - COALESCE(SUM(CASE WHEN l.created_at >= ? THEN l.change END), 0),
+			u.points_balance - COALESCE(SUM(CASE WHEN l.created_at >= ? THEN l.change END), 0),
+			COALESCE(MAX(l.id), 0)
+		FROM users u
+		LEFT JOIN point_ledger l ON l.user_id = u.id
+		WHERE u.id = ?
+		GROUP BY u.id, u.points_balance
+	`, from, to, userID).Scan(&opening, &closing, &lastID)
+
+	if err == sql.ErrNoRows {
+		return 0, 0, 0, ErrUserNotFound
+	}
+	return opening, closing, lastID, err
+}
+
+func (r *ledgerRepository) Statement(userID int64, from, to time.Time, afterID, lastID int64, limit int) ([]models.StatementEntry, error) {
+	rows, err := r.query(`
+		SELECT l.id, l.created_at, l.event_type, l.change, l.balance_after, l.transfer_id,
+			c.id, COALESCE(c.first_name || ' ' || c.last_name, ''), COALESCE(t.note, ''), COALESCE(l.reference, '')
+		FROM point_ledger l
+		LEFT JOIN transfers t ON t.transfer_id = l.transfer_id
+		LEFT JOIN users c ON c.id = CASE WHEN t.from_user_id = l.user_id THEN t.to_user_id ELSE t.from_user_id END
+		WHERE l.user_id = ? AND l.created_at >= ? AND l.created_at < ? AND l.id > ? AND l.id <= ?
+		ORDER BY l.id
+		LIMIT ?
+	`, userID, from, to, afterID, lastID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.StatementEntry
+	for rows.Next() {
+		var e models.StatementEntry
+		err := rows.Scan(&e.ID, &e.CreatedAt, &e.EventType, &e.Change, &e.BalanceAfter, &e.TransferID,
+			&e.CounterpartyID, &e.CounterpartyName, &e.Note, &e.Reference)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
 
-	ledger.ID = id
-	return nil
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
 }
@@ -0,0 +1,41 @@
+package repositories
+
+import (
+	"backend/models"
+	"database/sql"
+	"time"
+)
+
+type limitRepository struct {
+	conn
+}
+
+func (r *limitRepository) Get(userID int64) (*models.LimitOverrides, error) {
+	var o models.LimitOverrides
+	err := r.queryRow(`
+		SELECT daily_amount, daily_count, monthly_amount, monthly_count
+		FROM user_limits WHERE user_id = ?
+	`, userID).Scan(&o.DailyAmount, &o.DailyCount, &o.MonthlyAmount, &o.MonthlyCount)
+
+	if err == sql.ErrNoRows {
+		return &o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (r *limitRepository) Set(userID int64, o *models.LimitOverrides, at time.Time) error {
+	_, err := r.exec(`
+		INSERT INTO user_limits (user_id, daily_amount, daily_count, monthly_amount, monthly_count, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			daily_amount = excluded.daily_amount,
+			daily_count = excluded.daily_count,
+			monthly_amount = excluded.monthly_amount,
+			monthly_count = excluded.monthly_count,
+			updated_at = excluded.updated_at
+	`, userID, o.DailyAmount, o.DailyCount, o.MonthlyAmount, o.MonthlyCount, at)
+	return err
+}
@@ -4,43 +4,79 @@ import (
 	"backend/models"
 	"database/sql"
 	"errors"
+	"strings"
+	"time"
 )
 
-type TransferRepository struct {
-	DB *sql.DB
-}
+var (
+	ErrDuplicateIdemKey = errors.New("duplicate idempotency key")
+	ErrStatusChanged    = errors.New("transfer status changed concurrently")
+)
 
-func NewTransferRepository(db *sql.DB) *TransferRepository {
-	return &TransferRepository{DB: db}
+type transferRepository struct {
+	conn
 }
 
-func (r *TransferRepository) GetByIdemKey(key string) (*models.Transfer, error) {
-	var t models.Transfer
-	err := r.DB.QueryRow(`
-		SELECT transfer_id, idempotency_key, from_user_id, to_user_id, amount, status, note, created_at, updated_at, completed_at, fail_reason
+func (r *transferRepository) GetByIdemKey(key string) (*models.Transfer, error) {
+	t, err := scanTransfer(r.queryRow(`
+		SELECT transfer_id, idempotency_key, COALESCE(request_hash, ''), from_user_id, to_user_id, amount, status, note, created_at, updated_at, completed_at, expires_at, fail_reason, COALESCE(batch_id, ''), COALESCE(client_key, '')
 		FROM transfers WHERE idempotency_key = ?
-	`, key).Scan(&t.TransferID, &t.IdemKey, &t.FromUserID, &t.ToUserID, &t.Amount, &t.Status, &t.Note, &t.CreatedAt, &t.UpdatedAt, &t.CompletedAt, &t.FailReason)
+	`, key))
 
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
+	return t, err
+}
+
+func (r *transferRepository) GetByClientKey(fromUserID int64, key string) (*models.Transfer, error) {
+	t, err := scanTransfer(r.queryRow(`
+		SELECT transfer_id, idempotency_key, COALESCE(request_hash, ''), from_user_id, to_user_id, amount, status, note, created_at, updated_at, completed_at, expires_at, fail_reason, COALESCE(batch_id, ''), COALESCE(client_key, '')
+		FROM transfers WHERE from_user_id = ? AND client_key = ?
+	`, fromUserID, key))
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+func (r *transferRepository) ReleaseClientKeys(before time.Time) (int64, error) {
+	result, err := r.exec(`
+		UPDATE transfers SET client_key = NULL
+		WHERE client_key IS NOT NULL AND created_at < ?
+	`, before)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	return result.RowsAffected()
+}
 
-	return &t, nil
+func (r *transferRepository) ReleaseClientKey(fromUserID int64, key string, before time.Time) error {
+	_, err := r.exec(`
+		UPDATE transfers SET client_key = NULL
+		WHERE from_user_id = ? AND client_key = ? AND created_at < ?
+	`, fromUserID, key, before)
+	return err
 }
 
-func (r *TransferRepository) GetByID(id int64) (*models.Transfer, error) {
-	var t models.Transfer
-	err := r.DB.QueryRow(`
-		SELECT transfer_id, idempotency_key, from_user_id, to_user_id, amount, status, note, created_at, updated_at, completed_at, fail_reason
-		FROM transfers WHERE transfer_id = ?
-	`, id).Scan(&t.TransferID, &t.IdemKey, &t.FromUserID, &t.ToUserID, &t.Amount, &t.Status, &t.Note, &t.CreatedAt, &t.UpdatedAt, &t.CompletedAt, &t.FailReason)
+// GetByIdemKeyForUpdate reads a transfer and locks the row until the
+// surrounding transaction ends.
+func (r *transferRepository) GetByIdemKeyForUpdate(key string) (*models.Transfer, error) {
+	t, err := scanTransfer(r.queryRow(`
+		SELECT transfer_id, idempotency_key, COALESCE(request_hash, ''), from_user_id, to_user_id, amount, status, note, created_at, updated_at, completed_at, expires_at, fail_reason, COALESCE(batch_id, ''), COALESCE(client_key, '')
+		FROM transfers WHERE idempotency_key = ?
+	`+r.forUpdate(), key))
 
 	if err == sql.ErrNoRows {
-		return nil, errors.New("transfer not found")
+		return nil, nil
 	}
+	return t, err
+}
+
+func scanTransfer(row *sql.Row) (*models.Transfer, error) {
+	var t models.Transfer
+	err := row.Scan(&t.TransferID, &t.IdemKey, &t.RequestHash, &t.FromUserID, &t.ToUserID, &t.Amount, &t.Status, &t.Note, &t.CreatedAt, &t.UpdatedAt, &t.CompletedAt, &t.ExpiresAt, &t.FailReason, &t.BatchID, &t.ClientKey)
 	if err != nil {
 		return nil, err
 	}
@@ -48,60 +84,260 @@ func (r *TransferRepository) GetByID(id int64) (*models.Transfer, error) {
 	return &t, nil
 }
 
-func (r *TransferRepository) GetByUserID(userID int64, page, pageSize int) ([]models.Transfer, int, error) {
-	offset := (page - 1) * pageSize
+// scanTransfers reads the transfers of rows selected with the columns of
+// scanTransfer.
+func scanTransfers(rows *sql.Rows) ([]models.Transfer, error) {
+	var transfers []models.Transfer
+	for rows.Next() {
+		var t models.Transfer
+		err := rows.Scan(&t.TransferID, &t.IdemKey, &t.RequestHash, &t.FromUserID, &t.ToUserID, &t.Amount, &t.Status, &t.Note, &t.CreatedAt, &t.UpdatedAt, &t.CompletedAt, &t.ExpiresAt, &t.FailReason, &t.BatchID, &t.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, t)
+	}
+
+	return transfers, rows.Err()
+}
+
+// List returns the page of transfers matching q, newest first, followed by
+// the first transfer of the next page when there is one, and the number of
+// matching transfers; q.After skips the transfers up to and including the
+// cursor instead of q.Page.
+func (r *transferRepository) List(q *models.TransferListQuery) ([]models.Transfer, int, error) {
+	var where []string
+	var args []interface{}
+
+	switch {
+	case q.UserID != 0 && q.Direction == "sent":
+		where = append(where, "from_user_id = ?")
+		args = append(args, q.UserID)
+	case q.UserID != 0 && q.Direction == "received":
+		where = append(where, "to_user_id = ?")
+		args = append(args, q.UserID)
+	case q.UserID != 0:
+		where = append(where, "(from_user_id = ? OR to_user_id = ?)")
+		args = append(args, q.UserID, q.UserID)
+	}
+	if q.Counterparty != 0 && q.UserID != 0 {
+		where = append(where, "((from_user_id = ? AND to_user_id = ?) OR (from_user_id = ? AND to_user_id = ?))")
+		args = append(args, q.UserID, q.Counterparty, q.Counterparty, q.UserID)
+	} else if q.Counterparty != 0 {
+		where = append(where, "(from_user_id = ? OR to_user_id = ?)")
+		args = append(args, q.Counterparty, q.Counterparty)
+	}
+	if len(q.Statuses) > 0 {
+		where = append(where, "status IN (?"+strings.Repeat(", ?", len(q.Statuses)-1)+")")
+		for _, status := range q.Statuses {
+			args = append(args, status)
+		}
+	}
+	if q.MinAmount != nil {
+		where = append(where, "amount >= ?")
+		args = append(args, *q.MinAmount)
+	}
+	if q.MaxAmount != nil {
+		where = append(where, "amount <= ?")
+		args = append(args, *q.MaxAmount)
+	}
+	if q.From != nil {
+		where = append(where, "created_at >= ?")
+		args = append(args, *q.From)
+	}
+	if q.To != nil {
+		where = append(where, "created_at < ?")
+		args = append(args, *q.To)
+	}
+	if q.BatchID != "" {
+		where = append(where, "batch_id = ?")
+		args = append(args, q.BatchID)
+	}
+	if q.Note != "" {
+		where = append(where, `LOWER(note) LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(strings.ToLower(q.Note))+"%")
+	}
+
+	filter := ""
+	if len(where) > 0 {
+		filter = "WHERE " + strings.Join(where, " AND ")
+	}
 
 	// Get total count
 	var total int
-	err := r.DB.QueryRow(`
-		SELECT COUNT(*) FROM transfers 
-		WHERE from_user_id = ? OR to_user_id = ?
-	`, userID, userID).Scan(&total)
+	err := r.queryRow("SELECT COUNT(*) FROM transfers "+filter, args...).Scan(&total)
 	if err != nil {
 		return nil, 0, err
 	}
 
+	// The cursor is the last row of the previous page, so new transfers
+	// cannot shift the pages that follow it
+	offset := (q.Page - 1) * q.PageSize
+	if q.After != nil {
+		cursor := "(created_at < ? OR (created_at = ? AND transfer_id < ?))"
+		if filter == "" {
+			filter = "WHERE " + cursor
+		} else {
+			filter += " AND " + cursor
+		}
+		args = append(args, q.After.CreatedAt, q.After.CreatedAt, q.After.TransferID)
+		offset = 0
+	}
+
 	// Get paginated data
-	rows, err := r.DB.Query(`
-		SELECT transfer_id, idempotency_key, from_user_id, to_user_id, amount, status, note, created_at, updated_at, completed_at, fail_reason
-		FROM transfers 
-		WHERE from_user_id = ? OR to_user_id = ?
-		ORDER BY created_at DESC
+	rows, err := r.query(`
+		SELECT transfer_id, idempotency_key, COALESCE(request_hash, ''), from_user_id, to_user_id, amount, status, note, created_at, updated_at, completed_at, expires_at, fail_reason, COALESCE(batch_id, ''), COALESCE(client_key, '')
+		FROM transfers `+filter+`
+		ORDER BY created_at DESC, transfer_id DESC
 		LIMIT ? OFFSET ?
-	`, userID, userID, pageSize, offset)
+	`, append(args, q.PageSize+1, offset)...)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer rows.Close()
 
-	var transfers []models.Transfer
-	for rows.Next() {
-		var t models.Transfer
-		err := rows.Scan(&t.TransferID, &t.IdemKey, &t.FromUserID, &t.ToUserID, &t.Amount, &t.Status, &t.Note, &t.CreatedAt, &t.UpdatedAt, &t.CompletedAt, &t.FailReason)
-		if err != nil {
-			return nil, 0, err
-		}
-		transfers = append(transfers, t)
+	transfers, err := scanTransfers(rows)
+	return transfers, total, err
+}
+
+func (r *transferRepository) ListByBatch(batchID string) ([]models.Transfer, error) {
+	rows, err := r.query(`
+		SELECT transfer_id, idempotency_key, COALESCE(request_hash, ''), from_user_id, to_user_id, amount, status, note, created_at, updated_at, completed_at, expires_at, fail_reason, COALESCE(batch_id, ''), COALESCE(client_key, '')
+		FROM transfers WHERE batch_id = ?
+		ORDER BY transfer_id
+	`, batchID)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return transfers, total, nil
+	return scanTransfers(rows)
 }
 
-func (r *TransferRepository) Create(tx *sql.Tx, transfer *models.Transfer) error {
-	result, err := tx.Exec(`
-		INSERT INTO transfers (idempotency_key, from_user_id, to_user_id, amount, status, note, created_at, updated_at, completed_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, transfer.IdemKey, transfer.FromUserID, transfer.ToUserID, transfer.Amount, transfer.Status, transfer.Note, transfer.CreatedAt, transfer.UpdatedAt, transfer.CompletedAt)
+func (r *transferRepository) Create(transfer *models.Transfer) error {
+	err := r.queryRow(`
+		INSERT INTO transfers (idempotency_key, request_hash, from_user_id, to_user_id, amount, status, note, created_at, updated_at, completed_at, expires_at, batch_id, client_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING transfer_id
+	`, transfer.IdemKey, transfer.RequestHash, transfer.FromUserID, transfer.ToUserID, transfer.Amount, string(transfer.Status), transfer.Note, transfer.CreatedAt, transfer.UpdatedAt, transfer.CompletedAt, transfer.ExpiresAt, nullString(transfer.BatchID), nullString(transfer.ClientKey)).Scan(&transfer.TransferID)
+
+	if r.isUniqueViolation(err) {
+		return ErrDuplicateIdemKey
+	}
+	return err
+}
 
+// UpdateStatus moves a transfer from one status to another. The update only
+// applies while the transfer is still in the from status, so a concurrent
+// change is reported as ErrStatusChanged instead of being overwritten.
+func (r *transferRepository) UpdateStatus(transfer *models.Transfer, from, to models.TransferStatus) error {
+	now := models.Now()
+	result, err := r.exec(`
+		UPDATE transfers SET status = ?, updated_at = ?, completed_at = ?, fail_reason = ?
+		WHERE transfer_id = ? AND status = ?
+	`, string(to), now, transfer.CompletedAt, transfer.FailReason, transfer.TransferID, string(from))
 	if err != nil {
 		return err
 	}
 
-	id, err := result.LastInsertId()
+	rows, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
 
-	transfer.TransferID = id
+	if rows == 0 {
+		return ErrStatusChanged
+	}
+
+	transfer.Status = to
+	transfer.UpdatedAt = now
 	return nil
 }
+
+func (r *transferRepository) CreateStatusHistory(h *models.TransferStatusHistory) error {
+	var fromStatus sql.NullString
+	if h.FromStatus != nil {
+		fromStatus = sql.NullString{String: string(*h.FromStatus), Valid: true}
+	}
+
+	return r.queryRow(`
+		INSERT INTO transfer_status_history (transfer_id, from_status, to_status, actor, reason, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, h.TransferID, fromStatus, string(h.ToStatus), h.Actor, h.Reason, h.CreatedAt).Scan(&h.ID)
+}
+
+func (r *transferRepository) GetStatusHistory(transferID int64) ([]models.TransferStatusHistory, error) {
+	rows, err := r.query(`
+		SELECT id, transfer_id, from_status, to_status, actor, COALESCE(reason, ''), created_at
+		FROM transfer_status_history
+		WHERE transfer_id = ?
+		ORDER BY id
+	`, transferID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []models.TransferStatusHistory
+	for rows.Next() {
+		var h models.TransferStatusHistory
+		err := rows.Scan(&h.ID, &h.TransferID, &h.FromStatus, &h.ToStatus, &h.Actor, &h.Reason, &h.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+
+	return history, rows.Err()
+}
+
+// ListExpiredPending returns the idempotency keys of pending transfers whose
+// hold expired before now.
+func (r *transferRepository) ListExpiredPending(now time.Time) ([]string, error) {
+	rows, err := r.query(`
+		SELECT idempotency_key FROM transfers
+		WHERE status = 'pending' AND expires_at < ?
+		ORDER BY transfer_id
+	`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (r *transferRepository) GetLastSent(fromUserID, toUserID int64) (*models.Transfer, error) {
+	query := `
+		SELECT transfer_id, idempotency_key, COALESCE(request_hash, ''), from_user_id, to_user_id, amount, status, note, created_at, updated_at, completed_at, expires_at, fail_reason, COALESCE(batch_id, ''), COALESCE(client_key, '')
+		FROM transfers
+		WHERE from_user_id = ? AND status IN ('completed', 'pending')`
+	args := []any{fromUserID}
+	if toUserID != 0 {
+		query += " AND to_user_id = ?"
+		args = append(args, toUserID)
+	}
+
+	t, err := scanTransfer(r.queryRow(query+" ORDER BY transfer_id DESC LIMIT 1", args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+func (r *transferRepository) SumSent(fromUserID int64, since time.Time) (amount int64, count int64, err error) {
+	err = r.queryRow(`
+		SELECT COALESCE(SUM(amount), 0), COUNT(*) FROM transfers
+		WHERE from_user_id = ? AND created_at >= ? AND status IN ('pending', 'processing', 'completed')
+	`, fromUserID, since).Scan(&amount, &count)
+	return amount, count, err
+}
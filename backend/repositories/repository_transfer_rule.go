@@ -0,0 +1,54 @@
+package repositories
+
+import (
+	"backend/models"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type transferRuleRepository struct {
+	conn
+}
+
+// Create stores an enabled rule. The settings of the rule are kept as JSON
+// in the params column.
+func (r *transferRuleRepository) Create(rule *models.TransferRule, createdAt time.Time) error {
+	settings := *rule
+	settings.ID, settings.Name, settings.Type = 0, "", ""
+	params, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	return r.queryRow(`
+		INSERT INTO transfer_rules (name, type, params, enabled, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		RETURNING id
+	`, rule.Name, rule.Type, string(params), true, createdAt).Scan(&rule.ID)
+}
+
+// ListEnabled returns the enabled rules in the order they were added.
+func (r *transferRuleRepository) ListEnabled() ([]models.TransferRule, error) {
+	rows, err := r.query("SELECT id, name, type, params FROM transfer_rules WHERE enabled = ? ORDER BY id", true)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []models.TransferRule
+	for rows.Next() {
+		var rule models.TransferRule
+		var id int64
+		var name, typ, params string
+		if err := rows.Scan(&id, &name, &typ, &params); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(params), &rule); err != nil {
+			return nil, fmt.Errorf("transfer rule %q: params: %w", name, err)
+		}
+		rule.ID, rule.Name, rule.Type = id, name, typ
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
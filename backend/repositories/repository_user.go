@@ -4,48 +4,144 @@ import (
 	"backend/models"
 	"database/sql"
 	"errors"
+	"strings"
+	"time"
 )
 
-type UserRepository struct {
-	db *sql.DB
-}
+var (
+	ErrUserNotFound        = errors.New("user not found")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+)
 
-func NewUserRepository(db *sql.DB) *UserRepository {
-	return &UserRepository{db: db}
+type userRepository struct {
+	conn
 }
 
-func (r *UserRepository) GetAll() ([]models.User, error) {
-	rows, err := r.db.Query(`
-		SELECT id, first_name, last_name, email, phone, avatar_url, bio, points_balance, created_at, updated_at 
-		FROM users
-	`)
+// List returns a page of the users matching q, ordered by q.Sort with the id
+// breaking ties and followed by the first user of the next page when there is
+// one, and the number of matching users; q.After skips the users up to and
+// including the cursor instead of q.Page. q must be checked by the caller:
+// Sort must be a key of models.UserSortFields.
+func (r *userRepository) List(q *models.UserListQuery) ([]models.User, int, error) {
+	var where []string
+	var args []interface{}
+
+	switch q.Status {
+	case "", string(models.UserActive):
+		where = append(where, "status = ?")
+		args = append(args, models.UserActive)
+	case string(models.UserClosed):
+		where = append(where, "status = ?")
+		args = append(args, models.UserClosed)
+	}
+	for _, word := range strings.Fields(strings.ToLower(q.Search)) {
+		pattern := "%" + likeEscaper.Replace(word) + "%"
+		where = append(where, `(LOWER(first_name) LIKE ? ESCAPE '\' OR LOWER(last_name) LIKE ? ESCAPE '\'
+			OR LOWER(email) LIKE ? ESCAPE '\' OR phone LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern, pattern, pattern)
+	}
+	if q.MinBalance != nil {
+		where = append(where, "points_balance >= ?")
+		args = append(args, *q.MinBalance)
+	}
+	if q.MaxBalance != nil {
+		where = append(where, "points_balance <= ?")
+		args = append(args, *q.MaxBalance)
+	}
+	if q.From != nil {
+		where = append(where, "created_at >= ?")
+		args = append(args, *q.From)
+	}
+	if q.To != nil {
+		where = append(where, "created_at < ?")
+		args = append(args, *q.To)
+	}
+
+	filter := ""
+	if len(where) > 0 {
+		filter = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	if err := r.queryRow("SELECT COUNT(*) FROM users "+filter, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	field, desc := strings.CutPrefix(q.Sort, "-")
+	column := models.UserSortFields[field]
+	if column == "" {
+		column = "id"
+	}
+	order, after := column+", id", ">"
+	if desc {
+		order, after = column+" DESC, id DESC", "<"
+	}
+
+	// The cursor is the last row of the previous page in the (sort key, id)
+	// order, so new users cannot shift the pages that follow it
+	offset := (q.Page - 1) * q.PageSize
+	if q.After != nil {
+		cursor := "(" + column + " " + after + " ? OR (" + column + " = ? AND id " + after + " ?))"
+		if filter == "" {
+			filter = "WHERE " + cursor
+		} else {
+			filter += " AND " + cursor
+		}
+		args = append(args, q.After.Key, q.After.Key, q.After.ID)
+		offset = 0
+	}
+
+	rows, err := r.query(`
+		SELECT id, first_name, last_name, email, phone, avatar_url, bio, points_balance, held_balance, role, locale, tier, status, closed_at, created_at, updated_at 
+		FROM users `+filter+`
+		ORDER BY `+order+`
+		LIMIT ? OFFSET ?
+	`, append(args, q.PageSize+1, offset)...)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer rows.Close()
 
 	var users []models.User
 	for rows.Next() {
 		var u models.User
-		err := rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.Phone, &u.AvatarURL, &u.Bio, &u.PointsBalance, &u.CreatedAt, &u.UpdatedAt)
+		err := rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.Phone, &u.AvatarURL, &u.Bio, &u.PointsBalance, &u.HeldBalance, &u.Role, &u.Locale, &u.Tier, &u.Status, &u.ClosedAt, &u.CreatedAt, &u.UpdatedAt)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		users = append(users, u)
 	}
 
-	return users, nil
+	return users, total, rows.Err()
 }
 
-func (r *UserRepository) GetByID(id int64) (*models.User, error) {
-	var u models.User
-	err := r.db.QueryRow(`
-		SELECT id, first_name, last_name, email, phone, avatar_url, bio, points_balance, created_at, updated_at 
+// likeEscaper escapes the wildcards of LIKE patterns, with \ as the escape
+// character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (r *userRepository) GetByID(id int64) (*models.User, error) {
+	return scanUser(r.queryRow(`
+		SELECT id, first_name, last_name, email, phone, avatar_url, bio, points_balance, held_balance, role, locale, tier, status, closed_at, created_at, updated_at 
 		FROM users WHERE id = ?
-	`, id).Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.Phone, &u.AvatarURL, &u.Bio, &u.PointsBalance, &u.CreatedAt, &u.UpdatedAt)
+	`, id))
+}
+
+// GetByIDForUpdate reads a user and locks the row until the surrounding
+// transaction ends. SQLite has no row locks; there the transaction already
+// holds the database write lock (BEGIN IMMEDIATE).
+func (r *userRepository) GetByIDForUpdate(id int64) (*models.User, error) {
+	return scanUser(r.queryRow(`
+		SELECT id, first_name, last_name, email, phone, avatar_url, bio, points_balance, held_balance, role, locale, tier, status, closed_at, created_at, updated_at 
+		FROM users WHERE id = ?
+	`+r.forUpdate(), id))
+}
+
+func scanUser(row *sql.Row) (*models.User, error) {
+	var u models.User
+	err := row.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.Phone, &u.AvatarURL, &u.Bio, &u.PointsBalance, &u.HeldBalance, &u.Role, &u.Locale, &u.Tier, &u.Status, &u.ClosedAt, &u.CreatedAt, &u.UpdatedAt)
 
 	if err == sql.ErrNoRows {
-		return nil, errors.New("user not found")
+		return nil, ErrUserNotFound
 	}
 	if err != nil {
 		return nil, err
@@ -54,32 +150,39 @@ func (r *UserRepository) GetByID(id int64) (*models.User, error) {
 	return &u, nil
 }
 
-func (r *UserRepository) Create(user *models.User) error {
-	result, err := r.db.Exec(`
-		INSERT INTO users (first_name, last_name, email, phone, avatar_url, bio, points_balance, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, user.FirstName, user.LastName, user.Email, user.Phone, user.AvatarURL, user.Bio, user.PointsBalance, user.CreatedAt, user.UpdatedAt)
+func (r *userRepository) Create(user *models.User) error {
+	return r.queryRow(`
+		INSERT INTO users (first_name, last_name, email, phone, avatar_url, bio, points_balance, role, locale, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, user.FirstName, user.LastName, user.Email, user.Phone, user.AvatarURL, user.Bio, user.PointsBalance, user.Role, user.Locale, user.Status, user.CreatedAt, user.UpdatedAt).Scan(&user.ID)
+}
+
+func (r *userRepository) Update(id int64, user *models.User) error {
+	result, err := r.exec(`
+		UPDATE users 
+		SET first_name = ?, last_name = ?, email = ?, phone = ?, avatar_url = ?, bio = ?, locale = ?, updated_at = ?
+		WHERE id = ?
+	`, user.FirstName, user.LastName, user.Email, user.Phone, user.AvatarURL, user.Bio, user.Locale, user.UpdatedAt, id)
 
 	if err != nil {
 		return err
 	}
 
-	id, err := result.LastInsertId()
+	rows, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
 
-	user.ID = id
+	if rows == 0 {
+		return ErrUserNotFound
+	}
+
 	return nil
 }
 
-func (r *UserRepository) Update(id int64, user *models.User) error {
-	result, err := r.db.Exec(`
-		UPDATE users 
-		SET first_name = ?, last_name = ?, email = ?, phone = ?, avatar_url = ?, bio = ?, updated_at = ?
-		WHERE id = ?
-	`, user.FirstName, user.LastName, user.Email, user.Phone, user.AvatarURL, user.Bio, user.UpdatedAt, id)
-
+func (r *userRepository) UpdateRole(id int64, role models.Role) error {
+	result, err := r.exec("UPDATE users SET role = ?, updated_at = ? WHERE id = ?", role, models.Now(), id)
 	if err != nil {
 		return err
 	}
@@ -90,14 +193,14 @@ func (r *UserRepository) Update(id int64, user *models.User) error {
 	}
 
 	if rows == 0 {
-		return errors.New("user not found")
+		return ErrUserNotFound
 	}
 
 	return nil
 }
 
-func (r *UserRepository) Delete(id int64) error {
-	result, err := r.db.Exec("DELETE FROM users WHERE id = ?", id)
+func (r *userRepository) UpdateTier(id int64, tier string) error {
+	result, err := r.exec("UPDATE users SET tier = ?, updated_at = ? WHERE id = ?", tier, models.Now(), id)
 	if err != nil {
 		return err
 	}
@@ -108,35 +211,99 @@ func (r *UserRepository) Delete(id int64) error {
 	}
 
 	if rows == 0 {
-		return errors.New("user not found")
+		return ErrUserNotFound
 	}
 
 	return nil
 }
 
-func (r *UserRepository) UpdateBalance(tx *sql.Tx, userID int64, amount int64) error {
-	_, err := tx.Exec("UPDATE users SET points_balance = points_balance + ?, updated_at = ? WHERE id = ?", amount, models.Now(), userID)
-	return err
+// UpdateStatus opens or closes an account; closedAt is nil when it is
+// reopened.
+func (r *userRepository) UpdateStatus(id int64, status models.UserStatus, closedAt *time.Time) error {
+	result, err := r.exec("UPDATE users SET status = ?, closed_at = ?, updated_at = ? WHERE id = ?", status, closedAt, models.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
 }
 
-func (r *UserRepository) GetBalance(tx *sql.Tx, userID int64) (int64, error) {
-	var balance int64
-	err := tx.QueryRow("SELECT points_balance FROM users WHERE id = ?", userID).Scan(&balance)
-	return balance, err
+// UpdateBalance adds amount to the user's balance. Debits (negative amounts)
+// are guarded so they never spend points that are held or not there;
+// ErrInsufficientBalance is returned when the guard rejects the update.
+func (r *userRepository) UpdateBalance(userID int64, amount int64) error {
+	if amount >= 0 {
+		_, err := r.exec("UPDATE users SET points_balance = points_balance + ?, updated_at = ? WHERE id = ?", amount, models.Now(), userID)
+		return err
+	}
+
+	result, err := r.exec(`
+		UPDATE users SET points_balance = points_balance - ?, updated_at = ?
+		WHERE id = ? AND points_balance - held_balance >= ?
+	`, -amount, models.Now(), userID, -amount)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrInsufficientBalance
+	}
+
+	return nil
 }
 
-func (r *UserRepository) GetLastTransferRecipient(fromUserID int64) (int64, error) {
-	var toUserID int64
-	err := r.db.QueryRow(`
-		SELECT to_user_id FROM transfers 
-		WHERE from_user_id = ? AND status = 'completed'
-		ORDER BY transfer_id DESC 
-		LIMIT 1
-	`, fromUserID).Scan(&toUserID)
+// UpdateHeldBalance places (positive amount) or releases (negative amount) a
+// hold on the user's points. A hold is guarded like a debit and returns
+// ErrInsufficientBalance when the spendable balance is too low.
+func (r *userRepository) UpdateHeldBalance(userID int64, amount int64) error {
+	if amount <= 0 {
+		_, err := r.exec("UPDATE users SET held_balance = held_balance + ?, updated_at = ? WHERE id = ?", amount, models.Now(), userID)
+		return err
+	}
 
-	if err == sql.ErrNoRows {
-		return 0, nil
+	result, err := r.exec(`
+		UPDATE users SET held_balance = held_balance + ?, updated_at = ?
+		WHERE id = ? AND points_balance - held_balance >= ?
+	`, amount, models.Now(), userID, amount)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
 	}
 
-	return toUserID, err
+	if rows == 0 {
+		return ErrInsufficientBalance
+	}
+
+	return nil
+}
+
+// ForceUpdateBalance adds amount to the user's balance without the overdraft
+// guard of UpdateBalance. It is only meant for privileged corrections.
+func (r *userRepository) ForceUpdateBalance(userID int64, amount int64) error {
+	_, err := r.exec("UPDATE users SET points_balance = points_balance + ?, updated_at = ? WHERE id = ?", amount, models.Now(), userID)
+	return err
+}
+
+func (r *userRepository) GetBalance(userID int64) (int64, error) {
+	var balance int64
+	err := r.queryRow("SELECT points_balance FROM users WHERE id = ?", userID).Scan(&balance)
+	return balance, err
 }
@@ -0,0 +1,154 @@
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Dialect selects the SQL flavour the repositories generate.
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+)
+
+func (d Dialect) String() string {
+	if d == Postgres {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+// DBTX is the part of *sql.DB and *sql.Tx the repositories need.
+type DBTX interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// conn runs queries written with ? placeholders against either dialect.
+type conn struct {
+	q       DBTX
+	dialect Dialect
+}
+
+func (c conn) exec(query string, args ...any) (sql.Result, error) {
+	return c.q.Exec(c.rebind(query), args...)
+}
+
+func (c conn) query(query string, args ...any) (*sql.Rows, error) {
+	return c.q.Query(c.rebind(query), args...)
+}
+
+func (c conn) queryRow(query string, args ...any) *sql.Row {
+	return c.q.QueryRow(c.rebind(query), args...)
+}
+
+func (c conn) rebind(query string) string {
+	return c.dialect.Rebind(query)
+}
+
+// Rebind rewrites the ? placeholders of query to $1, $2, ... for Postgres.
+func (d Dialect) Rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// forUpdate returns the row-locking clause for a SELECT. SQLite has no row
+// locks; its transactions take the write lock up front (BEGIN IMMEDIATE).
+func (c conn) forUpdate() string {
+	if c.dialect == Postgres {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+func (c conn) isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505"
+	}
+
+	return false
+}
+
+type sqlStore struct {
+	db *sql.DB
+	conn
+}
+
+// NewStore returns a Store backed by db, generating SQL for dialect.
+func NewStore(db *sql.DB, dialect Dialect) Store {
+	return &sqlStore{db: db, conn: conn{q: db, dialect: dialect}}
+}
+
+func (s *sqlStore) Users() UserRepository {
+	return &userRepository{conn: s.conn}
+}
+
+func (s *sqlStore) Transfers() TransferRepository {
+	return &transferRepository{conn: s.conn}
+}
+
+func (s *sqlStore) Ledger() LedgerRepository {
+	return &ledgerRepository{conn: s.conn}
+}
+
+func (s *sqlStore) Credentials() CredentialRepository {
+	return &credentialRepository{conn: s.conn}
+}
+
+func (s *sqlStore) APIKeys() APIKeyRepository {
+	return &apiKeyRepository{conn: s.conn}
+}
+
+func (s *sqlStore) TransferRules() TransferRuleRepository {
+	return &transferRuleRepository{conn: s.conn}
+}
+
+func (s *sqlStore) Limits() LimitRepository {
+	return &limitRepository{conn: s.conn}
+}
+
+func (s *sqlStore) WithTx(fn func(tx Store) error) error {
+	if s.db == nil {
+		// Already inside a transaction
+		return fn(s)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(&sqlStore{conn: conn{q: tx, dialect: s.dialect}}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
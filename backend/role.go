@@ -0,0 +1,43 @@
+package main
+
+import (
+	"backend/config"
+	"backend/models"
+	"backend/repositories"
+	"backend/services"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+const roleUsage = "usage: backend [flags] role <user-id> user|support|admin"
+
+// runRole implements the role subcommand, which sets the role of a user. It
+// is how the first admin is created; after that admins can use
+// PUT /api/users/:id/role.
+func runRole(cfg *config.Config, args []string) {
+	if len(args) != 2 {
+		log.Fatal(roleUsage)
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		log.Fatal(roleUsage)
+	}
+
+	db, dialect, err := InitDB(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatal("Failed to initialize database:", err)
+	}
+	defer db.Close()
+
+	if err := Migrate(db, dialect); err != nil {
+		log.Fatal("Failed to run migrations:", err)
+	}
+
+	users := services.NewUserService(repositories.NewStore(db, dialect))
+	user, err := users.SetRole(id, models.Role(args[1]))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("user %d is now %s\n", user.ID, user.Role)
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"backend/i18n"
+	"backend/validation"
+	"strings"
+)
+
+// Error is a domain error with a stable, machine-readable code. Services
+// return the sentinels below, or a copy made by With or Variant that carries
+// the parameters of its message; callers match both with errors.Is and the
+// handlers map the code to an HTTP status.
+//
+// Messages are rendered from the i18n catalogs. Error returns the English
+// text; the handlers render the caller's language.
+type Error struct {
+	Code string
+	// Key is the catalog key of the message; it defaults to Code
+	Key    string
+	Params i18n.Params
+
+	sentinel *Error
+}
+
+func newError(code string) *Error {
+	return &Error{Code: code, Key: code}
+}
+
+func (e *Error) Error() string {
+	return i18n.T(i18n.English, e.Key, e.Params)
+}
+
+// Is matches the sentinel an error was made from.
+func (e *Error) Is(target error) bool {
+	return e.sentinel != nil && e.sentinel == target
+}
+
+// With returns an error matching e whose message is filled in with params.
+func (e *Error) With(params i18n.Params) *Error {
+	return e.Variant(e.Key, params)
+}
+
+// Variant returns an error matching e that is reported with another message.
+func (e *Error) Variant(key string, params i18n.Params) *Error {
+	sentinel := e
+	if e.sentinel != nil {
+		sentinel = e.sentinel
+	}
+	return &Error{Code: e.Code, Key: key, Params: params, sentinel: sentinel}
+}
+
+// Message renders the error in lang.
+func (e *Error) Message(lang string) string {
+	return i18n.T(lang, e.Key, e.Params)
+}
+
+var (
+	ErrUserNotFound                 = newError("user_not_found")
+	ErrInsufficientBalance          = newError("insufficient_balance")
+	ErrSameRecipient                = newError("same_recipient")
+	ErrTransferNotFound             = newError("transfer_not_found")
+	ErrIllegalTransition            = newError("illegal_transition")
+	ErrTransferExpired              = newError("transfer_expired")
+	ErrRecipientInsufficientBalance = newError("recipient_insufficient_balance")
+	ErrInvalidQuery                 = newError("invalid_query")
+	ErrValidation                   = newError("validation_failed")
+	ErrPreconditionFailed           = newError("precondition_failed")
+	ErrAccountClosed                = newError("account_closed")
+	ErrBalanceRemaining             = newError("balance_remaining")
+	ErrPendingHolds                 = newError("pending_holds")
+	ErrInvalidCSV                   = newError("invalid_csv")
+	ErrInvalidBody                  = newError("invalid_body")
+	ErrUnsupportedMediaType         = newError("unsupported_media_type")
+
+	// Rejections of the transfer rules; see RuleError
+	ErrAmountBelowMinimum    = newError("amount_below_minimum")
+	ErrAmountAboveMaximum    = newError("amount_above_maximum")
+	ErrDailyLimitExceeded    = newError("daily_limit_exceeded")
+	ErrWeeklyLimitExceeded   = newError("weekly_limit_exceeded")
+	ErrTransferBlocked       = newError("transfer_blocked")
+	ErrOutsideTransferWindow = newError("outside_transfer_window")
+	ErrTransferLimitExceeded = newError("transfer_limit_exceeded")
+
+	ErrIdempotencyKeyReused     = newError("idempotency_key_reused")
+	ErrIdempotencyKeyInProgress = newError("idempotency_key_in_progress")
+	ErrInvalidIdempotencyKey    = newError("invalid_idempotency_key")
+
+	ErrUnauthenticated    = newError("unauthenticated")
+	ErrInvalidCredentials = newError("invalid_credentials")
+	ErrInvalidToken       = newError("invalid_token")
+	ErrForbidden          = newError("permission_denied")
+	ErrUsernameTaken      = newError("username_taken")
+	ErrInvalidAPIKey      = newError("invalid_api_key")
+	ErrAPIKeyNotFound     = newError("api_key_not_found")
+)
+
+// FieldError describes what is wrong with one field of a request. Code is
+// stable; Message is rendered from the catalog key "field.<code>".
+type FieldError struct {
+	Field   string      `json:"field"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Params  i18n.Params `json:"-"`
+}
+
+// Localize renders the message of f in lang.
+func (f FieldError) Localize(lang string) FieldError {
+	f.Message = i18n.T(lang, "field."+f.Code, f.Params)
+	return f
+}
+
+// ValidationError lists every invalid field of a request. It matches
+// ErrValidation with errors.Is.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// Add records a problem with field; code selects the message.
+func (e *ValidationError) Add(field, code string, params i18n.Params) {
+	f := FieldError{Field: field, Code: code, Params: params}
+	e.Fields = append(e.Fields, f.Localize(i18n.English))
+}
+
+// Err returns e when it has recorded any problem and nil otherwise.
+func (e *ValidationError) Err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Invalid returns a ValidationError listing violations, or nil when there
+// are none.
+func Invalid(violations []validation.Violation) error {
+	return validate(violations).Err()
+}
+
+// validate starts a ValidationError with violations; services check their
+// requests with validate(validation.Struct(req)) and add the checks that need
+// state before calling Err.
+func validate(violations []validation.Violation) *ValidationError {
+	invalid := &ValidationError{}
+	for _, v := range violations {
+		invalid.Add(v.Field, v.Code, v.Params)
+	}
+	return invalid
+}
+
+// invalidField returns a ValidationError for a single field.
+func invalidField(field, code string, params i18n.Params) error {
+	v := &ValidationError{}
+	v.Add(field, code, params)
+	return v
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"backend/i18n"
+	"backend/models"
+	"backend/repositories"
+	"backend/validation"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// apiKeyScheme starts every API key. A key reads pk_<prefix>_<secret>: the
+// prefix finds the key and stays visible in listings, the secret is random.
+const apiKeyScheme = "pk_"
+
+// APIKeyService issues and verifies the API keys of partner integrations.
+// Keys carry 256 random bits, so a SHA-256 hash is enough to store them.
+type APIKeyService struct {
+	store repositories.Store
+}
+
+func NewAPIKeyService(store repositories.Store) *APIKeyService {
+	return &APIKeyService{store: store}
+}
+
+// Create issues a key for the owner with the given scopes. The raw key is in
+// the response and cannot be retrieved again.
+func (s *APIKeyService) Create(req *models.CreateAPIKeyRequest) (*models.CreateAPIKeyResponse, error) {
+	invalid := validate(validation.Struct(req))
+	for _, scope := range req.Scopes {
+		if !scope.Valid() {
+			invalid.Add("scopes", "unknown_scope", i18n.Params{"scope": scope})
+		}
+	}
+	if err := invalid.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.store.Users().GetByID(req.OwnerID); err != nil {
+		if errors.Is(err, repositories.ErrUserNotFound) {
+			return nil, ErrUserNotFound.With(i18n.Params{"id": req.OwnerID})
+		}
+		return nil, err
+	}
+
+	prefix, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return nil, err
+	}
+	raw := apiKeyScheme + prefix + "_" + secret
+
+	key := &models.APIKey{
+		Name:       req.Name,
+		Prefix:     prefix,
+		SecretHash: hashAPIKey(raw),
+		OwnerID:    req.OwnerID,
+		Scopes:     req.Scopes,
+		CreatedAt:  models.Now(),
+	}
+	if err := s.store.APIKeys().Create(key); err != nil {
+		return nil, err
+	}
+
+	return &models.CreateAPIKeyResponse{APIKey: *key, Key: raw}, nil
+}
+
+func (s *APIKeyService) List() ([]models.APIKey, error) {
+	return s.store.APIKeys().List()
+}
+
+func (s *APIKeyService) Revoke(id int64) error {
+	err := s.store.APIKeys().Revoke(id, models.Now())
+	if errors.Is(err, repositories.ErrAPIKeyNotFound) {
+		return ErrAPIKeyNotFound.With(i18n.Params{"id": id})
+	}
+	return err
+}
+
+// Verify checks a raw key and returns the caller it identifies: the owner of
+// the key, limited to its scopes. Revoked keys are rejected.
+func (s *APIKeyService) Verify(raw string) (*models.Principal, error) {
+	rest, ok := strings.CutPrefix(raw, apiKeyScheme)
+	prefix, _, found := strings.Cut(rest, "_")
+	if !ok || !found {
+		return nil, ErrInvalidAPIKey
+	}
+
+	key, err := s.store.APIKeys().GetByPrefix(prefix)
+	if errors.Is(err, repositories.ErrAPIKeyNotFound) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(raw)), []byte(key.SecretHash)) != 1 || key.RevokedAt != nil {
+		return nil, ErrInvalidAPIKey
+	}
+
+	// Keys act as their owner, so they stop working when the owner is closed
+	owner, err := s.store.Users().GetByID(key.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	if owner.Status == models.UserClosed {
+		return nil, ErrInvalidAPIKey
+	}
+
+	if err := s.store.APIKeys().TouchLastUsed(key.ID, models.Now()); err != nil {
+		return nil, err
+	}
+
+	return &models.Principal{UserID: key.OwnerID, APIKeyID: key.ID, Scopes: key.Scopes}, nil
+}
+
+func hashAPIKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int, encode func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encode(b), nil
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"backend/i18n"
+	"backend/models"
+	"backend/repositories"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// DefaultTokenTTL is how long an access token issued by Login is valid.
+	DefaultTokenTTL = time.Hour
+
+	// TokenIssuer is the iss claim of every access token.
+	TokenIssuer = "points-api"
+)
+
+// dummyHash is compared against when the username does not exist, so a failed
+// login takes the same time whether or not the user is registered.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+
+type AuthService struct {
+	store      repositories.Store
+	users      *UserService
+	signingKey []byte
+	tokenTTL   time.Duration
+}
+
+func NewAuthService(store repositories.Store, users *UserService, signingKey []byte) *AuthService {
+	return &AuthService{
+		store:      store,
+		users:      users,
+		signingKey: signingKey,
+		tokenTTL:   DefaultTokenTTL,
+	}
+}
+
+func (s *AuthService) SetTokenTTL(ttl time.Duration) {
+	s.tokenTTL = ttl
+}
+
+// Register creates a user together with its login.
+func (s *AuthService) Register(req *models.RegisterRequest) (*models.User, error) {
+	// The user service's validator knows the rules of the profile fields
+	if err := Invalid(s.users.validator.Struct(req)); err != nil {
+		return nil, err
+	}
+	user, err := s.users.newUser(&req.CreateUserRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.store.WithTx(func(tx repositories.Store) error {
+		if err := tx.Users().Create(user); err != nil {
+			return err
+		}
+
+		return tx.Credentials().Create(&models.Credential{
+			UserID:       user.ID,
+			Username:     req.Username,
+			PasswordHash: string(hash),
+			CreatedAt:    user.CreatedAt,
+			UpdatedAt:    user.UpdatedAt,
+		})
+	})
+	if errors.Is(err, repositories.ErrDuplicateUsername) {
+		return nil, ErrUsernameTaken.With(i18n.Params{"username": req.Username})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Login checks the username and password and issues an access token.
+func (s *AuthService) Login(req *models.LoginRequest) (*models.TokenResponse, error) {
+	cred, err := s.store.Credentials().GetByUsername(req.Username)
+	if errors.Is(err, repositories.ErrCredentialNotFound) {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(req.Password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(cred.PasswordHash), []byte(req.Password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	user, err := s.store.Users().GetByID(cred.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Status == models.UserClosed {
+		return nil, ErrAccountClosed.With(i18n.Params{"id": user.ID})
+	}
+
+	token, err := s.IssueToken(cred.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(s.tokenTTL / time.Second),
+	}, nil
+}
+
+// IssueToken signs an HS256 access token for the user.
+func (s *AuthService) IssueToken(userID int64) (string, error) {
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Issuer:    TokenIssuer,
+		Subject:   strconv.FormatInt(userID, 10),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(s.tokenTTL)),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.signingKey)
+}
+
+// VerifyToken checks the signature, issuer and expiry of an access token and
+// returns the caller it identifies. The role is read from the database on
+// every call so role changes apply to tokens already issued, and tokens of
+// deleted or closed users stop working.
+func (s *AuthService) VerifyToken(token string) (*models.Principal, error) {
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return s.signingKey, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(TokenIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID < 1 {
+		return nil, fmt.Errorf("%w: bad subject", ErrInvalidToken)
+	}
+
+	user, err := s.store.Users().GetByID(userID)
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		return nil, fmt.Errorf("%w: user no longer exists", ErrInvalidToken)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Status == models.UserClosed {
+		return nil, fmt.Errorf("%w: account is closed", ErrInvalidToken)
+	}
+
+	return &models.Principal{UserID: userID, Role: user.Role, Locale: user.Locale}, nil
+}
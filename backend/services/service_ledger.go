@@ -0,0 +1,165 @@
+package services
+
+import (
+	"backend/i18n"
+	"backend/models"
+	"backend/repositories"
+	"errors"
+	"time"
+)
+
+var ledgerEventTypes = map[string]bool{
+	"transfer_out": true,
+	"transfer_in":  true,
+	"adjust":       true,
+	"earn":         true,
+	"redeem":       true,
+}
+
+// statementFormats are the formats an account statement is exported in.
+var statementFormats = map[string]bool{
+	"csv":   true,
+	"jsonl": true,
+	"html":  true,
+}
+
+// statementPageSize is the number of entries a statement reads at a time.
+// The connection is given back between pages, so a slow download does not
+// hold it.
+const statementPageSize = 500
+
+// DefaultLedgerLimit is the number of ledger entries returned per page when
+// the client does not ask for a limit.
+const DefaultLedgerLimit = 50
+
+type LedgerService struct {
+	store        repositories.Store
+	defaultLimit int
+	maxLimit     int
+}
+
+func NewLedgerService(store repositories.Store) *LedgerService {
+	return &LedgerService{
+		store:        store,
+		defaultLimit: DefaultLedgerLimit,
+		maxLimit:     MaxPageSize,
+	}
+}
+
+func (s *LedgerService) SetLimit(defaultLimit, maxLimit int) {
+	s.defaultLimit = defaultLimit
+	s.maxLimit = maxLimit
+}
+
+func (s *LedgerService) List(q *models.LedgerListQuery) (*models.LedgerListResponse, error) {
+	if q.EventType != "" && !ledgerEventTypes[q.EventType] {
+		return nil, ErrInvalidQuery.Variant("unknown_event_type", i18n.Params{"value": q.EventType})
+	}
+	if q.From != nil && q.To != nil && !q.From.Before(*q.To) {
+		return nil, ErrInvalidQuery.Variant("from_after_to", nil)
+	}
+	if q.Limit < 1 || q.Limit > s.maxLimit {
+		q.Limit = s.defaultLimit
+	}
+
+	if _, err := s.store.Users().GetByID(q.UserID); err != nil {
+		if errors.Is(err, repositories.ErrUserNotFound) {
+			return nil, ErrUserNotFound.With(i18n.Params{"id": q.UserID})
+		}
+		return nil, err
+	}
+
+	// Fetch one extra row to know whether another page exists
+	limit := q.Limit
+	q.Limit = limit + 1
+	entries, err := s.store.Ledger().List(q)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &models.LedgerListResponse{
+		Data:  entries,
+		Limit: limit,
+	}
+	if len(entries) > limit {
+		resp.Data = entries[:limit]
+		nextCursor := resp.Data[limit-1].ID
+		resp.NextCursor = &nextCursor
+	}
+	if resp.Data == nil {
+		resp.Data = []models.PointLedger{}
+	}
+
+	return resp, nil
+}
+
+// Statement checks q and returns the header of the statement. Without From
+// the period starts on the first of the month of To, and without To it ends
+// now; a later To is moved to now so the closing balance is final.
+func (s *LedgerService) Statement(q *models.StatementQuery) (*models.Statement, error) {
+	if q.Format == "" {
+		q.Format = "csv"
+	}
+	if !statementFormats[q.Format] {
+		return nil, ErrInvalidQuery.Variant("unknown_value", i18n.Params{"name": "format", "value": q.Format})
+	}
+
+	now := models.Now()
+	to := now
+	if q.To != nil && q.To.Before(now) {
+		to = *q.To
+	}
+	// The period ends before To, so the default month is that of the instant
+	// before it: to=2026-10-01 gives the statement of September
+	last := to.Add(-time.Nanosecond)
+	from := time.Date(last.Year(), last.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if q.From != nil {
+		from = *q.From
+	}
+	if !from.Before(to) {
+		return nil, ErrInvalidQuery.Variant("from_after_to", nil)
+	}
+
+	st := &models.Statement{From: from, To: to, Format: q.Format}
+	// Ledger entries are written with the user locked, so locking it waits
+	// for transfers in flight and the balances agree with the entries up to
+	// LastEntryID
+	err := s.store.WithTx(func(tx repositories.Store) error {
+		user, err := tx.Users().GetByIDForUpdate(q.UserID)
+		if err != nil {
+			return err
+		}
+		st.User = user
+		st.OpeningBalance, st.ClosingBalance, st.LastEntryID, err = tx.Ledger().Balances(user.ID, from, to)
+		return err
+	})
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		return nil, ErrUserNotFound.With(i18n.Params{"id": q.UserID})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// StreamStatement calls fn with each entry of st, oldest first, without
+// holding the whole period in memory. The entries are read a page at a time
+// and no query is open while fn runs.
+func (s *LedgerService) StreamStatement(st *models.Statement, fn func(*models.StatementEntry) error) error {
+	var afterID int64
+	for {
+		entries, err := s.store.Ledger().Statement(st.User.ID, st.From, st.To, afterID, st.LastEntryID, statementPageSize)
+		if err != nil {
+			return err
+		}
+		for i := range entries {
+			if err := fn(&entries[i]); err != nil {
+				return err
+			}
+		}
+		if len(entries) < statementPageSize {
+			return nil
+		}
+		afterID = entries[len(entries)-1].ID
+	}
+}
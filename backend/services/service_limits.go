@@ -0,0 +1,165 @@
+package services
+
+import (
+	"backend/i18n"
+	"backend/models"
+	"backend/repositories"
+	"backend/validation"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultTier is the limit tier of users that have none.
+const DefaultTier = "standard"
+
+const (
+	// LimitDay and LimitMonth are the rolling windows the transfer limits
+	// count over.
+	LimitDay   = 24 * time.Hour
+	LimitMonth = 30 * 24 * time.Hour
+)
+
+// SetLimitTiers replaces the transfer limits of each tier; users without a
+// tier get those of defaultTier, which must be one of tiers.
+func (s *TransferService) SetLimitTiers(tiers map[string]models.TransferLimits, defaultTier string) {
+	s.tiers = tiers
+	s.defaultTier = defaultTier
+}
+
+// tierNames lists the tiers in a stable order, for messages.
+func (s *TransferService) tierNames() []string {
+	names := make([]string, 0, len(s.tiers))
+	for name := range s.tiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// userLimits returns the effective tier and limits of user and the overrides
+// they are built from.
+func (s *TransferService) userLimits(store repositories.Store, user *models.User) (string, models.TransferLimits, *models.LimitOverrides, error) {
+	tier := user.Tier
+	if _, ok := s.tiers[tier]; !ok {
+		// Users of a tier that was removed from the config fall back too
+		tier = s.defaultTier
+	}
+
+	overrides, err := store.Limits().Get(user.ID)
+	if err != nil {
+		return "", models.TransferLimits{}, nil, err
+	}
+	return tier, overrides.Apply(s.tiers[tier]), overrides, nil
+}
+
+// checkLimits rejects sending amount when it would take the sender over a
+// limit of the rolling day or month. It runs inside the transfer
+// transaction, after the sender is locked, so concurrent transfers are
+// counted.
+func (s *TransferService) checkLimits(tx repositories.Store, sender *models.User, amount int64, now time.Time) error {
+	_, limits, _, err := s.userLimits(tx, sender)
+	if err != nil {
+		return err
+	}
+
+	windows := []struct {
+		length        time.Duration
+		amount, count int64
+		amountRule    string
+		countRule     string
+	}{
+		{LimitDay, limits.DailyAmount, limits.DailyCount, "daily_amount", "daily_count"},
+		{LimitMonth, limits.MonthlyAmount, limits.MonthlyCount, "monthly_amount", "monthly_count"},
+	}
+	for _, w := range windows {
+		if w.amount == 0 && w.count == 0 {
+			continue
+		}
+		sent, count, err := tx.Transfers().SumSent(sender.ID, now.Add(-w.length))
+		if err != nil {
+			return err
+		}
+		if w.amount > 0 && sent+amount > w.amount {
+			return &RuleError{Rule: w.amountRule, Type: "transfer_limit", Err: ErrTransferLimitExceeded.Variant(
+				"limit_"+w.amountRule, i18n.Params{"limit": w.amount, "remaining": max(w.amount-sent, 0)})}
+		}
+		if w.count > 0 && count+1 > w.count {
+			return &RuleError{Rule: w.countRule, Type: "transfer_limit", Err: ErrTransferLimitExceeded.Variant(
+				"limit_"+w.countRule, i18n.Params{"limit": w.count})}
+		}
+	}
+	return nil
+}
+
+// GetLimits returns the limits of a user and how much of them the transfers
+// of the last day and month used.
+func (s *TransferService) GetLimits(userID int64) (*models.UserLimitsResponse, error) {
+	user, err := s.store.Users().GetByID(userID)
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		return nil, ErrUserNotFound.With(i18n.Params{"id": userID})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tier, limits, overrides, err := s.userLimits(s.store, user)
+	if err != nil {
+		return nil, err
+	}
+
+	now := models.Now()
+	resp := &models.UserLimitsResponse{UserID: userID, Tier: tier, Limits: limits, Overrides: *overrides}
+	for _, w := range []struct {
+		window        *models.LimitWindow
+		length        time.Duration
+		amount, count int64
+	}{
+		{&resp.Daily, LimitDay, limits.DailyAmount, limits.DailyCount},
+		{&resp.Monthly, LimitMonth, limits.MonthlyAmount, limits.MonthlyCount},
+	} {
+		since := now.Add(-w.length)
+		sent, count, err := s.store.Transfers().SumSent(userID, since)
+		if err != nil {
+			return nil, err
+		}
+		*w.window = models.LimitWindow{Since: since, Amount: limitUsage(w.amount, sent), Count: limitUsage(w.count, count)}
+	}
+	return resp, nil
+}
+
+func limitUsage(limit, used int64) models.LimitUsage {
+	usage := models.LimitUsage{Used: used}
+	if limit > 0 {
+		remaining := max(limit-used, 0)
+		usage.Limit = &limit
+		usage.Remaining = &remaining
+	}
+	return usage
+}
+
+// SetLimits puts a user in a tier and replaces their overrides.
+func (s *TransferService) SetLimits(userID int64, req *models.SetLimitsRequest) (*models.UserLimitsResponse, error) {
+	invalid := validate(validation.Struct(req))
+	if _, ok := s.tiers[req.Tier]; req.Tier != "" && !ok {
+		invalid.Add("tier", "one_of", i18n.Params{"values": strings.Join(s.tierNames(), ", ")})
+	}
+	if err := invalid.Err(); err != nil {
+		return nil, err
+	}
+
+	err := s.store.WithTx(func(tx repositories.Store) error {
+		if err := tx.Users().UpdateTier(userID, req.Tier); err != nil {
+			return err
+		}
+		return tx.Limits().Set(userID, &req.LimitOverrides, models.Now())
+	})
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		return nil, ErrUserNotFound.With(i18n.Params{"id": userID})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.GetLimits(userID)
+}
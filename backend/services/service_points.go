@@ -0,0 +1,153 @@
+package services
+
+import (
+	"backend/i18n"
+	"backend/models"
+	"backend/repositories"
+	"backend/validation"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type PointsService struct {
+	store         repositories.Store
+	idemRetention time.Duration
+}
+
+func NewPointsService(store repositories.Store) *PointsService {
+	return &PointsService{
+		store:         store,
+		idemRetention: DefaultIdempotencyRetention,
+	}
+}
+
+func (s *PointsService) SetIdempotencyRetention(retention time.Duration) {
+	s.idemRetention = retention
+}
+
+// Earn credits req.Amount points to the user.
+func (s *PointsService) Earn(userID int64, req *models.PointsRequest, idemKey string) (*models.PointLedger, bool, error) {
+	if err := Invalid(validation.Struct(req)); err != nil {
+		return nil, false, err
+	}
+	return s.apply(userID, "earn", req.Amount, req, idemKey)
+}
+
+// Redeem debits req.Amount points from the user; the balance may not go negative.
+func (s *PointsService) Redeem(userID int64, req *models.PointsRequest, idemKey string) (*models.PointLedger, bool, error) {
+	if err := Invalid(validation.Struct(req)); err != nil {
+		return nil, false, err
+	}
+	return s.apply(userID, "redeem", -req.Amount, req, idemKey)
+}
+
+// Adjust applies a signed correction to the user's balance.
+func (s *PointsService) Adjust(userID int64, req *models.AdjustPointsRequest, idemKey string) (*models.PointLedger, bool, error) {
+	if err := Invalid(validation.Struct(req)); err != nil {
+		return nil, false, err
+	}
+	return s.apply(userID, "adjust", req.Amount, (*models.PointsRequest)(req), idemKey)
+}
+
+func (s *PointsService) apply(userID int64, eventType string, change int64, req *models.PointsRequest, idemKey string) (*models.PointLedger, bool, error) {
+	requestHash := hashPointsRequest(userID, eventType, req)
+	if idemKey != "" {
+		if len(idemKey) < 8 || len(idemKey) > 128 {
+			return nil, false, ErrInvalidIdempotencyKey
+		}
+
+		existing, err := s.replayEntry(userID, idemKey, requestHash)
+		if err != nil || existing != nil {
+			return existing, existing != nil, err
+		}
+	}
+
+	var entry *models.PointLedger
+	err := s.store.WithTx(func(tx repositories.Store) error {
+		users, err := lockUsers(tx, userID)
+		if err != nil {
+			return err
+		}
+		if err := checkOpen(users, userID); err != nil {
+			return err
+		}
+
+		err = tx.Users().UpdateBalance(userID, change)
+		if errors.Is(err, repositories.ErrInsufficientBalance) {
+			return ErrInsufficientBalance.With(i18n.Params{"amount": -change})
+		}
+		if err != nil {
+			return err
+		}
+
+		balance, err := tx.Users().GetBalance(userID)
+		if err != nil {
+			return err
+		}
+
+		entry = &models.PointLedger{
+			UserID:       userID,
+			Change:       change,
+			BalanceAfter: balance,
+			EventType:    eventType,
+			Reference:    req.Reference,
+			Metadata:     string(req.Metadata),
+			IdemKey:      idemKey,
+			RequestHash:  requestHash,
+			CreatedAt:    models.Now(),
+		}
+		if idemKey != "" && s.idemRetention > 0 {
+			// A key past the retention is freed for this entry
+			if err := tx.Ledger().ReleaseIdemKey(userID, idemKey, entry.CreatedAt.Add(-s.idemRetention)); err != nil {
+				return err
+			}
+		}
+		err = tx.Ledger().Create(entry)
+		if errors.Is(err, repositories.ErrDuplicateIdemKey) {
+			return ErrIdempotencyKeyInProgress
+		}
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return entry, false, nil
+}
+
+// replayEntry returns the ledger entry of userID previously written with
+// idemKey, or nil when the key has not been used yet. A key older than the
+// retention is treated as unused and freed when the new entry is written.
+func (s *PointsService) replayEntry(userID int64, idemKey, requestHash string) (*models.PointLedger, error) {
+	existing, err := s.store.Ledger().GetByIdemKey(userID, idemKey)
+	if err != nil || existing == nil {
+		return nil, err
+	}
+
+	if s.idemRetention > 0 && models.Now().Sub(existing.CreatedAt) > s.idemRetention {
+		return nil, nil
+	}
+	if existing.RequestHash != requestHash {
+		return nil, ErrIdempotencyKeyReused
+	}
+
+	return existing, nil
+}
+
+// ReleaseIdempotencyKeys frees the Idempotency-Keys of ledger entries older
+// than the retention, so they can be used again, and returns how many were
+// freed.
+func (s *PointsService) ReleaseIdempotencyKeys(now time.Time) (int64, error) {
+	if s.idemRetention <= 0 {
+		return 0, nil
+	}
+	return s.store.Ledger().ReleaseIdemKeys(now.Add(-s.idemRetention))
+}
+
+func hashPointsRequest(userID int64, eventType string, req *models.PointsRequest) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%s|%d|%s|%s", userID, eventType, req.Amount, req.Reference, req.Metadata)))
+	return hex.EncodeToString(sum[:])
+}
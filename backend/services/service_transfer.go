@@ -1,144 +1,418 @@
 package services
 
 import (
+	"backend/i18n"
 	"backend/models"
 	"backend/repositories"
+	"backend/validation"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+const (
+	// DefaultIdempotencyRetention is how long a client-supplied Idempotency-Key
+	// replays its original transfer before it is considered expired.
+	DefaultIdempotencyRetention = 24 * time.Hour
+
+	// DefaultHoldTTL is how long a pending transfer keeps its hold before it
+	// is cancelled automatically.
+	DefaultHoldTTL = 15 * time.Minute
+
+	// DefaultPageSize and MaxPageSize bound the pages of list endpoints.
+	DefaultPageSize = 20
+	MaxPageSize     = 200
+)
+
 type TransferService struct {
-	transferRepo *repositories.TransferRepository
-	ledgerRepo   *repositories.LedgerRepository
-	userRepo     *repositories.UserRepository
+	store             repositories.Store
+	idemRetention     time.Duration
+	holdTTL           time.Duration
+	defaultPageSize   int
+	maxPageSize       int
+	noRepeatRecipient bool
+	rules             []*transferRule
+	tiers             map[string]models.TransferLimits
+	defaultTier       string
 }
 
-func NewTransferService(transferRepo *repositories.TransferRepository, ledgerRepo *repositories.LedgerRepository, userRepo *repositories.UserRepository) *TransferService {
+func NewTransferService(store repositories.Store) *TransferService {
 	return &TransferService{
-		transferRepo: transferRepo,
-		ledgerRepo:   ledgerRepo,
-		userRepo:     userRepo,
+		store:             store,
+		idemRetention:     DefaultIdempotencyRetention,
+		holdTTL:           DefaultHoldTTL,
+		defaultPageSize:   DefaultPageSize,
+		maxPageSize:       MaxPageSize,
+		noRepeatRecipient: true,
+		tiers:             map[string]models.TransferLimits{DefaultTier: {}},
+		defaultTier:       DefaultTier,
 	}
 }
 
-func (s *TransferService) CreateTransfer(req *models.CreateTransferRequest) (*models.Transfer, error) {
-	// Generate idempotency key (idemKey)
-	idemKey := uuid.New().String()
+func (s *TransferService) SetIdempotencyRetention(retention time.Duration) {
+	s.idemRetention = retention
+}
+
+func (s *TransferService) SetHoldTTL(ttl time.Duration) {
+	s.holdTTL = ttl
+}
+
+func (s *TransferService) SetPageSize(defaultSize, maxSize int) {
+	s.defaultPageSize = defaultSize
+	s.maxPageSize = maxSize
+}
+
+// SetNoRepeatRecipient toggles the rule that rejects a transfer to the
+// sender's previous recipient.
+func (s *TransferService) SetNoRepeatRecipient(enabled bool) {
+	s.noRepeatRecipient = enabled
+}
+
+// CreateTransfer moves points between two users. When idemKey is empty a new
+// key is generated; otherwise a previous transfer of the sender with the same
+// key and payload is returned with replayed set to true instead of moving
+// points again. Keys are unique per sender, and the transfer gets an ID of its
+// own. The key used is returned.
+func (s *TransferService) CreateTransfer(req *models.CreateTransferRequest, idemKey string) (transfer *models.Transfer, key string, replayed bool, err error) {
+	requestHash := hashTransferRequest(req)
+	transferID := uuid.New().String()
 
-	// Validation: Amount must be > 0
-	if req.Amount <= 0 {
-		return nil, errors.New("amount must be greater than 0")
+	if idemKey == "" {
+		idemKey = transferID
+	} else {
+		if len(idemKey) < 8 || len(idemKey) > 128 {
+			return nil, "", false, ErrInvalidIdempotencyKey
+		}
+
+		existing, err := s.replayTransfer(req.FromUserID, idemKey, requestHash)
+		if err != nil || existing != nil {
+			return existing, idemKey, existing != nil, err
+		}
 	}
 
-	// Validation: Cannot transfer to same recipient as last transfer
-	lastRecipient, err := s.userRepo.GetLastTransferRecipient(req.FromUserID)
-	if err != nil {
-		return nil, err
+	transfer, err = s.createTransfer(req, transferID, idemKey, requestHash)
+	if errors.Is(err, repositories.ErrDuplicateIdemKey) {
+		return nil, "", false, ErrIdempotencyKeyInProgress
 	}
-	if lastRecipient != 0 && lastRecipient == req.ToUserID {
-		return nil, errors.New("cannot transfer to the same recipient as your last transfer")
+	return transfer, idemKey, false, err
+}
+
+// replayTransfer returns the transfer fromUserID previously created with
+// idemKey, or nil when the key has not been used yet. A key older than the
+// retention is treated as unused; releaseClientKey frees it when the new
+// transfer is created.
+func (s *TransferService) replayTransfer(fromUserID int64, idemKey, requestHash string) (*models.Transfer, error) {
+	existing, err := s.store.Transfers().GetByClientKey(fromUserID, idemKey)
+	if err != nil || existing == nil {
+		return nil, err
 	}
 
-	// Validate users exist
-	fromUser, err := s.userRepo.GetByID(req.FromUserID)
-	if err != nil {
-		return nil, errors.New("from_user not found")
+	if s.idemRetention > 0 && models.Now().Sub(existing.CreatedAt) > s.idemRetention {
+		return nil, nil
+	}
+	if existing.RequestHash != requestHash {
+		return nil, ErrIdempotencyKeyReused
 	}
 
-	_, err = s.userRepo.GetByID(req.ToUserID)
-	if err != nil {
-		return nil, errors.New("to_user not found")
+	return existing, nil
+}
+
+// ReleaseIdempotencyKeys frees the Idempotency-Keys of transfers older than
+// the retention, so senders can use them again, and returns how many were
+// freed.
+func (s *TransferService) ReleaseIdempotencyKeys(now time.Time) (int64, error) {
+	if s.idemRetention <= 0 {
+		return 0, nil
 	}
+	return s.store.Transfers().ReleaseClientKeys(now.Add(-s.idemRetention))
+}
 
-	if req.FromUserID == req.ToUserID {
-		return nil, errors.New("cannot transfer to yourself")
+// releaseClientKey frees idemKey in tx when the transfer of fromUserID that
+// used it is older than the retention, so a new transfer can take it.
+func (s *TransferService) releaseClientKey(tx repositories.Store, fromUserID int64, idemKey string, now time.Time) error {
+	if s.idemRetention <= 0 {
+		return nil
 	}
+	return tx.Transfers().ReleaseClientKey(fromUserID, idemKey, now.Add(-s.idemRetention))
+}
+
+func hashTransferRequest(req *models.CreateTransferRequest) string {
+	payload := fmt.Sprintf("%d|%d|%d|%q|%t", req.FromUserID, req.ToUserID, req.Amount, req.Note, req.Hold)
+	sum := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(sum[:])
+}
 
-	// Check balance
-	if fromUser.PointsBalance < req.Amount {
-		return nil, errors.New("insufficient balance")
+func (s *TransferService) createTransfer(req *models.CreateTransferRequest, transferID, idemKey, requestHash string) (*models.Transfer, error) {
+	if err := validateTransfer(req); err != nil {
+		return nil, err
 	}
 
-	// Begin transaction
-	db := s.transferRepo.DB
-	tx, err := db.Begin()
+	var transfer *models.Transfer
+	err := s.store.WithTx(func(tx repositories.Store) error {
+		// Lock both users first so the checks below cannot be invalidated by
+		// a concurrent transfer before we commit
+		users, err := lockUsers(tx, req.FromUserID, req.ToUserID)
+		if err != nil {
+			return err
+		}
+
+		// Validate users exist and are not closed
+		if err := checkOpen(users, req.FromUserID, req.ToUserID); err != nil {
+			return err
+		}
+		fromUser := users[req.FromUserID]
+
+		// Business rules, such as no repeat recipient and the limits
+		now := models.Now()
+		if err := s.checkRules(tx, req, now); err != nil {
+			return err
+		}
+		if err := s.checkLimits(tx, fromUser, req.Amount, now); err != nil {
+			return err
+		}
+
+		// Check balance; points held by pending transfers are not spendable
+		if fromUser.PointsBalance-fromUser.HeldBalance < req.Amount {
+			return ErrInsufficientBalance.With(i18n.Params{"amount": req.Amount})
+		}
+
+		transfer = &models.Transfer{
+			IdemKey:     transferID,
+			ClientKey:   idemKey,
+			RequestHash: requestHash,
+			FromUserID:  req.FromUserID,
+			ToUserID:    req.ToUserID,
+			Amount:      req.Amount,
+			Status:      models.TransferCompleted,
+			Note:        req.Note,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		if req.Hold {
+			expiresAt := now.Add(s.holdTTL)
+			transfer.Status = models.TransferPending
+			transfer.ExpiresAt = &expiresAt
+		} else {
+			completedAt := now
+			transfer.CompletedAt = &completedAt
+		}
+
+		// Create transfer record
+		if err := s.releaseClientKey(tx, req.FromUserID, idemKey, now); err != nil {
+			return err
+		}
+		err = tx.Transfers().Create(transfer)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Transfers().CreateStatusHistory(&models.TransferStatusHistory{
+			TransferID: transfer.TransferID,
+			ToStatus:   transfer.Status,
+			Actor:      fmt.Sprintf("user:%d", req.FromUserID),
+			CreatedAt:  now,
+		})
+		if err != nil {
+			return err
+		}
+
+		if req.Hold {
+			// Reserve the amount; it is settled by ConfirmTransfer or released
+			// by CancelTransfer
+			err = tx.Users().UpdateHeldBalance(req.FromUserID, req.Amount)
+		} else {
+			err = settleTransfer(tx, transfer, now)
+		}
+		if errors.Is(err, repositories.ErrInsufficientBalance) {
+			return ErrInsufficientBalance.With(i18n.Params{"amount": req.Amount})
+		}
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
 
-	now := models.Now()
-	completedAt := now
-	transfer := &models.Transfer{
-		IdemKey:     idemKey,
-		FromUserID:  req.FromUserID,
-		ToUserID:    req.ToUserID,
-		Amount:      req.Amount,
-		Status:      "completed",
-		Note:        req.Note,
-		CreatedAt:   now,
-		UpdatedAt:   now,
-		CompletedAt: &completedAt,
+	return transfer, nil
+}
+
+// validateTransfer checks the fields of req.
+func validateTransfer(req *models.CreateTransferRequest) error {
+	invalid := validate(validation.Struct(req))
+	if req.ToUserID != 0 && req.FromUserID == req.ToUserID {
+		invalid.Add("toUserId", "self_transfer", nil)
 	}
+	return invalid.Err()
+}
 
-	// Create transfer record
-	err = s.transferRepo.Create(tx, transfer)
-	if err != nil {
-		return nil, err
+// lockUsers locks the given users in ascending id order, so two transactions
+// touching the same pair of users can never deadlock, and returns them by id.
+// Users that do not exist are left out of the result.
+func lockUsers(tx repositories.Store, ids ...int64) (map[int64]*models.User, error) {
+	sorted := append([]int64(nil), ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	users := make(map[int64]*models.User, len(sorted))
+	for _, id := range sorted {
+		if _, ok := users[id]; ok {
+			continue
+		}
+		user, err := tx.Users().GetByIDForUpdate(id)
+		if errors.Is(err, repositories.ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		users[id] = user
 	}
+	return users, nil
+}
 
-	// Update balances
-	err = s.userRepo.UpdateBalance(tx, req.FromUserID, -req.Amount)
+// checkOpen returns ErrAccountClosed for the first of ids that is closed in
+// users, the result of lockUsers, and ErrUserNotFound for one that is missing.
+func checkOpen(users map[int64]*models.User, ids ...int64) error {
+	for _, id := range ids {
+		user, ok := users[id]
+		if !ok {
+			return ErrUserNotFound.With(i18n.Params{"id": id})
+		}
+		if user.Status == models.UserClosed {
+			return ErrAccountClosed.With(i18n.Params{"id": id})
+		}
+	}
+	return nil
+}
+
+// settleTransfer moves the transfer amount from sender to recipient and writes
+// the matching ledger entries.
+func settleTransfer(tx repositories.Store, transfer *models.Transfer, now time.Time) error {
+	// Update balances; the debit is guarded so it can never overdraw
+	err := tx.Users().UpdateBalance(transfer.FromUserID, -transfer.Amount)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	err = s.userRepo.UpdateBalance(tx, req.ToUserID, req.Amount)
+	err = tx.Users().UpdateBalance(transfer.ToUserID, transfer.Amount)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Get updated balances
-	fromBalance, err := s.userRepo.GetBalance(tx, req.FromUserID)
+	fromBalance, err := tx.Users().GetBalance(transfer.FromUserID)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	toBalance, err := s.userRepo.GetBalance(tx, req.ToUserID)
+	toBalance, err := tx.Users().GetBalance(transfer.ToUserID)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Create ledger entries
 	fromLedger := &models.PointLedger{
-		UserID:       req.FromUserID,
-		Change:       -req.Amount,
+		UserID:       transfer.FromUserID,
+		Change:       -transfer.Amount,
 		BalanceAfter: fromBalance,
 		EventType:    "transfer_out",
 		TransferID:   &transfer.TransferID,
 		CreatedAt:    now,
 	}
-	err = s.ledgerRepo.Create(tx, fromLedger)
+	err = tx.Ledger().Create(fromLedger)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	toLedger := &models.PointLedger{
-		UserID:       req.ToUserID,
-		Change:       req.Amount,
+		UserID:       transfer.ToUserID,
+		Change:       transfer.Amount,
 		BalanceAfter: toBalance,
 		EventType:    "transfer_in",
 		TransferID:   &transfer.TransferID,
 		CreatedAt:    now,
 	}
-	err = s.ledgerRepo.Create(tx, toLedger)
+	return tx.Ledger().Create(toLedger)
+}
+
+// ConfirmTransfer settles a pending transfer: the hold is released and the
+// amount is moved to the recipient. A pending transfer whose hold has expired
+// is cancelled instead and ErrTransferExpired is returned.
+func (s *TransferService) ConfirmTransfer(idemKey, actor string) (*models.Transfer, error) {
+	var transfer *models.Transfer
+	expired := false
+	err := s.store.WithTx(func(tx repositories.Store) error {
+		var err error
+		transfer, err = s.getForUpdate(tx, idemKey)
+		if err != nil {
+			return err
+		}
+
+		now := models.Now()
+		if transfer.Status == models.TransferPending && transfer.ExpiresAt != nil && now.After(*transfer.ExpiresAt) {
+			// The cancellation is committed; ErrTransferExpired is returned
+			// once the transaction is done
+			expired = true
+			return s.cancelPending(tx, transfer, actor, "hold expired")
+		}
+
+		err = s.transition(tx, transfer, models.TransferProcessing, actor, "confirmed")
+		if err != nil {
+			return err
+		}
+
+		users, err := lockUsers(tx, transfer.FromUserID, transfer.ToUserID)
+		if err != nil {
+			return err
+		}
+		if err := checkOpen(users, transfer.ToUserID); err != nil {
+			return err
+		}
+
+		err = tx.Users().UpdateHeldBalance(transfer.FromUserID, -transfer.Amount)
+		if err != nil {
+			return err
+		}
+
+		err = settleTransfer(tx, transfer, now)
+		if err != nil {
+			return err
+		}
+
+		transfer.CompletedAt = &now
+		return s.transition(tx, transfer, models.TransferCompleted, actor, "")
+	})
 	if err != nil {
 		return nil, err
 	}
+	if expired {
+		return nil, ErrTransferExpired
+	}
 
-	// Commit transaction
-	err = tx.Commit()
+	return transfer, nil
+}
+
+// CancelTransfer releases the hold of a pending transfer without moving points.
+func (s *TransferService) CancelTransfer(idemKey string, req *models.CancelTransferRequest, actor string) (*models.Transfer, error) {
+	var transfer *models.Transfer
+	err := s.store.WithTx(func(tx repositories.Store) error {
+		var err error
+		transfer, err = s.getForUpdate(tx, idemKey)
+		if err != nil {
+			return err
+		}
+
+		reason := req.Reason
+		if reason == "" {
+			reason = "cancelled"
+		}
+		return s.cancelPending(tx, transfer, actor, reason)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -146,38 +420,280 @@ func (s *TransferService) CreateTransfer(req *models.CreateTransferRequest) (*mo
 	return transfer, nil
 }
 
-func (s *TransferService) GetByIdemKey(idemKey string) (*models.Transfer, error) {
-	transfer, err := s.transferRepo.GetByIdemKey(idemKey)
+// ExpirePendingTransfers cancels every pending transfer whose hold expired
+// before now and returns how many were cancelled.
+func (s *TransferService) ExpirePendingTransfers(now time.Time) (int, error) {
+	keys, err := s.store.Transfers().ListExpiredPending(now)
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, key := range keys {
+		_, err := s.CancelTransfer(key, &models.CancelTransferRequest{Reason: "hold expired"}, "system")
+		if errors.Is(err, ErrIllegalTransition) {
+			// Confirmed or cancelled since the list was read
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+
+	return expired, nil
+}
+
+func (s *TransferService) getForUpdate(tx repositories.Store, idemKey string) (*models.Transfer, error) {
+	transfer, err := tx.Transfers().GetByIdemKeyForUpdate(idemKey)
 	if err != nil {
 		return nil, err
 	}
 	if transfer == nil {
-		return nil, errors.New("transfer not found")
+		return nil, ErrTransferNotFound.With(i18n.Params{"id": idemKey})
 	}
 	return transfer, nil
 }
 
-func (s *TransferService) GetByUserID(userID int64, page, pageSize int) (*models.TransferListResponse, error) {
-	if page < 1 {
-		page = 1
+func (s *TransferService) cancelPending(tx repositories.Store, transfer *models.Transfer, actor, reason string) error {
+	transfer.FailReason = &reason
+	err := s.transition(tx, transfer, models.TransferCancelled, actor, reason)
+	if err != nil {
+		return err
+	}
+
+	return tx.Users().UpdateHeldBalance(transfer.FromUserID, -transfer.Amount)
+}
+
+// transition moves transfer to status to and records the change in the status
+// history. Every status change goes through here so the transition table in
+// models is the single place that decides what is legal.
+func (s *TransferService) transition(tx repositories.Store, transfer *models.Transfer, to models.TransferStatus, actor, reason string) error {
+	from := transfer.Status
+	if !from.CanTransitionTo(to) {
+		return ErrIllegalTransition.With(i18n.Params{"from": from, "to": to})
+	}
+
+	err := tx.Transfers().UpdateStatus(transfer, from, to)
+	if errors.Is(err, repositories.ErrStatusChanged) {
+		return ErrIllegalTransition.Variant("transfer_no_longer", i18n.Params{"status": from})
 	}
-	if pageSize < 1 || pageSize > 200 {
-		pageSize = 20
+	if err != nil {
+		return err
 	}
 
-	transfers, total, err := s.transferRepo.GetByUserID(userID, page, pageSize)
+	return tx.Transfers().CreateStatusHistory(&models.TransferStatusHistory{
+		TransferID: transfer.TransferID,
+		FromStatus: &from,
+		ToStatus:   to,
+		Actor:      actor,
+		Reason:     reason,
+		CreatedAt:  transfer.UpdatedAt,
+	})
+}
+
+// GetStatusHistory returns every status change of the transfer, oldest first.
+func (s *TransferService) GetStatusHistory(idemKey string) ([]models.TransferStatusHistory, error) {
+	transfer, err := s.store.Transfers().GetByIdemKey(idemKey)
 	if err != nil {
 		return nil, err
 	}
+	if transfer == nil {
+		return nil, ErrTransferNotFound.With(i18n.Params{"id": idemKey})
+	}
 
-	if transfers == nil {
-		transfers = []models.Transfer{}
+	history, err := s.store.Transfers().GetStatusHistory(transfer.TransferID)
+	if err != nil {
+		return nil, err
+	}
+	if history == nil {
+		history = []models.TransferStatusHistory{}
 	}
+	return history, nil
+}
+
+// ReverseTransfer undoes a completed transfer: the amount moves back from the
+// recipient to the sender, compensating ledger entries are written against the
+// original transfer_id and the transfer is marked reversed.
+func (s *TransferService) ReverseTransfer(idemKey string, req *models.ReverseTransferRequest, actor string) (*models.Transfer, error) {
+	var transfer *models.Transfer
+	err := s.store.WithTx(func(tx repositories.Store) error {
+		var err error
+		transfer, err = s.getForUpdate(tx, idemKey)
+		if err != nil {
+			return err
+		}
+
+		err = s.transition(tx, transfer, models.TransferReversed, actor, req.Reason)
+		if err != nil {
+			return err
+		}
+
+		users, err := lockUsers(tx, transfer.FromUserID, transfer.ToUserID)
+		if err != nil {
+			return err
+		}
+		if err := checkOpen(users, transfer.FromUserID, transfer.ToUserID); err != nil {
+			return err
+		}
+
+		// Take the points back from the recipient first; unless explicitly
+		// allowed, the reversal must not leave them with a negative balance.
+		if req.AllowNegative {
+			err = tx.Users().ForceUpdateBalance(transfer.ToUserID, -transfer.Amount)
+		} else {
+			err = tx.Users().UpdateBalance(transfer.ToUserID, -transfer.Amount)
+		}
+		if errors.Is(err, repositories.ErrInsufficientBalance) {
+			return ErrRecipientInsufficientBalance.With(i18n.Params{"amount": transfer.Amount})
+		}
+		if err != nil {
+			return err
+		}
+
+		err = tx.Users().UpdateBalance(transfer.FromUserID, transfer.Amount)
+		if err != nil {
+			return err
+		}
+
+		toBalance, err := tx.Users().GetBalance(transfer.ToUserID)
+		if err != nil {
+			return err
+		}
+
+		fromBalance, err := tx.Users().GetBalance(transfer.FromUserID)
+		if err != nil {
+			return err
+		}
+
+		metadata, err := json.Marshal(map[string]string{"reason": req.Reason})
+		if err != nil {
+			return err
+		}
+
+		// Create compensating ledger entries
+		now := models.Now()
+		toLedger := &models.PointLedger{
+			UserID:       transfer.ToUserID,
+			Change:       -transfer.Amount,
+			BalanceAfter: toBalance,
+			EventType:    "transfer_out",
+			TransferID:   &transfer.TransferID,
+			Reference:    "reversal",
+			Metadata:     string(metadata),
+			CreatedAt:    now,
+		}
+		err = tx.Ledger().Create(toLedger)
+		if err != nil {
+			return err
+		}
+
+		fromLedger := &models.PointLedger{
+			UserID:       transfer.FromUserID,
+			Change:       transfer.Amount,
+			BalanceAfter: fromBalance,
+			EventType:    "transfer_in",
+			TransferID:   &transfer.TransferID,
+			Reference:    "reversal",
+			Metadata:     string(metadata),
+			CreatedAt:    now,
+		}
+		return tx.Ledger().Create(fromLedger)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return transfer, nil
+}
 
-	return &models.TransferListResponse{
+func (s *TransferService) GetByIdemKey(idemKey string) (*models.Transfer, error) {
+	transfer, err := s.store.Transfers().GetByIdemKey(idemKey)
+	if err != nil {
+		return nil, err
+	}
+	if transfer == nil {
+		return nil, ErrTransferNotFound.With(i18n.Params{"id": idemKey})
+	}
+	return transfer, nil
+}
+
+// List returns a page of the transfers matching q. The page is selected by
+// q.Cursor when it is set and by q.Page otherwise; either way the response
+// carries the cursor of the next page.
+func (s *TransferService) List(q *models.TransferListQuery) (*models.TransferListResponse, error) {
+	if q.Direction != "" && q.Direction != "sent" && q.Direction != "received" {
+		return nil, ErrInvalidQuery.Variant("unknown_value", i18n.Params{"name": "direction", "value": q.Direction})
+	}
+	if q.Direction != "" && q.UserID == 0 {
+		return nil, ErrInvalidQuery.Variant("direction_without_user", nil)
+	}
+	for _, status := range q.Statuses {
+		if !status.Valid() {
+			return nil, ErrInvalidQuery.Variant("unknown_value", i18n.Params{"name": "status", "value": status})
+		}
+	}
+	if q.MinAmount != nil && q.MaxAmount != nil && *q.MinAmount > *q.MaxAmount {
+		return nil, ErrInvalidQuery.Variant("min_above_max", i18n.Params{"min": "min_amount", "max": "max_amount"})
+	}
+	if q.From != nil && q.To != nil && !q.From.Before(*q.To) {
+		return nil, ErrInvalidQuery.Variant("from_after_to", nil)
+	}
+	if q.Cursor != "" {
+		after, err := decodeTransferCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		q.After = after
+	}
+	if q.Page < 1 || q.After != nil {
+		q.Page = 1
+	}
+	if q.PageSize < 1 || q.PageSize > s.maxPageSize {
+		q.PageSize = s.defaultPageSize
+	}
+
+	transfers, total, err := s.store.Transfers().List(q)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := q.PageSize
+	resp := &models.TransferListResponse{
 		Data:     transfers,
-		Page:     page,
 		PageSize: pageSize,
 		Total:    total,
-	}, nil
+	}
+	if q.After == nil {
+		resp.Page = q.Page
+	}
+	if len(transfers) > pageSize {
+		resp.Data = transfers[:pageSize]
+		last := resp.Data[pageSize-1]
+		resp.NextCursor = encodeTransferCursor(models.TransferCursor{CreatedAt: last.CreatedAt, TransferID: last.TransferID})
+	}
+	if resp.Data == nil {
+		resp.Data = []models.Transfer{}
+	}
+
+	return resp, nil
+}
+
+// encodeTransferCursor makes the opaque cursor parameter of a list position.
+func encodeTransferCursor(c models.TransferCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeTransferCursor reads a cursor made by encodeTransferCursor.
+func decodeTransferCursor(cursor string) (*models.TransferCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidQuery.Variant("invalid_cursor", nil)
+	}
+	var c models.TransferCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.TransferID < 1 {
+		return nil, ErrInvalidQuery.Variant("invalid_cursor", nil)
+	}
+	return &c, nil
 }
@@ -0,0 +1,213 @@
+package services
+
+import (
+	"backend/i18n"
+	"backend/models"
+	"backend/repositories"
+	"backend/validation"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// MaxBatchSize is the largest number of transfers in a batch.
+const MaxBatchSize = 100
+
+// BatchError is the rejection of one transfer of a batch, which rolls back
+// the whole batch. It unwraps to the reason, so errors.Is and errors.As see
+// through it.
+type BatchError struct {
+	Index int // of the transfer in the request
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch transfer %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// CreateBatch makes a completed transfer from req.FromUserID to each item of
+// req in one transaction, so either every transfer is made or none is. The
+// transfers share a new batch ID. Every item is checked before anything is
+// written, and the sender's balance is checked once against the total.
+//
+// idemKey works like for CreateTransfer and covers the whole batch; it is
+// kept on the first transfer, and shares the keys of single transfers of the
+// sender. The key used is returned, generated when idemKey is empty.
+func (s *TransferService) CreateBatch(req *models.CreateBatchTransferRequest, idemKey string) (batch *models.BatchTransferResponse, key string, replayed bool, err error) {
+	if err := validateBatch(req); err != nil {
+		return nil, "", false, err
+	}
+	requestHash := hashBatchRequest(req)
+
+	if idemKey == "" {
+		idemKey = uuid.New().String()
+	} else {
+		if len(idemKey) < 8 || len(idemKey) > 128 {
+			return nil, "", false, ErrInvalidIdempotencyKey
+		}
+
+		first, err := s.replayTransfer(req.FromUserID, idemKey, requestHash)
+		if err != nil {
+			return nil, "", false, err
+		}
+		if first != nil {
+			transfers, err := s.store.Transfers().ListByBatch(first.BatchID)
+			if err != nil {
+				return nil, "", false, err
+			}
+			return newBatchResponse(first.BatchID, transfers), idemKey, true, nil
+		}
+	}
+
+	batch, err = s.createBatch(req, idemKey, requestHash)
+	if errors.Is(err, repositories.ErrDuplicateIdemKey) {
+		return nil, "", false, ErrIdempotencyKeyInProgress
+	}
+	return batch, idemKey, false, err
+}
+
+func (s *TransferService) createBatch(req *models.CreateBatchTransferRequest, idemKey, requestHash string) (*models.BatchTransferResponse, error) {
+	batchID := uuid.New().String()
+	ids := []int64{req.FromUserID}
+	var total int64
+	for _, item := range req.Transfers {
+		ids = append(ids, item.ToUserID)
+		total += item.Amount
+	}
+
+	transfers := make([]models.Transfer, len(req.Transfers))
+	err := s.store.WithTx(func(tx repositories.Store) error {
+		users, err := lockUsers(tx, ids...)
+		if err != nil {
+			return err
+		}
+		if err := checkOpen(users, ids...); err != nil {
+			return err
+		}
+		fromUser := users[req.FromUserID]
+
+		// Points held by pending transfers are not spendable
+		if fromUser.PointsBalance-fromUser.HeldBalance < total {
+			return ErrInsufficientBalance.With(i18n.Params{"amount": total})
+		}
+
+		now := models.Now()
+		actor := fmt.Sprintf("user:%d", req.FromUserID)
+		for i, item := range req.Transfers {
+			// The rules and limits see the transfers made before this one
+			itemReq := batchItemRequest(req, item)
+			if err := s.checkRules(tx, itemReq, now); err != nil {
+				return &BatchError{Index: i, Err: err}
+			}
+			if err := s.checkLimits(tx, fromUser, item.Amount, now); err != nil {
+				return &BatchError{Index: i, Err: err}
+			}
+
+			completedAt := now
+			transfer := &transfers[i]
+			*transfer = models.Transfer{
+				IdemKey:     uuid.New().String(),
+				RequestHash: requestHash,
+				FromUserID:  req.FromUserID,
+				ToUserID:    item.ToUserID,
+				Amount:      item.Amount,
+				Status:      models.TransferCompleted,
+				Note:        item.Note,
+				CreatedAt:   now,
+				UpdatedAt:   now,
+				CompletedAt: &completedAt,
+				BatchID:     batchID,
+			}
+			if i == 0 {
+				transfer.ClientKey = idemKey
+				if err := s.releaseClientKey(tx, req.FromUserID, idemKey, now); err != nil {
+					return err
+				}
+			}
+			if err := tx.Transfers().Create(transfer); err != nil {
+				return err
+			}
+
+			err = tx.Transfers().CreateStatusHistory(&models.TransferStatusHistory{
+				TransferID: transfer.TransferID,
+				ToStatus:   transfer.Status,
+				Actor:      actor,
+				CreatedAt:  now,
+			})
+			if err != nil {
+				return err
+			}
+
+			err = settleTransfer(tx, transfer, now)
+			if errors.Is(err, repositories.ErrInsufficientBalance) {
+				return ErrInsufficientBalance.With(i18n.Params{"amount": total})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newBatchResponse(batchID, transfers), nil
+}
+
+// validateBatch checks every item of req and reports the problems of all of
+// them at once, as transfers[i].<field>.
+func validateBatch(req *models.CreateBatchTransferRequest) error {
+	if len(req.Transfers) == 0 {
+		return invalidField("transfers", "required", nil)
+	}
+	if len(req.Transfers) > MaxBatchSize {
+		return invalidField("transfers", "max_items", i18n.Params{"max": MaxBatchSize})
+	}
+
+	invalid := &ValidationError{}
+	for i, item := range req.Transfers {
+		prefix := fmt.Sprintf("transfers[%d].", i)
+		for _, v := range validation.Struct(&item) {
+			invalid.Add(prefix+v.Field, v.Code, v.Params)
+		}
+		if item.ToUserID != 0 && item.ToUserID == req.FromUserID {
+			invalid.Add(prefix+"toUserId", "self_transfer", nil)
+		}
+	}
+	return invalid.Err()
+}
+
+// batchItemRequest is the transfer request the rules check for item.
+func batchItemRequest(req *models.CreateBatchTransferRequest, item models.BatchTransferItem) *models.CreateTransferRequest {
+	return &models.CreateTransferRequest{
+		FromUserID: req.FromUserID,
+		ToUserID:   item.ToUserID,
+		Amount:     item.Amount,
+		Note:       item.Note,
+	}
+}
+
+func hashBatchRequest(req *models.CreateBatchTransferRequest) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "batch|%d", req.FromUserID)
+	for _, item := range req.Transfers {
+		fmt.Fprintf(h, "|%d|%d|%q", item.ToUserID, item.Amount, item.Note)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newBatchResponse(batchID string, transfers []models.Transfer) *models.BatchTransferResponse {
+	batch := &models.BatchTransferResponse{BatchID: batchID, Transfers: transfers}
+	for _, t := range transfers {
+		batch.Total += t.Amount
+	}
+	return batch
+}
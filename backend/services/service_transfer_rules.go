@@ -0,0 +1,296 @@
+package services
+
+import (
+	"backend/i18n"
+	"backend/models"
+	"backend/repositories"
+	"errors"
+	"fmt"
+	"time"
+
+	// Rules may name any IANA time zone, even where the host has no tzdata
+	_ "time/tzdata"
+)
+
+// RuleError is the rejection of a transfer by a rule of the chain. It
+// unwraps to the *Error describing the problem, so errors.Is matches its
+// sentinel.
+type RuleError struct {
+	Rule string
+	Type string
+	Err  *Error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("transfer rule %s: %v", e.Rule, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// RuleResult is the outcome of one rule; Err is nil when the rule passed.
+type RuleResult struct {
+	Rule string
+	Type string
+	Err  *Error
+}
+
+// ruleCheck returns the rejection of req at time now, or nil when the rule
+// passes.
+type ruleCheck func(store repositories.Store, req *models.CreateTransferRequest, now time.Time) (*Error, error)
+
+// transferRule is a models.TransferRule ready to be checked.
+type transferRule struct {
+	models.TransferRule
+	check ruleCheck
+}
+
+// compileTransferRule checks the settings of rule and builds its check.
+func compileTransferRule(rule models.TransferRule) (*transferRule, error) {
+	if rule.Name == "" {
+		rule.Name = rule.Type
+	}
+	fail := func(format string, args ...any) (*transferRule, error) {
+		return nil, fmt.Errorf("transfer rule %q: "+format, append([]any{rule.Name}, args...)...)
+	}
+
+	loc := time.UTC
+	if rule.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(rule.Timezone); err != nil {
+			return fail("timezone: %v", err)
+		}
+	}
+
+	r := &transferRule{TransferRule: rule}
+	switch rule.Type {
+	case models.RuleMinAmount, models.RuleMaxAmount:
+		if rule.Amount < 1 {
+			return fail("amount must be at least 1")
+		}
+		r.check = amountCheck(rule.Type == models.RuleMaxAmount, rule.Amount)
+
+	case models.RuleSameRecipient:
+		var cooldown time.Duration
+		if rule.Cooldown != "" {
+			var err error
+			if cooldown, err = time.ParseDuration(rule.Cooldown); err != nil || cooldown <= 0 {
+				return fail("cooldown must be a positive duration such as 24h")
+			}
+		}
+		r.check = sameRecipientCheck(cooldown)
+
+	case models.RuleDailyLimit, models.RuleWeeklyLimit:
+		if rule.Amount < 1 {
+			return fail("amount must be at least 1")
+		}
+		r.check = limitCheck(rule.Type == models.RuleWeeklyLimit, rule.Amount, loc)
+
+	case models.RuleBlockedPair:
+		if rule.FromUserID == 0 && rule.ToUserID == 0 {
+			return fail("fromUserId or toUserId is required")
+		}
+		r.check = blockedPairCheck(rule.FromUserID, rule.ToUserID)
+
+	case models.RuleTimeWindow:
+		start, err := time.Parse("15:04", rule.Start)
+		if err != nil {
+			return fail("start must be a time such as 06:00")
+		}
+		end, err := time.Parse("15:04", rule.End)
+		if err != nil {
+			return fail("end must be a time such as 22:00")
+		}
+		r.check = timeWindowCheck(start, end, loc)
+
+	default:
+		return fail("unknown type %q", rule.Type)
+	}
+	return r, nil
+}
+
+func amountCheck(upper bool, bound int64) ruleCheck {
+	return func(_ repositories.Store, req *models.CreateTransferRequest, _ time.Time) (*Error, error) {
+		if upper && req.Amount > bound {
+			return ErrAmountAboveMaximum.With(i18n.Params{"max": bound}), nil
+		}
+		if !upper && req.Amount < bound {
+			return ErrAmountBelowMinimum.With(i18n.Params{"min": bound}), nil
+		}
+		return nil, nil
+	}
+}
+
+// sameRecipientCheck without a cooldown rejects a transfer to the recipient
+// of the sender's last transfer; with one it rejects a transfer to a
+// recipient the sender sent to less than cooldown ago.
+func sameRecipientCheck(cooldown time.Duration) ruleCheck {
+	return func(store repositories.Store, req *models.CreateTransferRequest, now time.Time) (*Error, error) {
+		if cooldown == 0 {
+			last, err := store.Transfers().GetLastSent(req.FromUserID, 0)
+			if err != nil || last == nil || last.ToUserID != req.ToUserID {
+				return nil, err
+			}
+			return ErrSameRecipient, nil
+		}
+
+		last, err := store.Transfers().GetLastSent(req.FromUserID, req.ToUserID)
+		if err != nil || last == nil || now.Sub(last.CreatedAt) >= cooldown {
+			return nil, err
+		}
+		return ErrSameRecipient.Variant("same_recipient_cooldown", i18n.Params{"cooldown": cooldown.String()}), nil
+	}
+}
+
+// limitCheck bounds what a sender sends per calendar day or week in loc,
+// counting the transfer being checked.
+func limitCheck(weekly bool, limit int64, loc *time.Location) ruleCheck {
+	sentinel := ErrDailyLimitExceeded
+	if weekly {
+		sentinel = ErrWeeklyLimitExceeded
+	}
+	return func(store repositories.Store, req *models.CreateTransferRequest, now time.Time) (*Error, error) {
+		local := now.In(loc)
+		start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+		if weekly {
+			// Weeks start on Monday
+			start = start.AddDate(0, 0, -(int(local.Weekday())+6)%7)
+		}
+
+		sent, _, err := store.Transfers().SumSent(req.FromUserID, start.UTC())
+		if err != nil || sent+req.Amount <= limit {
+			return nil, err
+		}
+		return sentinel.With(i18n.Params{"limit": limit, "remaining": max(limit-sent, 0)}), nil
+	}
+}
+
+func blockedPairCheck(from, to int64) ruleCheck {
+	return func(_ repositories.Store, req *models.CreateTransferRequest, _ time.Time) (*Error, error) {
+		if (from == 0 || from == req.FromUserID) && (to == 0 || to == req.ToUserID) {
+			return ErrTransferBlocked, nil
+		}
+		return nil, nil
+	}
+}
+
+// timeWindowCheck allows transfers from start until end in loc. A window
+// whose end is before its start runs past midnight.
+func timeWindowCheck(start, end time.Time, loc *time.Location) ruleCheck {
+	from := start.Hour()*60 + start.Minute()
+	until := end.Hour()*60 + end.Minute()
+	return func(_ repositories.Store, _ *models.CreateTransferRequest, now time.Time) (*Error, error) {
+		local := now.In(loc)
+		minute := local.Hour()*60 + local.Minute()
+
+		open := minute >= from && minute < until
+		if until < from {
+			open = minute >= from || minute < until
+		}
+		if open {
+			return nil, nil
+		}
+		return ErrOutsideTransferWindow.With(i18n.Params{
+			"start":    start.Format("15:04"),
+			"end":      end.Format("15:04"),
+			"timezone": loc.String(),
+		}), nil
+	}
+}
+
+// SetTransferRules replaces the rules of the config file. They are checked
+// after the same-recipient rule of SetNoRepeatRecipient and before the rules
+// of the transfer_rules table.
+func (s *TransferService) SetTransferRules(rules []models.TransferRule) error {
+	compiled := make([]*transferRule, 0, len(rules))
+	for _, rule := range rules {
+		r, err := compileTransferRule(rule)
+		if err != nil {
+			return err
+		}
+		compiled = append(compiled, r)
+	}
+	s.rules = compiled
+	return nil
+}
+
+// ruleChain returns the rules a transfer is checked against, in order. The
+// rules of the transfer_rules table are read on every call, so changes apply
+// to the next transfer.
+func (s *TransferService) ruleChain(store repositories.Store) ([]*transferRule, error) {
+	var chain []*transferRule
+	if s.noRepeatRecipient {
+		r, _ := compileTransferRule(models.TransferRule{Type: models.RuleSameRecipient})
+		chain = append(chain, r)
+	}
+	chain = append(chain, s.rules...)
+
+	stored, err := store.TransferRules().ListEnabled()
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range stored {
+		// A broken rule rejects every transfer rather than being skipped
+		r, err := compileTransferRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, r)
+	}
+	return chain, nil
+}
+
+// checkRules returns a *RuleError for the first rule that rejects req.
+func (s *TransferService) checkRules(store repositories.Store, req *models.CreateTransferRequest, now time.Time) error {
+	chain, err := s.ruleChain(store)
+	if err != nil {
+		return err
+	}
+	for _, r := range chain {
+		rejection, err := r.check(store, req, now)
+		if err != nil {
+			return err
+		}
+		if rejection != nil {
+			return &RuleError{Rule: r.Name, Type: r.Type, Err: rejection}
+		}
+	}
+	return nil
+}
+
+// DryRun checks req like CreateTransfer does, then evaluates every rule of
+// the chain without moving points.
+func (s *TransferService) DryRun(req *models.CreateTransferRequest) ([]RuleResult, error) {
+	if err := validateTransfer(req); err != nil {
+		return nil, err
+	}
+	for _, id := range []int64{req.FromUserID, req.ToUserID} {
+		user, err := s.store.Users().GetByID(id)
+		if errors.Is(err, repositories.ErrUserNotFound) {
+			return nil, ErrUserNotFound.With(i18n.Params{"id": id})
+		}
+		if err != nil {
+			return nil, err
+		}
+		if user.Status == models.UserClosed {
+			return nil, ErrAccountClosed.With(i18n.Params{"id": id})
+		}
+	}
+
+	chain, err := s.ruleChain(s.store)
+	if err != nil {
+		return nil, err
+	}
+
+	now := models.Now()
+	results := make([]RuleResult, len(chain))
+	for i, r := range chain {
+		rejection, err := r.check(s.store, req, now)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = RuleResult{Rule: r.Name, Type: r.Type, Err: rejection}
+	}
+	return results, nil
+}
@@ -1,38 +1,213 @@
 package services
 
 import (
+	"backend/i18n"
 	"backend/models"
 	"backend/repositories"
+	"backend/validation"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"reflect"
+	"strings"
+	"time"
 	"unicode/utf8"
+
+	"github.com/google/uuid"
 )
 
+// DefaultMaxNameLength is the maximum length of first and last names.
+const DefaultMaxNameLength = 3
+
 type UserService struct {
-	repo *repositories.UserRepository
+	store           repositories.Store
+	repo            repositories.UserRepository
+	maxNameLength   int
+	defaultPageSize int
+	maxPageSize     int
+	importCommit    string
+	importMaxRows   int
+	validator       *validation.Validator
+}
+
+func NewUserService(store repositories.Store) *UserService {
+	s := &UserService{
+		store:           store,
+		repo:            store.Users(),
+		maxNameLength:   DefaultMaxNameLength,
+		defaultPageSize: DefaultPageSize,
+		maxPageSize:     MaxPageSize,
+		importCommit:    models.ImportCommitAll,
+		importMaxRows:   DefaultImportMaxRows,
+	}
+	s.validator = validation.New()
+	s.validator.Register("name", s.checkName)
+	return s
+}
+
+func (s *UserService) SetMaxNameLength(n int) {
+	s.maxNameLength = n
+}
+
+func (s *UserService) SetPageSize(defaultSize, maxSize int) {
+	s.defaultPageSize = defaultSize
+	s.maxPageSize = maxSize
+}
+
+// checkName is the "name" rule of the user requests: names must not exceed
+// maxNameLength characters.
+func (s *UserService) checkName(v reflect.Value, _ string) (string, i18n.Params) {
+	if utf8.RuneCountInString(v.String()) > s.maxNameLength {
+		return "max_length", i18n.Params{"max": s.maxNameLength}
+	}
+	return "", nil
+}
+
+// List searches, filters, sorts and pages the users. Like the transfer list,
+// the page is selected by q.Cursor when it is set and by q.Page otherwise,
+// and the response carries the cursor of the next page.
+func (s *UserService) List(q *models.UserListQuery) (*models.UserListResponse, error) {
+	switch q.Status {
+	case "", string(models.UserActive), string(models.UserClosed), "all":
+	default:
+		return nil, ErrInvalidQuery.Variant("unknown_value", i18n.Params{"name": "status", "value": q.Status})
+	}
+	if field := strings.TrimPrefix(q.Sort, "-"); q.Sort != "" && models.UserSortFields[field] == "" {
+		return nil, ErrInvalidQuery.Variant("unknown_value", i18n.Params{"name": "sort", "value": q.Sort})
+	}
+	if q.MinBalance != nil && q.MaxBalance != nil && *q.MinBalance > *q.MaxBalance {
+		return nil, ErrInvalidQuery.Variant("min_above_max", i18n.Params{"min": "min_balance", "max": "max_balance"})
+	}
+	if q.From != nil && q.To != nil && !q.From.Before(*q.To) {
+		return nil, ErrInvalidQuery.Variant("from_after_to", nil)
+	}
+	if q.Cursor != "" {
+		after, err := decodeUserCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return nil, err
+		}
+		q.After = after
+	}
+	if q.Page < 1 || q.After != nil {
+		q.Page = 1
+	}
+	if q.PageSize < 1 || q.PageSize > s.maxPageSize {
+		q.PageSize = s.defaultPageSize
+	}
+
+	users, total, err := s.repo.List(q)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := q.PageSize
+	resp := &models.UserListResponse{
+		Data:     users,
+		PageSize: pageSize,
+		Total:    total,
+	}
+	if q.After == nil {
+		resp.Page = q.Page
+	}
+	if len(users) > pageSize {
+		resp.Data = users[:pageSize]
+		resp.NextCursor = encodeUserCursor(q.Sort, &resp.Data[pageSize-1])
+	}
+	if resp.Data == nil {
+		resp.Data = []models.User{}
+	}
+
+	return resp, nil
 }
 
-func NewUserService(repo *repositories.UserRepository) *UserService {
-	return &UserService{repo: repo}
+// userCursor is the JSON of an opaque user list cursor.
+type userCursor struct {
+	Sort string          `json:"s"`
+	Key  json.RawMessage `json:"k"`
+	ID   int64           `json:"id"`
+}
+
+// encodeUserCursor makes the cursor parameter of the position of u in the
+// list sorted by sort.
+func encodeUserCursor(sort string, u *models.User) string {
+	var key any
+	switch strings.TrimPrefix(sort, "-") {
+	case "first_name":
+		key = u.FirstName
+	case "last_name":
+		key = u.LastName
+	case "points_balance":
+		key = u.PointsBalance
+	case "created_at":
+		key = u.CreatedAt
+	default:
+		key = u.ID
+	}
+	raw, _ := json.Marshal(key)
+	b, _ := json.Marshal(userCursor{Sort: sort, Key: raw, ID: u.ID})
+	return base64.RawURLEncoding.EncodeToString(b)
 }
 
-func (s *UserService) GetAll() ([]models.User, error) {
-	return s.repo.GetAll()
+// decodeUserCursor reads a cursor made by encodeUserCursor for the same sort.
+func decodeUserCursor(cursor, sort string) (*models.UserCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidQuery.Variant("invalid_cursor", nil)
+	}
+	var c userCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.ID < 1 || c.Sort != sort {
+		return nil, ErrInvalidQuery.Variant("invalid_cursor", nil)
+	}
+
+	after := &models.UserCursor{Sort: c.Sort, ID: c.ID}
+	switch strings.TrimPrefix(sort, "-") {
+	case "first_name", "last_name":
+		var key string
+		err = json.Unmarshal(c.Key, &key)
+		after.Key = key
+	case "points_balance":
+		var key int64
+		err = json.Unmarshal(c.Key, &key)
+		after.Key = key
+	case "created_at":
+		var key time.Time
+		err = json.Unmarshal(c.Key, &key)
+		after.Key = key
+	default:
+		after.Key = c.ID
+	}
+	if err != nil {
+		return nil, ErrInvalidQuery.Variant("invalid_cursor", nil)
+	}
+	return after, nil
 }
 
 func (s *UserService) GetByID(id int64) (*models.User, error) {
-	return s.repo.GetByID(id)
+	user, err := s.repo.GetByID(id)
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		return nil, ErrUserNotFound.With(i18n.Params{"id": id})
+	}
+	return user, err
 }
 
 func (s *UserService) Create(req *models.CreateUserRequest) (*models.User, error) {
-	// Validation: names must not exceed 3 characters
-	if utf8.RuneCountInString(req.FirstName) > 3 {
-		return nil, errors.New("first_name must not exceed 3 characters")
+	user, err := s.newUser(req)
+	if err != nil {
+		return nil, err
 	}
-	if utf8.RuneCountInString(req.LastName) > 3 {
-		return nil, errors.New("last_name must not exceed 3 characters")
+
+	err = s.repo.Create(user)
+	if err != nil {
+		return nil, err
 	}
-	if req.FirstName == "" || req.LastName == "" {
-		return nil, errors.New("first_name and last_name are required")
+
+	return user, nil
+}
+
+// newUser validates req and builds the user to insert.
+func (s *UserService) newUser(req *models.CreateUserRequest) (*models.User, error) {
+	if err := Invalid(s.validator.Struct(req)); err != nil {
+		return nil, err
 	}
 
 	now := models.Now()
@@ -43,62 +218,262 @@ func (s *UserService) Create(req *models.CreateUserRequest) (*models.User, error
 		Phone:         req.Phone,
 		AvatarURL:     req.AvatarURL,
 		Bio:           req.Bio,
+		Locale:        req.Locale,
 		PointsBalance: 0,
+		Role:          models.RoleUser,
+		Status:        models.UserActive,
 		CreatedAt:     now,
 		UpdatedAt:     now,
 	}
 
-	err := s.repo.Create(user)
-	if err != nil {
+	return user, nil
+}
+
+// Replace replaces the profile of a user with req; fields req leaves empty
+// are cleared. ifMatch is the If-Match header: when set, the user is only
+// changed if one of its entity tags is the user's current ETag.
+func (s *UserService) Replace(id int64, req *models.UpdateUserRequest, ifMatch string) (*models.User, error) {
+	if err := Invalid(s.validator.Struct(req)); err != nil {
 		return nil, err
 	}
 
-	return user, nil
+	return s.update(id, ifMatch, func(*models.User) (*models.UpdateUserRequest, error) {
+		return req, nil
+	})
 }
 
-func (s *UserService) Update(id int64, req *models.UpdateUserRequest) (*models.User, error) {
-	// Validation: names must not exceed 3 characters
-	if req.FirstName != "" && utf8.RuneCountInString(req.FirstName) > 3 {
-		return nil, errors.New("first_name must not exceed 3 characters")
-	}
-	if req.LastName != "" && utf8.RuneCountInString(req.LastName) > 3 {
-		return nil, errors.New("last_name must not exceed 3 characters")
-	}
+// Patch applies a JSON Merge Patch (RFC 7396) to the profile of a user:
+// fields of patch replace those of the profile, null clears them and omitted
+// fields are kept. The merged profile is checked like the body of Replace.
+func (s *UserService) Patch(id int64, patch map[string]any, ifMatch string) (*models.User, error) {
+	return s.update(id, ifMatch, func(existing *models.User) (*models.UpdateUserRequest, error) {
+		current, err := json.Marshal(profile(existing))
+		if err != nil {
+			return nil, err
+		}
+		var target map[string]any
+		if err := json.Unmarshal(current, &target); err != nil {
+			return nil, err
+		}
+
+		merged, err := json.Marshal(mergePatch(target, patch))
+		if err != nil {
+			return nil, err
+		}
+		var req models.UpdateUserRequest
+		violations, err := validation.Decode(merged, &req)
+		if err != nil {
+			return nil, err
+		}
+		if len(violations) == 0 {
+			violations = s.validator.Struct(&req)
+		}
+		return &req, Invalid(violations)
+	})
+}
 
-	existing, err := s.repo.GetByID(id)
+// update locks the user, checks ifMatch and saves the profile built returns.
+func (s *UserService) update(id int64, ifMatch string, build func(existing *models.User) (*models.UpdateUserRequest, error)) (*models.User, error) {
+	var user *models.User
+	err := s.store.WithTx(func(tx repositories.Store) error {
+		existing, err := tx.Users().GetByIDForUpdate(id)
+		if err != nil {
+			return err
+		}
+		if !etagMatches(ifMatch, existing.ETag()) {
+			return ErrPreconditionFailed
+		}
+
+		req, err := build(existing)
+		if err != nil {
+			return err
+		}
+		existing.FirstName = req.FirstName
+		existing.LastName = req.LastName
+		existing.Email = req.Email
+		existing.Phone = req.Phone
+		existing.AvatarURL = req.AvatarURL
+		existing.Bio = req.Bio
+		existing.Locale = req.Locale
+		// Stored as is, so the ETag of the response is the one read back
+		existing.UpdatedAt = models.Now().Truncate(time.Microsecond)
+
+		user = existing
+		return tx.Users().Update(id, existing)
+	})
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		return nil, ErrUserNotFound.With(i18n.Params{"id": id})
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if req.FirstName != "" {
-		existing.FirstName = req.FirstName
+	return user, nil
+}
+
+// profile is the part of user that Replace and Patch change.
+func profile(user *models.User) *models.UpdateUserRequest {
+	return &models.UpdateUserRequest{
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Email:     user.Email,
+		Phone:     user.Phone,
+		AvatarURL: user.AvatarURL,
+		Bio:       user.Bio,
+		Locale:    user.Locale,
 	}
-	if req.LastName != "" {
-		existing.LastName = req.LastName
+}
+
+// mergePatch applies patch to target as RFC 7396 describes.
+func mergePatch(target, patch any) any {
+	fields, ok := patch.(map[string]any)
+	if !ok {
+		return patch
 	}
-	if req.Email != "" {
-		existing.Email = req.Email
+	merged, ok := target.(map[string]any)
+	if !ok {
+		merged = map[string]any{}
 	}
-	if req.Phone != "" {
-		existing.Phone = req.Phone
+	for name, value := range fields {
+		if value == nil {
+			delete(merged, name)
+		} else {
+			merged[name] = mergePatch(merged[name], value)
+		}
 	}
-	if req.AvatarURL != "" {
-		existing.AvatarURL = req.AvatarURL
+	return merged
+}
+
+// etagMatches reports whether the If-Match header ifMatch admits etag. An
+// empty header admits every version.
+func etagMatches(ifMatch, etag string) bool {
+	if ifMatch == "" {
+		return true
 	}
-	if req.Bio != "" {
-		existing.Bio = req.Bio
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			return true
+		}
 	}
+	return false
+}
 
-	existing.UpdatedAt = models.Now()
+// SetRole changes the role of a user and returns the updated user.
+func (s *UserService) SetRole(id int64, role models.Role) (*models.User, error) {
+	if !role.Valid() {
+		return nil, invalidField("role", "one_of", i18n.Params{"values": "user, support, admin"})
+	}
 
-	err = s.repo.Update(id, existing)
+	err := s.repo.UpdateRole(id, role)
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		return nil, ErrUserNotFound.With(i18n.Params{"id": id})
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return existing, nil
+	return s.GetByID(id)
+}
+
+// Close closes an account instead of deleting it, so its transfers and
+// ledger stay intact. A positive balance is first moved to req.SweepTo with a
+// completed transfer; accounts with a negative balance or with points held by
+// pending transfers cannot be closed. Closing a closed account does nothing.
+func (s *UserService) Close(id int64, req *models.CloseUserRequest, actor string) error {
+	if req.SweepTo == id {
+		return invalidField("sweep_to", "self_transfer", nil)
+	}
+
+	return s.store.WithTx(func(tx repositories.Store) error {
+		ids := []int64{id}
+		if req.SweepTo != 0 {
+			ids = append(ids, req.SweepTo)
+		}
+		users, err := lockUsers(tx, ids...)
+		if err != nil {
+			return err
+		}
+
+		user, ok := users[id]
+		if !ok {
+			return ErrUserNotFound.With(i18n.Params{"id": id})
+		}
+		if user.Status == models.UserClosed {
+			return nil
+		}
+		if user.HeldBalance > 0 {
+			return ErrPendingHolds.With(i18n.Params{"held": user.HeldBalance})
+		}
+		if user.PointsBalance < 0 {
+			return ErrBalanceRemaining.Variant("balance_negative", i18n.Params{"balance": user.PointsBalance})
+		}
+		if req.SweepTo != 0 {
+			if err := checkOpen(users, req.SweepTo); err != nil {
+				return err
+			}
+		}
+
+		now := models.Now()
+		if user.PointsBalance > 0 {
+			if req.SweepTo == 0 {
+				return ErrBalanceRemaining.With(i18n.Params{"balance": user.PointsBalance})
+			}
+			if err := sweep(tx, user, req.SweepTo, actor, now); err != nil {
+				return err
+			}
+		}
+
+		return tx.Users().UpdateStatus(id, models.UserClosed, &now)
+	})
 }
 
-func (s *UserService) Delete(id int64) error {
-	return s.repo.Delete(id)
+// sweep moves the whole balance of user to another user with a completed
+// transfer, so the move shows up in both ledgers like any other transfer.
+func sweep(tx repositories.Store, user *models.User, to int64, actor string, now time.Time) error {
+	transfer := &models.Transfer{
+		IdemKey:     uuid.New().String(),
+		FromUserID:  user.ID,
+		ToUserID:    to,
+		Amount:      user.PointsBalance,
+		Status:      models.TransferCompleted,
+		Note:        "account closure",
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		CompletedAt: &now,
+	}
+	if err := tx.Transfers().Create(transfer); err != nil {
+		return err
+	}
+
+	err := tx.Transfers().CreateStatusHistory(&models.TransferStatusHistory{
+		TransferID: transfer.TransferID,
+		ToStatus:   transfer.Status,
+		Actor:      actor,
+		Reason:     "account closure",
+		CreatedAt:  now,
+	})
+	if err != nil {
+		return err
+	}
+
+	return settleTransfer(tx, transfer, now)
+}
+
+// Reopen makes a closed account active again. Reopening an active account
+// does nothing.
+func (s *UserService) Reopen(id int64) (*models.User, error) {
+	user, err := s.GetByID(id)
+	if err != nil || user.Status == models.UserActive {
+		return user, err
+	}
+
+	err = s.repo.UpdateStatus(id, models.UserActive, nil)
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		return nil, ErrUserNotFound.With(i18n.Params{"id": id})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetByID(id)
 }
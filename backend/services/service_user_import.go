@@ -0,0 +1,224 @@
+package services
+
+import (
+	"backend/i18n"
+	"backend/models"
+	"backend/repositories"
+	"encoding/csv"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DefaultImportMaxRows is the largest number of rows a user import may have.
+const DefaultImportMaxRows = 10000
+
+// ImportRow is the outcome of one row of a user import. Err lists the
+// problems of an invalid row; User is set once the user is created. Failed
+// is why a valid row could not be created with models.ImportCommitRow.
+type ImportRow struct {
+	Line    int
+	User    *models.User
+	Err     *ValidationError
+	Failed  error
+	Skipped bool
+}
+
+// SetImport sets how imports commit their rows, models.ImportCommitAll or
+// models.ImportCommitRow, and how many rows they may have.
+func (s *UserService) SetImport(commit string, maxRows int) {
+	s.importCommit = commit
+	s.importMaxRows = maxRows
+}
+
+// Import creates a user for each row of the CSV in r. Every row is checked
+// before anything is written; a dry run stops there. With
+// models.ImportCommitAll the users are created in one transaction and only
+// when every row is valid, with models.ImportCommitRow each valid row is
+// created on its own: a row that cannot be created is marked Failed and the
+// rest are still imported.
+//
+// Problems with the file itself, such as a missing column, reject the whole
+// import with ErrInvalidCSV.
+func (s *UserService) Import(r io.Reader, dryRun bool) ([]ImportRow, error) {
+	rows, reqs, err := s.readImport(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return rows, nil
+	}
+
+	if s.importCommit == models.ImportCommitRow {
+		for i := range rows {
+			if rows[i].Err != nil {
+				continue
+			}
+			var user *models.User
+			err := s.store.WithTx(func(tx repositories.Store) (err error) {
+				user, err = s.createImported(tx, reqs[i])
+				return err
+			})
+			if err != nil {
+				rows[i].Failed = err
+				continue
+			}
+			rows[i].User = user
+		}
+		return rows, nil
+	}
+
+	// One invalid row rejects the file
+	for _, row := range rows {
+		if row.Err == nil {
+			continue
+		}
+		for i := range rows {
+			rows[i].Skipped = rows[i].Err == nil
+		}
+		return rows, nil
+	}
+	err = s.store.WithTx(func(tx repositories.Store) error {
+		for i := range rows {
+			user, err := s.createImported(tx, reqs[i])
+			if err != nil {
+				return err
+			}
+			rows[i].User = user
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// readImport parses and checks the rows of an import CSV. Columns are
+// matched by the names in the header, in any order.
+func (s *UserService) readImport(r io.Reader) ([]ImportRow, []*models.ImportUserRow, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil, ErrInvalidCSV.Variant("csv_empty", nil)
+	}
+	if err != nil {
+		return nil, nil, csvError(err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !importColumn(name) {
+			return nil, nil, ErrInvalidCSV.Variant("csv_unknown_column", i18n.Params{"column": name})
+		}
+		if _, ok := columns[name]; ok {
+			return nil, nil, ErrInvalidCSV.Variant("csv_duplicate_column", i18n.Params{"column": name})
+		}
+		columns[name] = i
+	}
+	for _, name := range []string{"first_name", "last_name"} {
+		if _, ok := columns[name]; !ok {
+			return nil, nil, ErrInvalidCSV.Variant("csv_missing_column", i18n.Params{"column": name})
+		}
+	}
+	value := func(record []string, name string) string {
+		if i, ok := columns[name]; ok {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var rows []ImportRow
+	var reqs []*models.ImportUserRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, csvError(err)
+		}
+		if len(rows) == s.importMaxRows {
+			return nil, nil, ErrInvalidCSV.Variant("csv_too_many_rows", i18n.Params{"max": s.importMaxRows})
+		}
+
+		req := &models.ImportUserRow{CreateUserRequest: models.CreateUserRequest{
+			FirstName: value(record, "first_name"),
+			LastName:  value(record, "last_name"),
+			Email:     value(record, "email"),
+			Phone:     value(record, "phone"),
+		}}
+		var balanceErr error
+		if v := value(record, "initial_balance"); v != "" {
+			req.InitialBalance, balanceErr = strconv.ParseInt(v, 10, 64)
+		}
+		invalid := validate(s.validator.Struct(req))
+		if balanceErr != nil {
+			invalid.Add("initial_balance", "integer", nil)
+		}
+
+		line, _ := cr.FieldPos(0)
+		row := ImportRow{Line: line}
+		if len(invalid.Fields) > 0 {
+			row.Err = invalid
+		}
+		rows = append(rows, row)
+		reqs = append(reqs, req)
+	}
+	return rows, reqs, nil
+}
+
+func importColumn(name string) bool {
+	for _, column := range models.ImportColumns {
+		if name == column {
+			return true
+		}
+	}
+	return false
+}
+
+// csvError reports where the CSV stopped making sense.
+func csvError(err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return ErrInvalidCSV.Variant("csv_malformed", i18n.Params{"line": parseErr.Line})
+	}
+	return err
+}
+
+// createImported creates the user of an import row in tx and credits its
+// initial balance.
+func (s *UserService) createImported(tx repositories.Store, req *models.ImportUserRow) (*models.User, error) {
+	user, err := s.newUser(&req.CreateUserRequest)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Users().Create(user); err != nil {
+		return nil, err
+	}
+	if req.InitialBalance == 0 {
+		return user, nil
+	}
+
+	if err := tx.Users().UpdateBalance(user.ID, req.InitialBalance); err != nil {
+		return nil, err
+	}
+	user.PointsBalance = req.InitialBalance
+	err = tx.Ledger().Create(&models.PointLedger{
+		UserID:       user.ID,
+		Change:       req.InitialBalance,
+		BalanceAfter: req.InitialBalance,
+		EventType:    "earn",
+		Reference:    "import",
+		CreatedAt:    user.CreatedAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -4,10 +4,10 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
-func SetupSwagger(app *fiber.App) {
+func SetupSwagger(app *fiber.App, specFile string) {
 	// Serve the OpenAPI spec file
 	app.Get("/swagger.yml", func(c *fiber.Ctx) error {
-		return c.SendFile("./swagger.yml")
+		return c.SendFile(specFile)
 	})
 
 	// Serve Swagger UI HTML
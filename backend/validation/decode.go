@@ -0,0 +1,144 @@
+package validation
+
+import (
+	"backend/i18n"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Decode parses a JSON object into v, a pointer to a struct. Fields of the
+// body that v does not have and values of the wrong JSON type are returned as
+// violations, all at once; the error is only set when the body is not a JSON
+// object. Nested objects and lists of objects are decoded just as strictly,
+// their fields reported as e.g. transfers[0].amount.
+//
+// Like encoding/json, body fields match the JSON names of v case-insensitively.
+func Decode(body []byte, v any) ([]Violation, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, errors.New("validation: body is not a JSON object")
+	}
+	return decodeObject(raw, reflect.ValueOf(v).Elem(), "")
+}
+
+// decodeObject decodes the fields of raw into the struct val; prefix is the
+// path of val in the body.
+func decodeObject(raw map[string]json.RawMessage, val reflect.Value, prefix string) ([]Violation, error) {
+	var violations []Violation
+	var decodeErr error
+	eachField(val, func(field reflect.StructField, fieldValue reflect.Value) {
+		name := jsonName(field)
+		for key, value := range raw {
+			if !strings.EqualFold(key, name) {
+				continue
+			}
+			delete(raw, key)
+
+			fieldViolations, err := decodeValue(value, fieldValue, prefix+name)
+			violations = append(violations, fieldViolations...)
+			if err != nil && decodeErr == nil {
+				decodeErr = err
+			}
+			return
+		}
+	})
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	unknown := make([]string, 0, len(raw))
+	for key := range raw {
+		unknown = append(unknown, key)
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		violations = append(violations, Violation{Field: prefix + key, Code: "unknown_field"})
+	}
+
+	return violations, nil
+}
+
+// decodeValue decodes data into v, which is reported as name. Structs and
+// lists of structs are walked field by field; other values are left to
+// encoding/json.
+func decodeValue(data json.RawMessage, v reflect.Value, name string) ([]Violation, error) {
+	typeViolation := []Violation{{Field: name, Code: "type", Params: i18n.Params{"type": jsonType(v.Type())}}}
+	if string(data) == "null" {
+		v.SetZero()
+		return nil, nil
+	}
+
+	switch {
+	case v.Kind() == reflect.Pointer && strictStruct(v.Type().Elem()):
+		elem := reflect.New(v.Type().Elem())
+		violations, err := decodeValue(data, elem.Elem(), name)
+		v.Set(elem)
+		return violations, err
+
+	case strictStruct(v.Type()):
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return typeViolation, nil
+		}
+		return decodeObject(raw, v, name+".")
+
+	case v.Kind() == reflect.Slice && strictStruct(v.Type().Elem()):
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return typeViolation, nil
+		}
+		list := reflect.MakeSlice(v.Type(), len(items), len(items))
+		var violations []Violation
+		for i, item := range items {
+			itemViolations, err := decodeValue(item, list.Index(i), fmt.Sprintf("%s[%d]", name, i))
+			if err != nil {
+				return nil, err
+			}
+			violations = append(violations, itemViolations...)
+		}
+		v.Set(list)
+		return violations, nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	err := json.Unmarshal(data, v.Addr().Interface())
+	if errors.As(err, &typeErr) {
+		return typeViolation, nil
+	}
+	return nil, err
+}
+
+// strictStruct reports whether t is a struct decoded field by field, rather
+// than one with its own JSON decoding such as time.Time.
+func strictStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && !reflect.PointerTo(t).Implements(unmarshalerType)
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// jsonType names the JSON type a Go type is decoded from.
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonType(t.Elem())
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
@@ -0,0 +1,265 @@
+// Package validation checks request DTOs against the rules in their validate
+// struct tags, e.g.
+//
+//	Email string `json:"email,omitempty" validate:"max=254,email"`
+//
+// Rules are separated by commas and checked in order; the first rule a field
+// fails is reported and the remaining fields are still checked, so a caller
+// gets every problem at once. String rules other than required pass on an
+// empty string, so optional fields only need their format rules.
+//
+// Fields are reported by their JSON name and problems by a code, which is
+// also the i18n key "field.<code>" of the message.
+package validation
+
+import (
+	"backend/i18n"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Violation is a problem with one field.
+type Violation struct {
+	Field  string
+	Code   string
+	Params i18n.Params
+}
+
+// Rule checks the value of a field; arg is the text after "=" in the tag.
+// It returns the code and params of the problem, or an empty code when the
+// value is valid.
+type Rule func(v reflect.Value, arg string) (code string, params i18n.Params)
+
+// Validator holds the rules the validate tags may use.
+type Validator struct {
+	rules map[string]Rule
+}
+
+// New returns a validator with the built-in rules: required, min, max,
+// maxbytes, positive, nonzero, oneof, email, phone, url, username, json and
+// locale.
+func New() *Validator {
+	return &Validator{rules: map[string]Rule{
+		"required": required,
+		"min":      minRule,
+		"max":      maxRule,
+		"maxbytes": maxBytes,
+		"positive": positive,
+		"nonzero":  nonZero,
+		"oneof":    oneOf,
+		"email":    stringRule("email", isEmail),
+		"phone":    stringRule("phone", phonePattern.MatchString),
+		"url":      stringRule("url", isURL),
+		"username": stringRule("username_format", usernamePattern.MatchString),
+		"json":     jsonRule,
+		"locale":   locale,
+	}}
+}
+
+// Register adds a rule, or replaces the one with the same name, so a service
+// can check a setting that is only known at run time.
+func (v *Validator) Register(name string, rule Rule) {
+	v.rules[name] = rule
+}
+
+// Default is the validator with the built-in rules.
+var Default = New()
+
+// Struct checks s, a struct or a pointer to one, with the Default validator.
+func Struct(s any) []Violation {
+	return Default.Struct(s)
+}
+
+// Struct checks every field of s, a struct or a pointer to one, against its
+// validate tag. It panics on a tag naming a rule that does not exist, as that
+// is a programming error.
+func (v *Validator) Struct(s any) []Violation {
+	var violations []Violation
+	eachField(reflect.Indirect(reflect.ValueOf(s)), func(field reflect.StructField, value reflect.Value) {
+		tag := field.Tag.Get("validate")
+		if tag == "" {
+			return
+		}
+
+		for _, spec := range strings.Split(tag, ",") {
+			name, arg, _ := strings.Cut(spec, "=")
+			rule, ok := v.rules[name]
+			if !ok {
+				panic(fmt.Sprintf("validation: field %s: unknown rule %q", field.Name, name))
+			}
+
+			// Optional values are pointers: a nil one only fails required,
+			// the others are checked by what they point to
+			checked := value
+			if value.Kind() == reflect.Pointer && !value.IsNil() {
+				checked = value.Elem()
+			} else if value.Kind() == reflect.Pointer && name != "required" {
+				continue
+			}
+			if code, params := rule(checked, arg); code != "" {
+				violations = append(violations, Violation{Field: jsonName(field), Code: code, Params: params})
+				return
+			}
+		}
+	})
+	return violations
+}
+
+// eachField calls fn with the exported fields of the struct val, including
+// the fields of embedded structs, as they appear in a JSON body.
+func eachField(val reflect.Value, fn func(field reflect.StructField, value reflect.Value)) {
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		switch {
+		case field.Anonymous && field.Type.Kind() == reflect.Struct && field.Tag.Get("json") == "":
+			eachField(val.Field(i), fn)
+		case field.IsExported() && jsonName(field) != "-":
+			fn(field, val.Field(i))
+		}
+	}
+}
+
+// jsonName is the name of field in a JSON body.
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// required rejects zero values, and empty lists.
+func required(v reflect.Value, _ string) (string, i18n.Params) {
+	if v.IsZero() || (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0 {
+		return "required", nil
+	}
+	return "", nil
+}
+
+// minRule bounds the length of strings and the value of numbers.
+func minRule(v reflect.Value, arg string) (string, i18n.Params) {
+	limit := mustInt(arg)
+	switch {
+	case v.Kind() == reflect.String:
+		if v.Len() > 0 && int64(utf8.RuneCountInString(v.String())) < limit {
+			return "min_length", i18n.Params{"min": limit}
+		}
+	case v.CanInt():
+		if v.Int() < limit {
+			return "min_value", i18n.Params{"min": limit}
+		}
+	}
+	return "", nil
+}
+
+// maxRule bounds the length of strings and the value of numbers.
+func maxRule(v reflect.Value, arg string) (string, i18n.Params) {
+	limit := mustInt(arg)
+	switch {
+	case v.Kind() == reflect.String:
+		if int64(utf8.RuneCountInString(v.String())) > limit {
+			return "max_length", i18n.Params{"max": limit}
+		}
+	case v.CanInt():
+		if v.Int() > limit {
+			return "max_value", i18n.Params{"max": limit}
+		}
+	}
+	return "", nil
+}
+
+// maxBytes bounds the length of strings in bytes, for values such as
+// passwords that are limited by their encoding rather than by characters.
+func maxBytes(v reflect.Value, arg string) (string, i18n.Params) {
+	if limit := mustInt(arg); int64(len(v.String())) > limit {
+		return "max_bytes", i18n.Params{"max": limit}
+	}
+	return "", nil
+}
+
+func positive(v reflect.Value, _ string) (string, i18n.Params) {
+	if v.CanInt() && v.Int() <= 0 {
+		return "positive", nil
+	}
+	return "", nil
+}
+
+func nonZero(v reflect.Value, _ string) (string, i18n.Params) {
+	if v.CanInt() && v.Int() == 0 {
+		return "non_zero", nil
+	}
+	return "", nil
+}
+
+// jsonRule checks raw JSON such as a json.RawMessage; empty is allowed.
+func jsonRule(v reflect.Value, _ string) (string, i18n.Params) {
+	if v.Kind() == reflect.Slice && v.Len() > 0 && !json.Valid(v.Bytes()) {
+		return "json", nil
+	}
+	return "", nil
+}
+
+// oneOf takes the allowed values separated by spaces, e.g. oneof=en th.
+func oneOf(v reflect.Value, arg string) (string, i18n.Params) {
+	values := strings.Fields(arg)
+	s := v.String()
+	if s == "" {
+		return "", nil
+	}
+	for _, allowed := range values {
+		if s == allowed {
+			return "", nil
+		}
+	}
+	return "one_of", i18n.Params{"values": strings.Join(values, ", ")}
+}
+
+// locale accepts the languages that have a message catalog.
+func locale(v reflect.Value, _ string) (string, i18n.Params) {
+	return oneOf(v, strings.Join(i18n.Languages(), " "))
+}
+
+// stringRule reports code for a non-empty string that valid rejects.
+func stringRule(code string, valid func(string) bool) Rule {
+	return func(v reflect.Value, _ string) (string, i18n.Params) {
+		if s := v.String(); s != "" && !valid(s) {
+			return code, nil
+		}
+		return "", nil
+	}
+}
+
+// phonePattern accepts international and local numbers, e.g. +66812345678
+// or 081-234-5678.
+var phonePattern = regexp.MustCompile(`^\+?[0-9](?:[ -]?[0-9]){6,14}$`)
+
+// usernamePattern accepts the login names of local accounts.
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{3,64}$`)
+
+// isEmail accepts a bare address such as somchai@example.com, without a
+// display name.
+func isEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s
+}
+
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func mustInt(arg string) int64 {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		panic(fmt.Sprintf("validation: bad rule argument %q", arg))
+	}
+	return n
+}